@@ -4,26 +4,23 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"sync"
+	"path/filepath"
 	"testing"
 	"time"
 )
 
-var testServices map[string]ServiceConfig
-var servicesMutex sync.Mutex
-
-func init() {
-	resetTestServices()
-}
-
-func resetTestServices() {
-	servicesMutex.Lock()
-	defer servicesMutex.Unlock()
-
-	testServices = make(map[string]ServiceConfig)
-	for k, v := range services {
-		testServices[k] = v
+// testGateway writes the routes to a file in a temporary directory and
+// loads them.
+func testGateway(t *testing.T, routes string) *Gateway {
+	path := filepath.Join(t.TempDir(), "routes.yaml")
+	if err := os.WriteFile(path, []byte(routes), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := NewGateway(path, nil)
+	if err != nil {
+		t.Fatalf("failed to load routes: %v", err)
 	}
+	return gateway
 }
 
 func TestHealthCheckHandler(t *testing.T) {
@@ -37,30 +34,28 @@ func TestHealthCheckHandler(t *testing.T) {
 	}))
 	defer fileAnalysisSrv.Close()
 
-	resetTestServices()
-	servicesMutex.Lock()
-	testServices["files"] = ServiceConfig{
-		Name:   "File Storing Service",
-		URL:    fileStoringSrv.URL,
-		Client: &http.Client{Timeout: 1 * time.Second},
-	}
-	testServices["analyze"] = ServiceConfig{
-		Name:   "File Analysis Service",
-		URL:    fileAnalysisSrv.URL,
-		Client: &http.Client{Timeout: 1 * time.Second},
-	}
-	testServices["wordcloud"] = testServices["analyze"]
-	servicesMutex.Unlock()
+	badSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer badSrv.Close()
 
-	origServices := services
-	services = testServices
-	defer func() { services = origServices }()
+	routes := func(fileStoringURL string) string {
+		return `
+upstreams:
+  file-storing: {name: File Storing Service, url: "` + fileStoringURL + `"}
+  file-analysis: {name: File Analysis Service, url: "` + fileAnalysisSrv.URL + `"}
+routes:
+  - {prefix: /api/files, upstream: file-storing, strip_prefix: /api}
+  - {prefix: /api/analyze, upstream: file-analysis, strip_prefix: /api}
+`
+	}
 
 	t.Run("Successful health check", func(t *testing.T) {
+		gateway := testGateway(t, routes(fileStoringSrv.URL))
 		req := httptest.NewRequest("GET", "/health", nil)
 		rr := httptest.NewRecorder()
 
-		healthCheckHandler(rr, req)
+		gateway.Health(rr, req)
 
 		if rr.Code != http.StatusOK {
 			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
@@ -68,23 +63,11 @@ func TestHealthCheckHandler(t *testing.T) {
 	})
 
 	t.Run("Unhealthy service", func(t *testing.T) {
-		badSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			w.WriteHeader(http.StatusInternalServerError)
-		}))
-		defer badSrv.Close()
-
-		servicesMutex.Lock()
-		testServices["files"] = ServiceConfig{
-			Name:   "File Storing Service",
-			URL:    badSrv.URL,
-			Client: &http.Client{Timeout: 1 * time.Second},
-		}
-		servicesMutex.Unlock()
-
+		gateway := testGateway(t, routes(badSrv.URL))
 		req := httptest.NewRequest("GET", "/health", nil)
 		rr := httptest.NewRecorder()
 
-		healthCheckHandler(rr, req)
+		gateway.Health(rr, req)
 
 		if rr.Code != http.StatusServiceUnavailable {
 			t.Errorf("expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
@@ -93,36 +76,50 @@ func TestHealthCheckHandler(t *testing.T) {
 }
 
 func TestApiHandler(t *testing.T) {
+	var forwardedURL, forwardedPrefix string
 	mockSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		forwardedURL = r.URL.String()
+		forwardedPrefix = r.Header.Get("X-Forwarded-Prefix")
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte(`{"test":"response"}`))
 	}))
 	defer mockSrv.Close()
 
-	resetTestServices()
-	servicesMutex.Lock()
-	testServices["test"] = ServiceConfig{
-		Name:   "Test Service",
-		URL:    mockSrv.URL,
-		Client: &http.Client{Timeout: 1 * time.Second},
-	}
-	servicesMutex.Unlock()
-
-	origServices := services
-	services = testServices
-	defer func() { services = origServices }()
+	gateway := testGateway(t, `
+upstreams:
+  test: {name: Test Service, url: "`+mockSrv.URL+`/"}
+routes:
+  - prefix: /api/test
+    upstream: test
+    methods: [get, post]
+    strip_prefix: /api
+  - prefix: /api/test/v2
+    upstream: test
+    strip_prefix: /api/test/v2
+    add_prefix: /internal
+  - prefix: /api/slow
+    upstream: test
+    strip_prefix: /api
+    timeout: 50ms
+`)
 
 	tests := []struct {
 		name           string
 		url            string
 		method         string
 		expectedStatus int
+		expectedURL    string
 	}{
 		{
 			name:           "Existing service",
 			url:            "/api/test/endpoint",
 			method:         "GET",
 			expectedStatus: http.StatusOK,
+			expectedURL:    "/test/endpoint",
 		},
 		{
 			name:           "Non-existent service",
@@ -130,20 +127,176 @@ func TestApiHandler(t *testing.T) {
 			method:         "GET",
 			expectedStatus: http.StatusNotFound,
 		},
+		{
+			name:           "Prefix matches whole segments only",
+			url:            "/api/testing",
+			method:         "GET",
+			expectedStatus: http.StatusNotFound,
+		},
+		{
+			name:           "Method not allowed",
+			url:            "/api/test/endpoint",
+			method:         "DELETE",
+			expectedStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:           "Longest prefix wins and is rewritten",
+			url:            "/api/test/v2/items",
+			method:         "DELETE",
+			expectedStatus: http.StatusOK,
+			expectedURL:    "/internal/items",
+		},
+		{
+			name:           "Route timeout",
+			url:            "/api/slow",
+			method:         "GET",
+			expectedStatus: http.StatusGatewayTimeout,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
+			forwardedURL = ""
 			req := httptest.NewRequest(tt.method, tt.url, nil)
 			rr := httptest.NewRecorder()
 
-			apiHandler(rr, req)
+			gateway.ServeHTTP(rr, req)
 
 			if rr.Code != tt.expectedStatus {
 				t.Errorf("expected status %d, got %d", tt.expectedStatus, rr.Code)
 			}
+			if tt.expectedURL != "" && forwardedURL != tt.expectedURL {
+				t.Errorf("expected upstream path %q, got %q", tt.expectedURL, forwardedURL)
+			}
 		})
 	}
+
+	t.Run("Query string is forwarded", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/test?sort=name&limit=5", nil)
+		gateway.ServeHTTP(httptest.NewRecorder(), req)
+
+		if forwardedURL != "/test?sort=name&limit=5" {
+			t.Errorf("expected query to be forwarded, got %q", forwardedURL)
+		}
+		if forwardedPrefix != "/api" {
+			t.Errorf("expected X-Forwarded-Prefix /api, got %q", forwardedPrefix)
+		}
+	})
+}
+
+func TestParseRoutes(t *testing.T) {
+	t.Setenv("FILE_STORING_SERVICE_URL", "http://storage:9000")
+	data, err := os.ReadFile("routes.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, err := ParseRoutes(data)
+	if err != nil {
+		t.Fatalf("routes.yaml does not load: %v", err)
+	}
+
+	for path, expected := range map[string]string{
+		"/api/files/123/content":  "http://storage:9000/files/123/content",
+		"/api/uploads/abc":        "http://storage:9000/uploads/abc",
+		"/api/analysis/1/history": "http://file-analysis-service:8082/analysis/1/history",
+		"/api/reindex":            "http://file-analysis-service:8082/reindex",
+	} {
+		route := table.Match(path)
+		if route == nil {
+			t.Errorf("no route for %s", path)
+			continue
+		}
+		if target := route.Upstream.URL + route.Rewrite(path); target != expected {
+			t.Errorf("%s: expected %s, got %s", path, expected, target)
+		}
+	}
+	if route := table.Match("/api/uploads/abc"); route.Timeout != 5*time.Minute || !route.Allows("PATCH") {
+		t.Errorf("unexpected uploads route %+v", route)
+	}
+	files := table.Match("/api/files")
+	if !files.Permits("GET", []string{"student"}) || files.Permits("DELETE", []string{"teacher"}) || !files.Permits("DELETE", []string{"admin"}) {
+		t.Errorf("unexpected roles of files route %v", files.Roles)
+	}
+
+	for name, routes := range map[string]string{
+		"Unknown upstream":      "routes:\n  - {prefix: /api/x, upstream: missing}",
+		"Unknown field":         "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /api/x, upstream: a, timeuot: 5s}",
+		"Invalid url":           "upstreams:\n  a: {url: 'a:8080'}",
+		"Prefix without slash":  "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: api, upstream: a}",
+		"Strip not a prefix":    "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /api/x, upstream: a, strip_prefix: /other}",
+		"Duplicate prefix":      "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a}\n  - {prefix: /x/, upstream: a}",
+		"Roles of other method": "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a, methods: [GET], roles: {POST: [admin]}}",
+		"Public with roles":     "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a, public: true, roles: {GET: [admin]}}",
+		"Empty roles":           "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a, roles: {GET: []}}",
+		"Rate without period":   "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a, rate_limit: {requests: 10}}",
+		"Empty rate limit":      "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a, rate_limit: {}}",
+		"Backoff over maximum":  "upstreams:\n  a: {url: 'http://a'}\nroutes:\n  - {prefix: /x, upstream: a, retry: {backoff: 5s, max_backoff: 1s}}",
+		"Negative breaker":      "upstreams:\n  a: {url: 'http://a', circuit_breaker: {failures: -1}}",
+	} {
+		if _, err := ParseRoutes([]byte(routes)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestReloadRoutes(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old/wait" {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	routes := func(prefix string) string {
+		return `
+upstreams:
+  test: {url: "` + upstream.URL + `"}
+routes:
+  - {prefix: /api/` + prefix + `, upstream: test, strip_prefix: /api}
+`
+	}
+	gateway := testGateway(t, routes("old"))
+
+	inFlight := make(chan int)
+	go func() {
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, httptest.NewRequest("GET", "/api/old/wait", nil))
+		inFlight <- rr.Code
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.WriteFile(gateway.routesPath, []byte(routes("new")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := gateway.Reload(); err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("in-flight request finished with %d", code)
+	}
+
+	for path, expected := range map[string]int{"/api/old/x": http.StatusNotFound, "/api/new/x": http.StatusOK} {
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != expected {
+			t.Errorf("%s: expected status %d, got %d", path, expected, rr.Code)
+		}
+	}
+
+	t.Run("Broken file keeps the previous routes", func(t *testing.T) {
+		os.WriteFile(gateway.routesPath, []byte("routes: [nonsense"), 0o644)
+		if err := gateway.Reload(); err == nil {
+			t.Fatal("expected reload to fail")
+		}
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, httptest.NewRequest("GET", "/api/new/x", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected the previous routes to stay, got %d", rr.Code)
+		}
+	})
 }
 
 func TestMain(m *testing.M) {
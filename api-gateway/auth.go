@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/yaml.v3"
+)
+
+// Headers the gateway sets for the backends from the verified credentials.
+// Copies sent by clients are removed before a request is forwarded.
+const (
+	userIDHeader      = "X-User-ID"
+	userRolesHeader   = "X-User-Roles"
+	userCoursesHeader = "X-User-Courses"
+	apiKeyHeader      = "X-API-Key"
+
+	// serviceTokenHeader carries the token the services authenticate
+	// with to each other. Only they may set it.
+	serviceTokenHeader = "X-Service-Token"
+)
+
+// anonymousIdentity is forwarded when authentication is disabled. It is
+// an ordinary user, so the services restrict it like any other.
+var anonymousIdentity = &Identity{Subject: "anonymous", Roles: []string{"student"}}
+
+// tokenLeeway allows for clock skew between the issuer and the gateway.
+const tokenLeeway = 30 * time.Second
+
+var (
+	errNoCredentials      = errors.New("no credentials")
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is the caller a request was authenticated as. Courses are the
+// courses the caller studies or teaches.
+type Identity struct {
+	Subject string
+	Roles   []string
+	Courses []string
+}
+
+type Claims struct {
+	Roles   []string `json:"roles"`
+	Courses []string `json:"courses"`
+	jwt.RegisteredClaims
+}
+
+type APIKeysFile struct {
+	Keys []APIKey `yaml:"keys"`
+}
+
+// APIKey is a key for scripts. Only the SHA-256 of the key is stored.
+type APIKey struct {
+	Name    string   `yaml:"name"`
+	Hash    string   `yaml:"hash"`
+	Subject string   `yaml:"subject"`
+	Roles   []string `yaml:"roles"`
+	Courses []string `yaml:"courses"`
+}
+
+type AuthConfig struct {
+	// JWTSecret verifies HMAC-signed tokens of the local issuer.
+	JWTSecret string
+	// JWKSFile holds the public keys of an external issuer.
+	JWKSFile    string
+	APIKeysFile string
+	Issuer      string
+	Audience    string
+}
+
+type Authenticator struct {
+	secret   []byte
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+	parser   *jwt.Parser
+	// apiKeys are indexed by the hex SHA-256 of the key.
+	apiKeys map[string]*APIKey
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := &Authenticator{
+		keys:     make(map[string]crypto.PublicKey),
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		apiKeys:  make(map[string]*APIKey),
+	}
+	var methods []string
+	if config.JWTSecret != "" {
+		a.secret = []byte(config.JWTSecret)
+		methods = append(methods, "HS256", "HS384", "HS512")
+	}
+	if config.JWKSFile != "" {
+		data, err := os.ReadFile(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.keys, err = ParseJWKS(data); err != nil {
+			return nil, err
+		}
+		methods = append(methods, "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA")
+	}
+	if config.APIKeysFile != "" {
+		data, err := os.ReadFile(config.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+		if a.apiKeys, err = ParseAPIKeys(data); err != nil {
+			return nil, err
+		}
+	}
+	if len(methods) == 0 && len(a.apiKeys) == 0 {
+		return nil, errors.New("no JWT secret, JWKS file or API keys configured")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(tokenLeeway),
+	}
+	if a.issuer != "" {
+		options = append(options, jwt.WithIssuer(a.issuer))
+	}
+	if a.audience != "" {
+		options = append(options, jwt.WithAudience(a.audience))
+	}
+	if len(methods) > 0 {
+		a.parser = jwt.NewParser(options...)
+	}
+	return a, nil
+}
+
+// Authenticate verifies the API key in X-API-Key or the bearer token in
+// Authorization.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if key := r.Header.Get(apiKeyHeader); key != "" {
+		apiKey, ok := a.apiKeys[HashAPIKey(key)]
+		if !ok {
+			return nil, errInvalidCredentials
+		}
+		return &Identity{Subject: apiKey.Subject, Roles: apiKey.Roles, Courses: apiKey.Courses}, nil
+	}
+
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errNoCredentials
+	}
+	if a.parser == nil {
+		return nil, errInvalidCredentials
+	}
+	var claims Claims
+	if _, err := a.parser.ParseWithClaims(token, &claims, a.verificationKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidCredentials, err)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: token has no subject", errInvalidCredentials)
+	}
+	return &Identity{Subject: claims.Subject, Roles: claims.Roles, Courses: claims.Courses}, nil
+}
+
+// verificationKey picks the key for a token: the shared secret for HMAC and
+// the JWKS key named by kid otherwise. A JWKS with a single key may be used
+// without kid.
+func (a *Authenticator) verificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return a.secret, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(a.keys) == 1 {
+		for _, key := range a.keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+// IssueToken signs a token with the local issuer's secret.
+func (a *Authenticator) IssueToken(subject string, roles, courses []string, ttl time.Duration) (string, error) {
+	if a.secret == nil {
+		return "", errors.New("no JWT secret configured")
+	}
+	now := time.Now()
+	claims := Claims{
+		Roles:   roles,
+		Courses: courses,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			Issuer:    a.issuer,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	if a.audience != "" {
+		claims.Audience = jwt.ClaimStrings{a.audience}
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+}
+
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPIKey generates a random API key.
+func NewAPIKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+func ParseAPIKeys(data []byte) (map[string]*APIKey, error) {
+	var file APIKeysFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid API keys file: %v", err)
+	}
+
+	keys := make(map[string]*APIKey)
+	for i := range file.Keys {
+		key := &file.Keys[i]
+		key.Hash = strings.ToLower(key.Hash)
+		if decoded, err := hex.DecodeString(key.Hash); err != nil || len(decoded) != sha256.Size {
+			return nil, fmt.Errorf("API key %d: hash must be a hex SHA-256", i+1)
+		}
+		if key.Subject == "" {
+			return nil, fmt.Errorf("API key %d: no subject", i+1)
+		}
+		if _, exists := keys[key.Hash]; exists {
+			return nil, fmt.Errorf("API key %d: duplicate hash", i+1)
+		}
+		keys[key.Hash] = key
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseJWKS reads the signing keys of a JSON Web Key Set. RSA, EC and
+// Ed25519 keys are supported; encryption keys are skipped.
+func ParseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %q: %v", jwk.Kid, err)
+		}
+		if _, exists := keys[jwk.Kid]; exists {
+			return nil, fmt.Errorf("JWKS key %q: duplicate kid", jwk.Kid)
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS has no signing keys")
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errors.New("RSA key shorter than 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, errX := decodeBigInt(k.X)
+		y, errY := decodeBigInt(k.Y)
+		if errX != nil || errY != nil || !curve.IsOnCurve(x, y) {
+			return nil, errors.New("invalid EC point")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid base64url number")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
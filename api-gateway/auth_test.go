@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func writeTempFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func bearer(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/api/files", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func TestAuthenticate(t *testing.T) {
+	key := "test-api-key"
+	keysFile := writeTempFile(t, "keys.yaml", `
+keys:
+  - name: grader
+    hash: `+strings.ToUpper(HashAPIKey(key))+`
+    subject: grader-bot
+    roles: [teacher]
+`)
+	auth, err := NewAuthenticator(AuthConfig{
+		JWTSecret:   "secret",
+		APIKeysFile: keysFile,
+		Issuer:      "antiplagiat",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Local issuer token", func(t *testing.T) {
+		token, err := auth.IssueToken("student42", []string{"student"}, nil, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		identity, err := auth.Authenticate(bearer(token))
+		if err != nil {
+			t.Fatalf("token rejected: %v", err)
+		}
+		if identity.Subject != "student42" || len(identity.Roles) != 1 || identity.Roles[0] != "student" {
+			t.Errorf("unexpected identity %+v", identity)
+		}
+	})
+
+	t.Run("API key", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/files", nil)
+		req.Header.Set(apiKeyHeader, key)
+		identity, err := auth.Authenticate(req)
+		if err != nil || identity.Subject != "grader-bot" {
+			t.Fatalf("expected grader-bot, got %+v, %v", identity, err)
+		}
+
+		req.Header.Set(apiKeyHeader, "wrong")
+		if _, err := auth.Authenticate(req); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("expected invalid credentials, got %v", err)
+		}
+	})
+
+	sign := func(method jwt.SigningMethod, key interface{}, claims jwt.MapClaims) string {
+		token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := func() jwt.MapClaims {
+		return jwt.MapClaims{"sub": "student42", "iss": "antiplagiat", "exp": time.Now().Add(time.Hour).Unix()}
+	}
+	expired, wrongIssuer, noExpiry, noSubject := valid(), valid(), valid(), valid()
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	wrongIssuer["iss"] = "someone-else"
+	delete(noExpiry, "exp")
+	delete(noSubject, "sub")
+
+	for name, token := range map[string]string{
+		"Wrong secret":       sign(jwt.SigningMethodHS256, []byte("other"), valid()),
+		"Expired":            sign(jwt.SigningMethodHS256, []byte("secret"), expired),
+		"Wrong issuer":       sign(jwt.SigningMethodHS256, []byte("secret"), wrongIssuer),
+		"No expiry":          sign(jwt.SigningMethodHS256, []byte("secret"), noExpiry),
+		"No subject":         sign(jwt.SigningMethodHS256, []byte("secret"), noSubject),
+		"Unsigned":           sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid()),
+		"Not a token at all": "garbage",
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := auth.Authenticate(bearer(token)); !errors.Is(err, errInvalidCredentials) {
+				t.Errorf("expected invalid credentials, got %v", err)
+			}
+		})
+	}
+
+	t.Run("No credentials", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/files", nil)
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		if _, err := auth.Authenticate(req); !errors.Is(err, errNoCredentials) {
+			t.Errorf("expected no credentials, got %v", err)
+		}
+	})
+}
+
+func TestAuthenticateJWKS(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	jwks := writeTempFile(t, "jwks.json", `{"keys": [
+		{"kty": "RSA", "kid": "rsa-1", "use": "sig", "n": "`+b64(rsaKey.N)+`", "e": "AQAB"},
+		{"kty": "EC", "kid": "ec-1", "crv": "P-256", "x": "`+b64(ecKey.X)+`", "y": "`+b64(ecKey.Y)+`"},
+		{"kty": "RSA", "kid": "enc-1", "use": "enc", "n": "AQAB", "e": "AQAB"}
+	]}`)
+	auth, err := NewAuthenticator(AuthConfig{JWKSFile: jwks, Audience: "gateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(method jwt.SigningMethod, kid string, key interface{}, audience string) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"sub":   "teacher7",
+			"aud":   audience,
+			"roles": []string{"teacher"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		})
+		token.Header["kid"] = kid
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+
+	for name, token := range map[string]string{
+		"RSA": sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, "gateway"),
+		"EC":  sign(jwt.SigningMethodES256, "ec-1", ecKey, "gateway"),
+	} {
+		identity, err := auth.Authenticate(bearer(token))
+		if err != nil || identity.Subject != "teacher7" || identity.Roles[0] != "teacher" {
+			t.Errorf("%s: unexpected result %+v, %v", name, identity, err)
+		}
+	}
+
+	for name, token := range map[string]string{
+		"Unknown kid":         sign(jwt.SigningMethodRS256, "rsa-2", rsaKey, "gateway"),
+		"Key of another type": sign(jwt.SigningMethodRS256, "ec-1", rsaKey, "gateway"),
+		"Wrong audience":      sign(jwt.SigningMethodRS256, "rsa-1", rsaKey, "other"),
+		"HMAC with no secret": sign(jwt.SigningMethodHS256, "rsa-1", []byte(""), "gateway"),
+	} {
+		if _, err := auth.Authenticate(bearer(token)); !errors.Is(err, errInvalidCredentials) {
+			t.Errorf("%s: expected invalid credentials, got %v", name, err)
+		}
+	}
+}
+
+func TestGatewayAuthentication(t *testing.T) {
+	var forwarded http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	auth, err := NewAuthenticator(AuthConfig{JWTSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway, err := NewGateway(writeTempFile(t, "routes.yaml", `
+upstreams:
+  test: {url: "`+upstream.URL+`"}
+routes:
+  - {prefix: /api/files, upstream: test, strip_prefix: /api}
+  - {prefix: /api/public, upstream: test, strip_prefix: /api, public: true}
+  - {prefix: /api/admin, upstream: test, strip_prefix: /api, roles: {"*": [admin]}}
+`), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := auth.IssueToken("student42", []string{"student", "ta"}, []string{"cs101"}, time.Hour)
+
+	t.Run("Missing credentials", func(t *testing.T) {
+		forwarded = nil
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, httptest.NewRequest("GET", "/api/files", nil))
+
+		if rr.Code != http.StatusUnauthorized || rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("expected 401 with WWW-Authenticate, got %d", rr.Code)
+		}
+		if forwarded != nil {
+			t.Error("request was forwarded")
+		}
+	})
+
+	t.Run("Identity replaces client headers", func(t *testing.T) {
+		req := bearer(token)
+		req.Header.Set(userIDHeader, "admin")
+		req.Header.Set(userRolesHeader, "admin")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		if got := forwarded.Values(userIDHeader); len(got) != 1 || got[0] != "student42" {
+			t.Errorf("expected X-User-ID student42, got %v", got)
+		}
+		if got := forwarded.Values(userRolesHeader); len(got) != 1 || got[0] != "student,ta" {
+			t.Errorf("expected X-User-Roles student,ta, got %v", got)
+		}
+		if got := forwarded.Get(userCoursesHeader); got != "cs101" {
+			t.Errorf("expected X-User-Courses cs101, got %q", got)
+		}
+		if forwarded.Get("Authorization") != "" {
+			t.Error("credentials were forwarded")
+		}
+	})
+
+	t.Run("Role not permitted", func(t *testing.T) {
+		forwarded = nil
+		req := bearer(token)
+		req.URL.Path = "/api/admin"
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", rr.Code)
+		}
+		if forwarded != nil {
+			t.Error("request was forwarded")
+		}
+	})
+
+	t.Run("Public route", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/public", nil)
+		req.Header.Set(userIDHeader, "admin")
+		req.Header.Set(serviceTokenHeader, "guess")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		if forwarded.Get(userIDHeader) != "" {
+			t.Error("client X-User-ID was forwarded")
+		}
+		if forwarded.Get(serviceTokenHeader) != "" {
+			t.Error("client service token was forwarded")
+		}
+	})
+
+	t.Run("Authentication disabled", func(t *testing.T) {
+		gateway := testGateway(t, `
+upstreams:
+  test: {url: "`+upstream.URL+`"}
+routes:
+  - {prefix: /api/files, upstream: test, strip_prefix: /api}
+`)
+		req := httptest.NewRequest("GET", "/api/files", nil)
+		req.Header.Set(userRolesHeader, "admin")
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", rr.Code)
+		}
+		if forwarded.Get(userIDHeader) != "anonymous" || forwarded.Get(userRolesHeader) != "student" {
+			t.Errorf("expected the anonymous student, got %q with roles %q", forwarded.Get(userIDHeader), forwarded.Get(userRolesHeader))
+		}
+	})
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	hash := HashAPIKey("key")
+	for name, keys := range map[string]string{
+		"Not a hash":     "keys:\n  - {hash: abc, subject: bot}",
+		"No subject":     "keys:\n  - {hash: " + hash + "}",
+		"Duplicate hash": "keys:\n  - {hash: " + hash + ", subject: a}\n  - {hash: " + hash + ", subject: b}",
+		"Unknown field":  "keys:\n  - {hash: " + hash + ", subject: a, key: plaintext}",
+	} {
+		if _, err := ParseAPIKeys([]byte(keys)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	defaultBreakerFailures = 5
+	defaultBreakerOpenFor  = 30 * time.Second
+	defaultBreakerProbes   = 1
+)
+
+// errCircuitOpen is returned for requests to an upstream whose circuit
+// breaker is open.
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig is the circuit breaker of an upstream as written in the
+// routes file. After Failures failed calls in a row the breaker opens and
+// requests are rejected for OpenFor; then up to Probes requests are let
+// through, and the first of them decides whether it closes or opens again.
+type BreakerConfig struct {
+	Failures int           `yaml:"failures"`
+	OpenFor  time.Duration `yaml:"open_for"`
+	Probes   int           `yaml:"probes"`
+}
+
+func newBreakerConfig(config *BreakerConfig) (*BreakerConfig, error) {
+	if config.Failures < 0 || config.OpenFor < 0 || config.Probes < 0 {
+		return nil, fmt.Errorf("circuit_breaker values must not be negative")
+	}
+	validated := *config
+	if validated.Failures == 0 {
+		validated.Failures = defaultBreakerFailures
+	}
+	if validated.OpenFor == 0 {
+		validated.OpenFor = defaultBreakerOpenFor
+	}
+	if validated.Probes == 0 {
+		validated.Probes = defaultBreakerProbes
+	}
+	return &validated, nil
+}
+
+type breakerState string
+
+const (
+	breakerClosed   breakerState = "closed"
+	breakerOpen     breakerState = "open"
+	breakerHalfOpen breakerState = "half-open"
+)
+
+// outcome is what a call tells the breaker about the upstream.
+type outcome int
+
+const (
+	outcomeSuccess outcome = iota
+	outcomeFailure
+	// outcomeUnknown is a call the client gave up on first.
+	outcomeUnknown
+)
+
+// CircuitBreaker stops calls to an upstream that keeps failing, so it can
+// recover instead of being retried into the ground.
+type CircuitBreaker struct {
+	mu       sync.Mutex
+	now      func() time.Time
+	config   *BreakerConfig
+	state    breakerState
+	failures int
+	// openUntil is when an open breaker becomes half-open.
+	openUntil time.Time
+	probes    int
+}
+
+func NewCircuitBreaker(config *BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{now: time.Now, config: config, state: breakerClosed}
+}
+
+// Configure replaces the settings after the routes file is reloaded. The
+// state is kept.
+func (b *CircuitBreaker) Configure(config *BreakerConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.config = config
+}
+
+// Allow asks to make a call. If the breaker lets it through, done must be
+// called with its outcome; otherwise Allow returns how long the breaker
+// stays open.
+func (b *CircuitBreaker) Allow() (done func(outcome), retryAfter time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	if b.state == breakerOpen && !now.Before(b.openUntil) {
+		b.state, b.probes = breakerHalfOpen, 0
+	}
+	switch b.state {
+	case breakerOpen:
+		return nil, b.openUntil.Sub(now), false
+	case breakerHalfOpen:
+		if b.probes >= b.config.Probes {
+			return nil, 0, false
+		}
+		b.probes++
+		return func(result outcome) { b.finishProbe(result) }, 0, true
+	}
+	return func(result outcome) { b.finish(result) }, 0, true
+}
+
+func (b *CircuitBreaker) finish(result outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Calls let through before the breaker opened do not count any more.
+	if b.state != breakerClosed {
+		return
+	}
+	switch result {
+	case outcomeSuccess:
+		b.failures = 0
+	case outcomeFailure:
+		if b.failures++; b.failures >= b.config.Failures {
+			b.open()
+		}
+	}
+}
+
+func (b *CircuitBreaker) finishProbe(result outcome) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerHalfOpen {
+		return
+	}
+	switch result {
+	case outcomeSuccess:
+		b.state, b.failures = breakerClosed, 0
+	case outcomeFailure:
+		b.open()
+	default:
+		b.probes--
+	}
+}
+
+func (b *CircuitBreaker) open() {
+	b.state = breakerOpen
+	b.openUntil = b.now().Add(b.config.OpenFor)
+	b.failures = 0
+}
+
+// State reports the state for /health.
+func (b *CircuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && !b.now().Before(b.openUntil) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// breaker returns the circuit breaker of an upstream, or nil if it has
+// none. Breakers are kept by URL across reloads of the routes file.
+func (g *Gateway) breaker(upstream *Upstream) *CircuitBreaker {
+	if upstream.Breaker == nil {
+		return nil
+	}
+	g.breakersMu.Lock()
+	defer g.breakersMu.Unlock()
+
+	breaker, ok := g.breakers[upstream.URL]
+	if !ok {
+		breaker = NewCircuitBreaker(upstream.Breaker)
+		g.breakers[upstream.URL] = breaker
+	} else {
+		breaker.Configure(upstream.Breaker)
+	}
+	return breaker
+}
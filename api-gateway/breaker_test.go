@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	breaker := NewCircuitBreaker(&BreakerConfig{Failures: 2, OpenFor: 10 * time.Second, Probes: 1})
+	breaker.now = func() time.Time { return now }
+
+	call := func(result outcome) bool {
+		done, _, ok := breaker.Allow()
+		if ok {
+			done(result)
+		}
+		return ok
+	}
+
+	call(outcomeFailure)
+	call(outcomeSuccess)
+	call(outcomeFailure)
+	if state := breaker.State(); state != breakerClosed {
+		t.Fatalf("failures not in a row opened the breaker: %s", state)
+	}
+	call(outcomeFailure)
+	if state := breaker.State(); state != breakerOpen {
+		t.Fatalf("expected open, got %s", state)
+	}
+	if _, retryAfter, ok := breaker.Allow(); ok || retryAfter != 10*time.Second {
+		t.Errorf("open breaker: expected rejection for 10s, got %v, %v", ok, retryAfter)
+	}
+
+	now = now.Add(10 * time.Second)
+	probe, _, ok := breaker.Allow()
+	if !ok {
+		t.Fatal("half-open breaker rejected the probe")
+	}
+	if _, _, ok := breaker.Allow(); ok {
+		t.Error("half-open breaker let through a second probe")
+	}
+	probe(outcomeFailure)
+	if state := breaker.State(); state != breakerOpen {
+		t.Fatalf("failed probe: expected open, got %s", state)
+	}
+
+	now = now.Add(10 * time.Second)
+	if !call(outcomeUnknown) || !call(outcomeSuccess) {
+		t.Fatal("probe slot was not released")
+	}
+	if state := breaker.State(); state != breakerClosed {
+		t.Errorf("successful probe: expected closed, got %s", state)
+	}
+}
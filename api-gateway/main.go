@@ -4,20 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-)
 
-type ServiceConfig struct {
-	Name   string
-	URL    string
-	Client *http.Client
-}
+	"github.com/redis/go-redis/v9"
+)
 
 type ErrorResponse struct {
 	Error   string `json:"error"`
@@ -25,25 +25,47 @@ type ErrorResponse struct {
 	Code    int    `json:"code"`
 }
 
-var (
-	services = map[string]ServiceConfig{
-		"files": {
-			Name:   "File Storing Service",
-			URL:    getEnv("FILE_STORING_SERVICE_URL", "http://file-storing-service:8081"),
-			Client: &http.Client{Timeout: 10 * time.Second},
-		},
-		"analyze": {
-			Name:   "File Analysis Service",
-			URL:    getEnv("FILE_ANALYSIS_SERVICE_URL", "http://file-analysis-service:8082"),
-			Client: &http.Client{Timeout: 15 * time.Second},
-		},
-		"wordcloud": {
-			Name:   "File Analysis Service",
-			URL:    getEnv("FILE_ANALYSIS_SERVICE_URL", "http://file-analysis-service:8082"),
-			Client: &http.Client{Timeout: 15 * time.Second},
-		},
+// healthTimeout limits each upstream health check.
+const healthTimeout = 5 * time.Second
+
+// Gateway forwards requests by the routing table loaded from routesPath. The
+// table is swapped atomically on reload, so a request is routed by the table
+// it started with.
+type Gateway struct {
+	routesPath    string
+	routes        atomic.Pointer[RouteTable]
+	routesModTime time.Time
+	routesSize    int64
+	// auth is nil when authentication is disabled.
+	auth   *Authenticator
+	limits LimitStore
+	client *http.Client
+	// breakers are the circuit breakers of upstreams by URL.
+	breakers   map[string]*CircuitBreaker
+	breakersMu sync.Mutex
+}
+
+// strippedHeaders are request headers that are not forwarded: the
+// credentials and the identity headers only the gateway and the services
+// may set.
+var strippedHeaders = []string{"Authorization", apiKeyHeader, userIDHeader, userRolesHeader, userCoursesHeader, serviceTokenHeader}
+
+// NewGateway loads the routing table. Timeouts are set per route, so the
+// client has none of its own. Rate limits are kept in memory until another
+// store is set.
+func NewGateway(routesPath string, auth *Authenticator) (*Gateway, error) {
+	g := &Gateway{
+		routesPath: routesPath,
+		auth:       auth,
+		limits:     NewMemoryLimitStore(),
+		client:     &http.Client{},
+		breakers:   make(map[string]*CircuitBreaker),
 	}
-)
+	if err := g.Reload(); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
 
 func getEnv(key, defaultValue string) string {
 	if value, exists := os.LookupEnv(key); exists {
@@ -53,47 +75,120 @@ func getEnv(key, defaultValue string) string {
 }
 
 func main() {
-	http.HandleFunc("/api/", apiHandler)
-	http.HandleFunc("/health", healthCheckHandler)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "token":
+			issueToken(os.Args[2:])
+			return
+		case "api-key":
+			generateAPIKey()
+			return
+		}
+	}
+
+	var auth *Authenticator
+	if getEnv("AUTH_DISABLED", "false") == "true" {
+		log.Println("Authentication is disabled, requests are forwarded for the anonymous student")
+	} else {
+		var err error
+		if auth, err = NewAuthenticator(authConfig()); err != nil {
+			log.Fatalf("Failed to configure authentication: %v", err)
+		}
+	}
+
+	gateway, err := NewGateway(getEnv("ROUTES_FILE", "routes.yaml"), auth)
+	if err != nil {
+		log.Fatalf("Failed to load routes: %v", err)
+	}
+	if redisURL := os.Getenv("RATE_LIMIT_REDIS_URL"); redisURL != "" {
+		options, err := redis.ParseURL(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid RATE_LIMIT_REDIS_URL: %v", err)
+		}
+		client := redis.NewClient(options)
+		if err := client.Ping(context.Background()).Err(); err != nil {
+			log.Printf("Redis for rate limits is unavailable, requests are let through until it is back: %v", err)
+		}
+		gateway.limits = NewRedisLimitStore(client)
+		log.Printf("Rate limits are kept in Redis at %s", options.Addr)
+	}
+	go gateway.WatchRoutes(context.Background())
+
+	http.Handle("/", gateway)
+	http.HandleFunc("/health", gateway.Health)
 
 	log.Println("API Gateway is running on :8080")
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
 
-func apiHandler(w http.ResponseWriter, r *http.Request) {
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	path := strings.TrimPrefix(r.URL.Path, "/api/")
-	parts := strings.Split(path, "/")
-	serviceName := parts[0]
-
-	service, exists := services[serviceName]
-	if !exists {
-		sendError(w, fmt.Sprintf("Service '%s' not found", serviceName), http.StatusNotFound)
+	route := g.routes.Load().Match(r.URL.Path)
+	if route == nil {
+		sendError(w, fmt.Sprintf("No route for '%s'", r.URL.Path), http.StatusNotFound)
 		return
 	}
-
-	targetURL := service.URL + "/" + strings.Join(parts, "/")
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
-	if err != nil {
-		sendError(w, "Failed to create request", http.StatusInternalServerError)
+	if !route.Allows(r.Method) {
+		w.Header().Set("Allow", strings.Join(route.Methods, ", "))
+		sendError(w, fmt.Sprintf("Method %s not allowed", r.Method), http.StatusMethodNotAllowed)
 		return
 	}
-
-	for name, values := range r.Header {
-		for _, value := range values {
-			req.Header.Add(name, value)
+	var identity *Identity
+	if g.auth != nil && !route.Public {
+		var err error
+		if identity, err = g.auth.Authenticate(r); err != nil {
+			log.Printf("Rejected %s %s: %v", r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			sendError(w, "Valid bearer token or API key required", http.StatusUnauthorized)
+			return
+		}
+		if !route.Permits(r.Method, identity.Roles) {
+			log.Printf("Denied %s %s to %s with roles %v", r.Method, r.URL.Path, identity.Subject, identity.Roles)
+			sendError(w, "Your role does not allow this request", http.StatusForbidden)
+			return
 		}
 	}
+	if route.RateLimit != nil && !g.checkRateLimit(w, r, route, identity) {
+		return
+	}
+	service := route.Upstream
+
+	targetURL := service.URL + route.Rewrite(r.URL.Path)
+	if r.URL.RawQuery != "" {
+		targetURL += "?" + r.URL.RawQuery
+	}
+
+	header := r.Header.Clone()
+	for _, name := range strippedHeaders {
+		header.Del(name)
+	}
+	forwardedIdentity := identity
+	if g.auth == nil {
+		forwardedIdentity = anonymousIdentity
+	}
+	if forwardedIdentity != nil {
+		header.Set(userIDHeader, forwardedIdentity.Subject)
+		header.Set(userRolesHeader, strings.Join(forwardedIdentity.Roles, ","))
+		header.Set(userCoursesHeader, strings.Join(forwardedIdentity.Courses, ","))
+	}
 
-	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
-	req.Header.Set("X-Forwarded-Host", r.Host)
-	req.Header.Set("X-Forwarded-Proto", "http")
+	header.Set("X-Forwarded-For", r.RemoteAddr)
+	header.Set("X-Forwarded-Host", r.Host)
+	header.Set("X-Forwarded-Proto", "http")
+	if route.StripPrefix != "" {
+		header.Set("X-Forwarded-Prefix", route.StripPrefix)
+	}
 
 	log.Printf("Forwarding request to %s: %s %s", service.Name, r.Method, targetURL)
 
-	resp, err := service.Client.Do(req)
+	ctx, cancel := context.WithTimeout(r.Context(), route.Timeout)
+	defer cancel()
+	resp, retryAfter, err := g.send(ctx, route, r, targetURL, header)
 	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
+		if errors.Is(err, errCircuitOpen) {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(retryAfter))))
+			sendError(w, fmt.Sprintf("%s unavailable, circuit breaker open", service.Name), http.StatusServiceUnavailable)
+		} else if errors.Is(err, context.DeadlineExceeded) {
 			sendError(w, fmt.Sprintf("%s timeout", service.Name), http.StatusGatewayTimeout)
 		} else {
 			sendError(w, fmt.Sprintf("%s unavailable", service.Name), http.StatusBadGateway)
@@ -119,19 +214,27 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		r.Method, r.URL.Path, time.Since(start), resp.StatusCode)
 }
 
-func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
+// Health checks every upstream of the current routing table and reports
+// the state of their circuit breakers.
+func (g *Gateway) Health(w http.ResponseWriter, r *http.Request) {
 	status := make(map[string]string)
+	circuits := make(map[string]breakerState)
 	allHealthy := true
 
-	for name, service := range services {
-		req, err := http.NewRequest("GET", service.URL+"/health", nil)
+	for name, service := range g.routes.Load().Upstreams {
+		if breaker := g.breaker(service); breaker != nil {
+			circuits[name] = breaker.State()
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), healthTimeout)
+		req, err := http.NewRequestWithContext(ctx, "GET", service.URL+"/health", nil)
 		if err != nil {
+			cancel()
 			status[name] = "error"
 			allHealthy = false
 			continue
 		}
 
-		resp, err := service.Client.Do(req)
+		resp, err := g.client.Do(req)
 		if err != nil || resp.StatusCode != http.StatusOK {
 			status[name] = "unhealthy"
 			allHealthy = false
@@ -141,10 +244,12 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 		if resp != nil {
 			resp.Body.Close()
 		}
+		cancel()
 	}
 
 	response := map[string]interface{}{
 		"status":   status,
+		"circuits": circuits,
 		"healthy":  allHealthy,
 		"datetime": time.Now().Format(time.RFC3339),
 	}
@@ -156,6 +261,59 @@ func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+func authConfig() AuthConfig {
+	return AuthConfig{
+		JWTSecret:   os.Getenv("AUTH_JWT_SECRET"),
+		JWKSFile:    os.Getenv("AUTH_JWKS_FILE"),
+		APIKeysFile: os.Getenv("AUTH_API_KEYS_FILE"),
+		Issuer:      os.Getenv("AUTH_ISSUER"),
+		Audience:    os.Getenv("AUTH_AUDIENCE"),
+	}
+}
+
+// issueToken prints a token signed with AUTH_JWT_SECRET:
+//
+//	api-gateway token -sub student42 -roles student -courses cs101 -ttl 24h
+func issueToken(args []string) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	subject := flags.String("sub", "", "user ID")
+	roles := flags.String("roles", "", "comma-separated roles: student, teacher, admin")
+	courses := flags.String("courses", "", "comma-separated course IDs")
+	ttl := flags.Duration("ttl", 24*time.Hour, "token lifetime")
+	flags.Parse(args)
+
+	if *subject == "" {
+		log.Fatal("-sub is required")
+	}
+	config := authConfig()
+	auth, err := NewAuthenticator(AuthConfig{JWTSecret: config.JWTSecret, Issuer: config.Issuer, Audience: config.Audience})
+	if err != nil {
+		log.Fatalf("AUTH_JWT_SECRET is required: %v", err)
+	}
+	token, err := auth.IssueToken(*subject, splitList(*roles), splitList(*courses), *ttl)
+	if err != nil {
+		log.Fatalf("Failed to issue token: %v", err)
+	}
+	fmt.Println(token)
+}
+
+// generateAPIKey prints a new API key and the hash to put in the API keys
+// file.
+func generateAPIKey() {
+	key, err := NewAPIKey()
+	if err != nil {
+		log.Fatalf("Failed to generate API key: %v", err)
+	}
+	fmt.Printf("key:  %s\nhash: %s\n", key, HashAPIKey(key))
+}
+
+func splitList(value string) []string {
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
 func sendError(w http.ResponseWriter, message string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
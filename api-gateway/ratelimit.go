@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// limitSweepInterval is how often the memory store drops idle buckets.
+const limitSweepInterval = time.Minute
+
+// RateLimitConfig is the rate limit of a route as written in the routes
+// file. Every client gets a token bucket that refills with Requests tokens
+// per Per and holds up to Burst tokens, and may make Daily requests per UTC
+// day. Either part may be left out.
+type RateLimitConfig struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+	Daily    int           `yaml:"daily"`
+}
+
+// RateLimit is a validated rate limit. A zero Burst means the route has a
+// daily quota only.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+	Burst    int
+	Daily    int
+}
+
+func newRateLimit(config *RateLimitConfig) (*RateLimit, error) {
+	if config.Requests < 0 || config.Per < 0 || config.Burst < 0 || config.Daily < 0 {
+		return nil, fmt.Errorf("rate_limit values must not be negative")
+	}
+	if (config.Requests > 0) != (config.Per > 0) {
+		return nil, fmt.Errorf("rate_limit needs both requests and per")
+	}
+	if config.Burst > 0 && config.Requests == 0 {
+		return nil, fmt.Errorf("rate_limit burst needs requests")
+	}
+	if config.Requests == 0 && config.Daily == 0 {
+		return nil, fmt.Errorf("rate_limit sets neither requests nor daily")
+	}
+
+	limit := &RateLimit{Requests: config.Requests, Per: config.Per, Burst: config.Burst, Daily: config.Daily}
+	if limit.Burst == 0 {
+		limit.Burst = limit.Requests
+	}
+	return limit, nil
+}
+
+// Rate is the number of tokens added to a bucket per second.
+func (l *RateLimit) Rate() float64 {
+	if l.Per == 0 {
+		return 0
+	}
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// LimitState is a client's bucket and daily quota after a request.
+type LimitState struct {
+	Allowed bool
+	Tokens  float64
+	Used    int
+}
+
+// LimitStore keeps the buckets and quotas of clients.
+type LimitStore interface {
+	// Take refills the bucket of key and takes a token from it and from the
+	// daily quota, unless one of them is exhausted.
+	Take(ctx context.Context, key string, limit *RateLimit, now time.Time) (LimitState, error)
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	day     string
+	used    int
+	// expires is when the bucket is full again and its quota over, so
+	// dropping it changes nothing.
+	expires time.Time
+}
+
+func (b *bucket) take(limit *RateLimit, now time.Time) LimitState {
+	if day := quotaDay(now); b.day != day {
+		b.day, b.used = day, 0
+	}
+	if b.updated.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		elapsed := max(0, now.Sub(b.updated).Seconds())
+		b.tokens = min(float64(limit.Burst), b.tokens+elapsed*limit.Rate())
+	}
+	b.updated = now
+
+	allowed := (limit.Burst == 0 || b.tokens >= 1) && (limit.Daily == 0 || b.used < limit.Daily)
+	if allowed {
+		if limit.Burst > 0 {
+			b.tokens--
+		}
+		if limit.Daily > 0 {
+			b.used++
+		}
+	}
+
+	b.expires = now.Add(untilNextDay(now))
+	if limit.Burst > 0 {
+		if full := now.Add(secondsDuration((float64(limit.Burst) - b.tokens) / limit.Rate())); full.After(b.expires) {
+			b.expires = full
+		}
+	}
+	return LimitState{Allowed: allowed, Tokens: b.tokens, Used: b.used}
+}
+
+// MemoryLimitStore keeps limits in the gateway's memory, so each replica
+// counts its own requests.
+type MemoryLimitStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{buckets: make(map[string]*bucket)}
+}
+
+func (s *MemoryLimitStore) Take(ctx context.Context, key string, limit *RateLimit, now time.Time) (LimitState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > limitSweepInterval {
+		for k, b := range s.buckets {
+			if now.After(b.expires) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{}
+		s.buckets[key] = b
+	}
+	return b.take(limit, now), nil
+}
+
+// takeScript is bucket.take for Redis. The bucket is a hash with the tokens
+// and the time of the last update in milliseconds; the quota is a counter
+// per day that expires at the end of the day.
+var takeScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local daily = tonumber(ARGV[4])
+
+local tokens = 0
+if burst > 0 then
+	local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+	tokens = tonumber(state[1]) or burst
+	local updated = tonumber(state[2]) or now
+	tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+end
+local used = 0
+if daily > 0 then
+	used = tonumber(redis.call('GET', KEYS[2])) or 0
+end
+
+local allowed = (burst == 0 or tokens >= 1) and (daily == 0 or used < daily)
+if allowed then
+	if burst > 0 then
+		tokens = tokens - 1
+	end
+	if daily > 0 then
+		used = redis.call('INCR', KEYS[2])
+		redis.call('PEXPIRE', KEYS[2], ARGV[5])
+	end
+end
+if burst > 0 then
+	redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', ARGV[1])
+	redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+end
+return {allowed and 1 or 0, tostring(tokens), used}
+`)
+
+// RedisLimitStore keeps limits in Redis, so gateway replicas share them.
+type RedisLimitStore struct {
+	client redis.Scripter
+}
+
+func NewRedisLimitStore(client redis.Scripter) *RedisLimitStore {
+	return &RedisLimitStore{client: client}
+}
+
+func (s *RedisLimitStore) Take(ctx context.Context, key string, limit *RateLimit, now time.Time) (LimitState, error) {
+	// The hash tag keeps both keys in one slot of a Redis cluster.
+	keys := []string{
+		"ratelimit:{" + key + "}:bucket",
+		"ratelimit:{" + key + "}:quota:" + quotaDay(now),
+	}
+	result, err := takeScript.Run(ctx, s.client, keys,
+		now.UnixMilli(), limit.Rate()/1000, limit.Burst, limit.Daily, untilNextDay(now).Milliseconds()).Slice()
+	if err != nil {
+		return LimitState{}, err
+	}
+	if len(result) != 3 {
+		return LimitState{}, fmt.Errorf("unexpected rate limit script result %v", result)
+	}
+	allowed, _ := result[0].(int64)
+	tokensText, _ := result[1].(string)
+	used, _ := result[2].(int64)
+	tokens, err := strconv.ParseFloat(tokensText, 64)
+	if err != nil {
+		return LimitState{}, fmt.Errorf("invalid token count %q", tokensText)
+	}
+	return LimitState{Allowed: allowed == 1, Tokens: tokens, Used: int(used)}, nil
+}
+
+// clientKey names whose limits a request counts against: the API key, the
+// authenticated user or, for anonymous requests, the client address.
+func clientKey(r *http.Request, identity *Identity) string {
+	if identity != nil {
+		if key := r.Header.Get(apiKeyHeader); key != "" {
+			return "key:" + HashAPIKey(key)
+		}
+		return "user:" + identity.Subject
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// checkRateLimit takes a request from the client's limits on the route and
+// sets the RateLimit headers. It responds with 429 and returns false when
+// the client is over a limit. If the store fails, the request is let
+// through.
+func (g *Gateway) checkRateLimit(w http.ResponseWriter, r *http.Request, route *Route, identity *Identity) bool {
+	limit := route.RateLimit
+	client := clientKey(r, identity)
+	now := time.Now()
+	state, err := g.limits.Take(r.Context(), route.Prefix+"|"+client, limit, now)
+	if err != nil {
+		log.Printf("Failed to check rate limit of %s: %v", client, err)
+		return true
+	}
+
+	setRateLimitHeaders(w.Header(), limit, state, now)
+	if state.Allowed {
+		return true
+	}
+	retryAfter := retryAfter(limit, state, now)
+	w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(retryAfter)))
+	log.Printf("Rate limited %s %s for %s", r.Method, r.URL.Path, client)
+	sendError(w, fmt.Sprintf("Rate limit exceeded, retry in %d s", ceilSeconds(retryAfter)), http.StatusTooManyRequests)
+	return false
+}
+
+// setRateLimitHeaders describes the limit closest to being reached in
+// RateLimit-Limit, -Remaining and -Reset, and all limits of the route in
+// RateLimit-Policy.
+func setRateLimitHeaders(h http.Header, limit *RateLimit, state LimitState, now time.Time) {
+	var policies []string
+	quota, remaining, reset := 0, math.MaxInt, time.Duration(0)
+	if limit.Burst > 0 {
+		policies = append(policies, fmt.Sprintf("%d;w=%d;burst=%d", limit.Requests, ceilSeconds(limit.Per), limit.Burst))
+		quota, remaining = limit.Burst, int(state.Tokens)
+		reset = secondsDuration((float64(limit.Burst) - state.Tokens) / limit.Rate())
+	}
+	if limit.Daily > 0 {
+		policies = append(policies, fmt.Sprintf("%d;w=%d", limit.Daily, ceilSeconds(24*time.Hour)))
+		if left := max(0, limit.Daily-state.Used); left < remaining {
+			quota, remaining, reset = limit.Daily, left, untilNextDay(now)
+		}
+	}
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+	h.Set("RateLimit-Limit", strconv.Itoa(quota))
+	h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(reset)))
+}
+
+// retryAfter is how long a rejected client has to wait for both a token and
+// a request of the daily quota.
+func retryAfter(limit *RateLimit, state LimitState, now time.Time) time.Duration {
+	var wait time.Duration
+	if limit.Burst > 0 && state.Tokens < 1 {
+		wait = secondsDuration((1 - state.Tokens) / limit.Rate())
+	}
+	if limit.Daily > 0 && state.Used >= limit.Daily {
+		wait = max(wait, untilNextDay(now))
+	}
+	return wait
+}
+
+// quotaDay names the UTC day daily quotas are counted for.
+func quotaDay(now time.Time) string {
+	return now.UTC().Format("2006-01-02")
+}
+
+func untilNextDay(now time.Time) time.Duration {
+	return now.UTC().Truncate(24 * time.Hour).Add(24 * time.Hour).Sub(now)
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
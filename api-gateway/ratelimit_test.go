@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// limitStores returns the stores to test: memory, miniredis and, if
+// RATE_LIMIT_TEST_REDIS_URL is set, a real Redis, e.g. one started with
+// docker run -p 6379:6379 redis:7.
+func limitStores(t *testing.T) map[string]LimitStore {
+	stores := map[string]LimitStore{
+		"Memory":    NewMemoryLimitStore(),
+		"Miniredis": NewRedisLimitStore(redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})),
+	}
+	if url := os.Getenv("RATE_LIMIT_TEST_REDIS_URL"); url != "" {
+		options, err := redis.ParseURL(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := redis.NewClient(options)
+		t.Cleanup(func() { client.Close() })
+		stores["Redis"] = NewRedisLimitStore(client)
+	}
+	return stores
+}
+
+func TestLimitStores(t *testing.T) {
+	ctx := context.Background()
+	start := time.Date(2026, 10, 16, 23, 59, 0, 0, time.UTC)
+
+	for name, store := range limitStores(t) {
+		t.Run(name, func(t *testing.T) {
+			// Keys are unique, so a real Redis may keep data of earlier runs.
+			prefix := fmt.Sprintf("test-%d|", time.Now().UnixNano())
+			take := func(key string, limit *RateLimit, at time.Duration) LimitState {
+				state, err := store.Take(ctx, prefix+key, limit, start.Add(at))
+				if err != nil {
+					t.Fatal(err)
+				}
+				return state
+			}
+
+			bucketLimit := &RateLimit{Requests: 2, Per: time.Second, Burst: 2}
+			for i, expected := range []bool{true, true, false} {
+				if state := take("bucket", bucketLimit, 0); state.Allowed != expected {
+					t.Errorf("request %d: expected allowed %v, got %+v", i+1, expected, state)
+				}
+			}
+			if state := take("bucket", bucketLimit, 500*time.Millisecond); !state.Allowed || state.Tokens > 0.01 {
+				t.Errorf("expected a refilled token, got %+v", state)
+			}
+			if state := take("other", bucketLimit, 500*time.Millisecond); !state.Allowed || state.Tokens < 0.99 {
+				t.Errorf("clients share a bucket: %+v", state)
+			}
+
+			quotaLimit := &RateLimit{Daily: 2}
+			for i, expected := range []bool{true, true, false} {
+				if state := take("quota", quotaLimit, 0); state.Allowed != expected || state.Used != min(i+1, 2) {
+					t.Errorf("request %d: expected allowed %v, got %+v", i+1, expected, state)
+				}
+			}
+			if state := take("quota", quotaLimit, time.Minute); !state.Allowed || state.Used != 1 {
+				t.Errorf("expected a new quota the next day, got %+v", state)
+			}
+
+			both := &RateLimit{Requests: 1, Per: time.Second, Burst: 1, Daily: 1}
+			take("both", both, 0)
+			if state := take("both", both, 30*time.Second); state.Allowed || state.Tokens < 0.99 {
+				t.Errorf("a request over the quota took a token: %+v", state)
+			}
+		})
+	}
+}
+
+func TestGatewayRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	gateway := testGateway(t, `
+upstreams:
+  test: {url: "`+upstream.URL+`"}
+routes:
+  - prefix: /api/analyze
+    upstream: test
+    rate_limit: {requests: 1, per: 1h, burst: 2, daily: 100}
+  - {prefix: /api/files, upstream: test}
+`)
+	send := func(path, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", path, nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 1; i <= 2; i++ {
+		rr := send("/api/analyze/1", "10.0.0.1:5000")
+		if rr.Code != http.StatusOK {
+			t.Fatalf("request %d: expected status 200, got %d", i, rr.Code)
+		}
+		if remaining := rr.Header().Get("RateLimit-Remaining"); remaining != fmt.Sprint(2-i) {
+			t.Errorf("request %d: expected RateLimit-Remaining %d, got %q", i, 2-i, remaining)
+		}
+	}
+
+	rr := send("/api/analyze/1", "10.0.0.1:5001")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", rr.Code)
+	}
+	if retry := rr.Header().Get("Retry-After"); retry != "3600" {
+		t.Errorf("expected Retry-After 3600, got %q", retry)
+	}
+	if policy := rr.Header().Get("RateLimit-Policy"); policy != "1;w=3600;burst=2, 100;w=86400" {
+		t.Errorf("unexpected RateLimit-Policy %q", policy)
+	}
+
+	if rr := send("/api/analyze/1", "10.0.0.2:5000"); rr.Code != http.StatusOK {
+		t.Errorf("another client: expected status 200, got %d", rr.Code)
+	}
+	if rr := send("/api/files", "10.0.0.1:5000"); rr.Code != http.StatusOK || rr.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("route without limit: got status %d, headers %v", rr.Code, rr.Header())
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/api/files", nil)
+	req.RemoteAddr = "[2001:db8::1]:443"
+	if key := clientKey(req, nil); key != "ip:2001:db8::1" {
+		t.Errorf("anonymous: got %q", key)
+	}
+	if key := clientKey(req, &Identity{Subject: "student42"}); key != "user:student42" {
+		t.Errorf("token: got %q", key)
+	}
+	req.Header.Set(apiKeyHeader, "secret")
+	if key := clientKey(req, &Identity{Subject: "grader-bot"}); key != "key:"+HashAPIKey("secret") {
+		t.Errorf("API key: got %q", key)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = 2 * time.Second
+	defaultRetryMaxBody    = 1 << 20
+)
+
+// idempotencyKeyHeader marks a POST request the client allows to be sent
+// more than once. It is passed to the services, which create one resource
+// per key, so a retried POST does not create a second one.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// RetryConfig is the retry policy of a route as written in the routes file.
+// A failed attempt is repeated after a backoff that doubles from Backoff up
+// to MaxBackoff, until Attempts attempts were made or the route timeout is
+// over. Request bodies up to MaxBody bytes are kept to be sent again.
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	MaxBody    int64         `yaml:"max_body"`
+}
+
+func newRetryConfig(config *RetryConfig) (*RetryConfig, error) {
+	if config.Attempts < 0 || config.Backoff < 0 || config.MaxBackoff < 0 || config.MaxBody < 0 {
+		return nil, fmt.Errorf("retry values must not be negative")
+	}
+	validated := *config
+	if validated.Attempts == 0 {
+		validated.Attempts = defaultRetryAttempts
+	}
+	if validated.Backoff == 0 {
+		validated.Backoff = defaultRetryBackoff
+	}
+	if validated.MaxBackoff == 0 {
+		validated.MaxBackoff = max(defaultRetryMaxBackoff, validated.Backoff)
+	}
+	if validated.MaxBody == 0 {
+		validated.MaxBody = defaultRetryMaxBody
+	}
+	if validated.MaxBackoff < validated.Backoff {
+		return nil, fmt.Errorf("retry max_backoff is less than backoff")
+	}
+	return &validated, nil
+}
+
+// backoff is the wait before the next attempt: the doubled backoff with
+// jitter in its upper half, so that gateway replicas do not retry in step.
+func (c *RetryConfig) backoff(attempt int) time.Duration {
+	wait := c.MaxBackoff
+	if attempt < 32 {
+		wait = min(c.MaxBackoff, c.Backoff<<(attempt-1))
+	}
+	return wait/2 + rand.N(wait/2+1)
+}
+
+// replayable reports whether a request may be sent more than once: GET,
+// HEAD, PUT and DELETE, and POST with an Idempotency-Key. PATCH is never
+// repeated.
+func replayable(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	case http.MethodPost:
+		return r.Header.Get(idempotencyKeyHeader) != ""
+	}
+	return false
+}
+
+// upstreamFailed reports whether an attempt failed in a way worth retrying
+// and counting against the upstream.
+func upstreamFailed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// send forwards a request to the route's upstream through its circuit
+// breaker. Failed attempts are retried when the route has a retry policy,
+// the request is replayable and its body fits in MaxBody; otherwise the
+// body is streamed and sent once. When the breaker rejects an attempt, send
+// returns errCircuitOpen and how long the breaker stays open.
+func (g *Gateway) send(ctx context.Context, route *Route, r *http.Request, targetURL string, header http.Header) (*http.Response, time.Duration, error) {
+	attempts := 1
+	var body []byte
+	stream := r.Body
+	if route.Retry != nil && replayable(r) {
+		var err error
+		if body, err = io.ReadAll(io.LimitReader(r.Body, route.Retry.MaxBody+1)); err != nil {
+			return nil, 0, err
+		}
+		if int64(len(body)) <= route.Retry.MaxBody {
+			attempts, stream = route.Retry.Attempts, nil
+		} else {
+			stream = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		}
+	}
+
+	breaker := g.breaker(route.Upstream)
+	for attempt := 1; ; attempt++ {
+		done := func(outcome) {}
+		if breaker != nil {
+			var retryAfter time.Duration
+			var ok bool
+			if done, retryAfter, ok = breaker.Allow(); !ok {
+				return nil, retryAfter, errCircuitOpen
+			}
+		}
+
+		requestBody := stream
+		if requestBody == nil {
+			requestBody = http.NoBody
+			if len(body) > 0 {
+				requestBody = io.NopCloser(bytes.NewReader(body))
+			}
+		}
+		req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, requestBody)
+		if err != nil {
+			done(outcomeUnknown)
+			return nil, 0, err
+		}
+		req.Header = header.Clone()
+		req.ContentLength = r.ContentLength
+		if stream == nil {
+			req.ContentLength = int64(len(body))
+		}
+
+		resp, err := g.client.Do(req)
+		failed := upstreamFailed(resp, err)
+		switch {
+		case r.Context().Err() != nil:
+			done(outcomeUnknown)
+		case failed:
+			done(outcomeFailure)
+		default:
+			done(outcomeSuccess)
+		}
+		if !failed || attempt >= attempts || ctx.Err() != nil {
+			return resp, 0, err
+		}
+
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		wait := route.Retry.backoff(attempt)
+		log.Printf("Attempt %d of %s %s failed, retrying in %v", attempt, r.Method, targetURL, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
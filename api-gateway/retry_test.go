@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGatewayRetries(t *testing.T) {
+	var mu sync.Mutex
+	var bodies []string
+	failures := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		bodies = append(bodies, string(body))
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	gateway := testGateway(t, `
+upstreams:
+  test: {url: "`+upstream.URL+`"}
+routes:
+  - {prefix: /api/files, upstream: test, retry: {attempts: 3, backoff: 1ms, max_body: 16}}
+  - {prefix: /api/once, upstream: test}
+`)
+	send := func(method, path, body string, failing int, header map[string]string) (int, []string) {
+		mu.Lock()
+		bodies, failures = nil, failing
+		mu.Unlock()
+
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, req)
+
+		mu.Lock()
+		defer mu.Unlock()
+		return rr.Code, bodies
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		failing  int
+		header   map[string]string
+		code     int
+		attempts int
+	}{
+		{"GET is retried", "GET", "/api/files/1", "", 2, nil, http.StatusOK, 3},
+		{"Retries run out", "GET", "/api/files/1", "", 5, nil, http.StatusServiceUnavailable, 3},
+		{"POST is sent once", "POST", "/api/files", "essay", 1, nil, http.StatusServiceUnavailable, 1},
+		{"POST with Idempotency-Key is retried", "POST", "/api/files", "essay", 1, map[string]string{idempotencyKeyHeader: "k1"}, http.StatusOK, 2},
+		{"PUT is retried", "PUT", "/api/files/1", "essay", 1, nil, http.StatusOK, 2},
+		{"Large body is sent once", "PUT", "/api/files/1", strings.Repeat("x", 17), 1, nil, http.StatusServiceUnavailable, 1},
+		{"Route without retries", "GET", "/api/once", "", 1, nil, http.StatusServiceUnavailable, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, bodies := send(tt.method, tt.path, tt.body, tt.failing, tt.header)
+			if code != tt.code {
+				t.Errorf("expected status %d, got %d", tt.code, code)
+			}
+			if len(bodies) != tt.attempts {
+				t.Fatalf("expected %d attempts, got %d", tt.attempts, len(bodies))
+			}
+			for i, body := range bodies {
+				if body != tt.body {
+					t.Errorf("attempt %d: expected body %q, got %q", i+1, tt.body, body)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayCircuitBreaker(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/health" {
+			calls++
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	gateway := testGateway(t, `
+upstreams:
+  test:
+    url: "`+upstream.URL+`"
+    circuit_breaker: {failures: 3, open_for: 1m}
+routes:
+  - {prefix: /api/files, upstream: test, retry: {attempts: 2, backoff: 1ms}}
+`)
+	get := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		gateway.ServeHTTP(rr, httptest.NewRequest("GET", "/api/files", nil))
+		return rr
+	}
+
+	get()
+	rr := get()
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 503 with Retry-After once the breaker opens, got %d", rr.Code)
+	}
+	get()
+	if calls != 3 {
+		t.Errorf("expected 3 calls before the breaker opened, got %d", calls)
+	}
+
+	rr = httptest.NewRecorder()
+	gateway.Health(rr, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Circuits map[string]string `json:"circuits"`
+	}
+	json.NewDecoder(rr.Body).Decode(&health)
+	if health.Circuits["test"] != "open" {
+		t.Errorf("expected open circuit in /health, got %v", health.Circuits)
+	}
+
+	breaker := gateway.breaker(gateway.routes.Load().Upstreams["test"])
+	breaker.now = func() time.Time { return time.Now().Add(time.Minute) }
+	get()
+	if calls != 4 || breaker.State() != breakerOpen {
+		t.Errorf("failed probe: expected 4 calls and an open breaker, got %d, %s", calls, breaker.State())
+	}
+}
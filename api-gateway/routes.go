@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultRouteTimeout = 15 * time.Second
+	routesPollInterval  = 2 * time.Second
+)
+
+// RoutesFile is the routing table as written in the routes file.
+type RoutesFile struct {
+	Upstreams map[string]UpstreamConfig `yaml:"upstreams"`
+	Routes    []RouteConfig             `yaml:"routes"`
+}
+
+type UpstreamConfig struct {
+	Name           string         `yaml:"name"`
+	URL            string         `yaml:"url"`
+	CircuitBreaker *BreakerConfig `yaml:"circuit_breaker"`
+}
+
+type RouteConfig struct {
+	Prefix      string        `yaml:"prefix"`
+	Upstream    string        `yaml:"upstream"`
+	Methods     []string      `yaml:"methods"`
+	StripPrefix string        `yaml:"strip_prefix"`
+	AddPrefix   string        `yaml:"add_prefix"`
+	Timeout     time.Duration `yaml:"timeout"`
+	// Public routes are forwarded without credentials.
+	Public bool `yaml:"public"`
+	// Roles lists the roles allowed to use each method, "*" standing for
+	// the methods not listed. Without roles for a method any
+	// authenticated caller may use it.
+	Roles     map[string][]string `yaml:"roles"`
+	RateLimit *RateLimitConfig    `yaml:"rate_limit"`
+	Retry     *RetryConfig        `yaml:"retry"`
+}
+
+type Upstream struct {
+	Name string
+	URL  string
+	// Breaker is nil for upstreams without a circuit breaker.
+	Breaker *BreakerConfig
+}
+
+type Route struct {
+	Prefix      string
+	Upstream    *Upstream
+	Methods     []string
+	StripPrefix string
+	AddPrefix   string
+	Timeout     time.Duration
+	Public      bool
+	Roles       map[string][]string
+	// RateLimit is nil for routes without limits.
+	RateLimit *RateLimit
+	// Retry is nil for routes that try each request once.
+	Retry *RetryConfig
+}
+
+// RouteTable is a validated routing table. It is never changed once built,
+// so requests can keep using a table after it has been replaced.
+type RouteTable struct {
+	// Routes are sorted by prefix, longest first.
+	Routes    []*Route
+	Upstreams map[string]*Upstream
+}
+
+// ParseRoutes reads and validates a routing table. Unknown keys are errors,
+// so a typo does not silently drop a setting.
+func ParseRoutes(data []byte) (*RouteTable, error) {
+	var file RoutesFile
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&file); err != nil {
+		return nil, fmt.Errorf("invalid routes file: %v", err)
+	}
+
+	table := &RouteTable{Upstreams: make(map[string]*Upstream)}
+	for key, upstream := range file.Upstreams {
+		address := strings.TrimSuffix(expandEnv(upstream.URL), "/")
+		parsed, err := url.Parse(address)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("upstream %q: invalid url %q", key, address)
+		}
+		name := upstream.Name
+		if name == "" {
+			name = key
+		}
+		table.Upstreams[key] = &Upstream{Name: name, URL: address}
+		if upstream.CircuitBreaker != nil {
+			if table.Upstreams[key].Breaker, err = newBreakerConfig(upstream.CircuitBreaker); err != nil {
+				return nil, fmt.Errorf("upstream %q: %v", key, err)
+			}
+		}
+	}
+
+	prefixes := make(map[string]bool)
+	for i, config := range file.Routes {
+		route, err := newRoute(config, table.Upstreams)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %v", i+1, err)
+		}
+		if prefixes[route.Prefix] {
+			return nil, fmt.Errorf("route %d: duplicate prefix %q", i+1, route.Prefix)
+		}
+		prefixes[route.Prefix] = true
+		table.Routes = append(table.Routes, route)
+	}
+	sort.SliceStable(table.Routes, func(i, j int) bool {
+		return len(table.Routes[i].Prefix) > len(table.Routes[j].Prefix)
+	})
+
+	return table, nil
+}
+
+func newRoute(config RouteConfig, upstreams map[string]*Upstream) (*Route, error) {
+	prefix := strings.TrimSuffix(config.Prefix, "/")
+	if !strings.HasPrefix(config.Prefix, "/") {
+		return nil, fmt.Errorf("prefix %q must start with /", config.Prefix)
+	}
+	upstream, ok := upstreams[config.Upstream]
+	if !ok {
+		return nil, fmt.Errorf("unknown upstream %q", config.Upstream)
+	}
+	strip := strings.TrimSuffix(config.StripPrefix, "/")
+	if !strings.HasPrefix(prefix+"/", strip+"/") {
+		return nil, fmt.Errorf("strip_prefix %q is not a prefix of %q", config.StripPrefix, config.Prefix)
+	}
+	if config.AddPrefix != "" && !strings.HasPrefix(config.AddPrefix, "/") {
+		return nil, fmt.Errorf("add_prefix %q must start with /", config.AddPrefix)
+	}
+	if config.Timeout < 0 {
+		return nil, fmt.Errorf("negative timeout")
+	}
+	if config.Public && len(config.Roles) > 0 {
+		return nil, fmt.Errorf("public route cannot require roles")
+	}
+
+	route := &Route{
+		Prefix:      prefix,
+		Upstream:    upstream,
+		StripPrefix: strip,
+		AddPrefix:   strings.TrimSuffix(config.AddPrefix, "/"),
+		Timeout:     config.Timeout,
+		Public:      config.Public,
+	}
+	if route.Timeout == 0 {
+		route.Timeout = defaultRouteTimeout
+	}
+	for _, method := range config.Methods {
+		route.Methods = append(route.Methods, strings.ToUpper(method))
+	}
+	if len(config.Roles) > 0 {
+		route.Roles = make(map[string][]string, len(config.Roles))
+	}
+	for method, roles := range config.Roles {
+		method = strings.ToUpper(method)
+		if method != "*" && !route.Allows(method) {
+			return nil, fmt.Errorf("roles given for method %s the route does not allow", method)
+		}
+		if len(roles) == 0 {
+			return nil, fmt.Errorf("no roles given for method %s", method)
+		}
+		route.Roles[method] = roles
+	}
+	if config.RateLimit != nil {
+		limit, err := newRateLimit(config.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		route.RateLimit = limit
+	}
+	if config.Retry != nil {
+		retry, err := newRetryConfig(config.Retry)
+		if err != nil {
+			return nil, err
+		}
+		route.Retry = retry
+	}
+	return route, nil
+}
+
+// expandEnv replaces ${VAR} and ${VAR:-default} with environment variables.
+func expandEnv(s string) string {
+	return os.Expand(s, func(name string) string {
+		name, fallback, _ := strings.Cut(name, ":-")
+		if value, exists := os.LookupEnv(name); exists {
+			return value
+		}
+		return fallback
+	})
+}
+
+// Match returns the route with the longest prefix that covers whole path
+// segments of the path, or nil.
+func (t *RouteTable) Match(path string) *Route {
+	for _, route := range t.Routes {
+		if route.Prefix == "" || path == route.Prefix || strings.HasPrefix(path, route.Prefix+"/") {
+			return route
+		}
+	}
+	return nil
+}
+
+func (r *Route) Allows(method string) bool {
+	if len(r.Methods) == 0 {
+		return true
+	}
+	for _, allowed := range r.Methods {
+		if allowed == method {
+			return true
+		}
+	}
+	return false
+}
+
+// Permits reports whether a caller with the given roles may use the method.
+func (r *Route) Permits(method string, roles []string) bool {
+	allowed, ok := r.Roles[method]
+	if !ok {
+		allowed, ok = r.Roles["*"]
+	}
+	if !ok {
+		return true
+	}
+	for _, role := range roles {
+		if slices.Contains(allowed, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite returns the upstream path of a request path matched by the route.
+func (r *Route) Rewrite(path string) string {
+	path = r.AddPrefix + strings.TrimPrefix(path, r.StripPrefix)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return path
+}
+
+// Reload reads the routes file and replaces the routing table. A file that
+// fails to load leaves the current table in place and is not read again
+// until it changes.
+func (g *Gateway) Reload() error {
+	info, err := os.Stat(g.routesPath)
+	if err != nil {
+		return err
+	}
+	g.routesModTime, g.routesSize = info.ModTime(), info.Size()
+
+	data, err := os.ReadFile(g.routesPath)
+	if err != nil {
+		return err
+	}
+	table, err := ParseRoutes(data)
+	if err != nil {
+		return err
+	}
+
+	g.routes.Store(table)
+	log.Printf("Loaded %d routes from %s", len(table.Routes), g.routesPath)
+	return nil
+}
+
+// WatchRoutes reloads the routes file on SIGHUP and whenever its
+// modification time or size changes.
+func (g *Gateway) WatchRoutes(ctx context.Context) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	ticker := time.NewTicker(routesPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		case <-ticker.C:
+			info, err := os.Stat(g.routesPath)
+			if err != nil || (info.ModTime().Equal(g.routesModTime) && info.Size() == g.routesSize) {
+				continue
+			}
+		}
+		if err := g.Reload(); err != nil {
+			log.Printf("Failed to reload routes, keeping the previous ones: %v", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Roles assigned by the gateway. Any identified caller may analyze the
+// files it uploaded; teachers also the files of their courses, and only
+// admins may see everything and re-index.
+const (
+	roleTeacher = "teacher"
+	roleAdmin   = "admin"
+)
+
+// Headers with the caller's identity, set by the gateway.
+const (
+	userIDHeader  = "X-User-ID"
+	rolesHeader   = "X-User-Roles"
+	coursesHeader = "X-User-Courses"
+)
+
+// serviceTokenHeader carries the token services authenticate with to each
+// other. The gateway never forwards it from clients.
+const serviceTokenHeader = "X-Service-Token"
+
+// serviceToken is the SERVICE_TOKEN shared by the services. Requests that
+// present it come from another service and are not restricted, and this
+// service presents it to the file storing service. Without a token no
+// request is unrestricted.
+var serviceToken string
+
+// Principal is the caller a request was made for: a user or, if Service is
+// set, another service.
+type Principal struct {
+	UserID  string
+	Roles   []string
+	Courses []string
+	Service bool
+}
+
+// principalFrom returns the service that presented the service token or
+// the user identified by the gateway, and nil if the request has neither.
+func principalFrom(r *http.Request) *Principal {
+	if isServiceToken(r.Header.Get(serviceTokenHeader)) {
+		return &Principal{Service: true}
+	}
+	userID := r.Header.Get(userIDHeader)
+	if userID == "" {
+		return nil
+	}
+	return &Principal{
+		UserID:  userID,
+		Roles:   splitList(r.Header.Get(rolesHeader)),
+		Courses: splitList(r.Header.Get(coursesHeader)),
+	}
+}
+
+func isServiceToken(token string) bool {
+	return serviceToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(serviceToken)) == 1
+}
+
+// requireIdentity rejects requests made neither for a user nor by a
+// service with 401.
+func requireIdentity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principalFrom(r) == nil {
+			http.Error(w, "Caller identity required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Unrestricted reports whether the caller is an admin or another service.
+// An unidentified caller may do nothing.
+func (p *Principal) Unrestricted() bool {
+	return p != nil && (p.Service || slices.Contains(p.Roles, roleAdmin))
+}
+
+func (p *Principal) CanRead(file *FileMetadata) bool {
+	if p == nil {
+		return false
+	}
+	if p.Unrestricted() || file.Uploader == p.UserID {
+		return true
+	}
+	return file.CourseID != "" && slices.Contains(p.Roles, roleTeacher) && slices.Contains(p.Courses, file.CourseID)
+}
+
+// authorizeFile responds with 404 or 403 and returns false unless the
+// caller may see the file.
+func (h *Handler) authorizeFile(w http.ResponseWriter, principal *Principal, fileID string) bool {
+	if principal.Unrestricted() {
+		return true
+	}
+	metadata, err := h.repo.GetFileMetadata(fileID)
+	if err != nil {
+		log.Printf("Failed to get metadata of file %s: %v", fileID, err)
+	}
+	if metadata == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return false
+	}
+	if !principal.CanRead(metadata) {
+		http.Error(w, "Access to the file denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// redactSimilarFiles hides which files the caller may not see were found
+// similar, so a student learns how much of the text matches but not whose
+// documents it matches. Matched passages are the caller's own text and are
+// kept.
+func (h *Handler) redactSimilarFiles(principal *Principal, results ...*AnalysisResult) {
+	if principal.Unrestricted() {
+		return
+	}
+
+	var ids []string
+	for _, result := range results {
+		for _, sf := range result.SimilarFiles {
+			ids = append(ids, sf.FileID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	owners, err := h.repo.GetFileOwners(ids)
+	if err != nil {
+		// Everything is hidden rather than too much shown.
+		log.Printf("Failed to get owners of similar files: %v", err)
+	}
+
+	for _, result := range results {
+		// The slice may be shared with a cached or stored result.
+		result.SimilarFiles = slices.Clone(result.SimilarFiles)
+		for i := range result.SimilarFiles {
+			sf := &result.SimilarFiles[i]
+			if owner, ok := owners[sf.FileID]; !ok || !principal.CanRead(&owner) {
+				sf.FileID, sf.Name = "", ""
+			}
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func init() {
+	serviceToken = "test-service-token"
+}
+
+// internal marks a request as made by another service.
+func internal(req *http.Request) *http.Request {
+	req.Header.Set(serviceTokenHeader, serviceToken)
+	return req
+}
+
+func as(req *http.Request, userID, roles, courses string) *http.Request {
+	req.Header.Del(serviceTokenHeader)
+	req.Header.Set(userIDHeader, userID)
+	req.Header.Set(rolesHeader, roles)
+	req.Header.Set(coursesHeader, courses)
+	return req
+}
+
+func TestAccessControl(t *testing.T) {
+	stored := AnalysisResult{
+		ID:          "result1",
+		FileID:      "alice-essay",
+		WordCloudID: "cloud1",
+		SimilarFiles: []SimilarFile{
+			{FileID: "bob-essay", Name: "bob.txt", Similarity: 0.8},
+			{FileID: "alice-draft", Name: "draft.txt", Similarity: 0.5},
+		},
+	}
+	mockRepo := &MockRepository{
+		Files: map[string]string{"alice-essay": "Alice's essay"},
+		FileMetadatas: map[string]FileMetadata{
+			"alice-essay": {ID: "alice-essay", Name: "essay.txt", Uploader: "alice", CourseID: "cs101"},
+			"alice-draft": {ID: "alice-draft", Name: "draft.txt", Uploader: "alice"},
+			"bob-essay":   {ID: "bob-essay", Name: "bob.txt", Uploader: "bob", CourseID: "cs101"},
+		},
+		AnalysisResult: &stored,
+		Analyses:       []AnalysisResult{stored},
+		WordClouds:     map[string][]byte{"cloud1": []byte("<svg/>")},
+		Jobs:           make(map[string]*Job),
+	}
+	handler := NewHandler(NewAnalyzer(mockRepo))
+
+	getAnalysis := func(userID, roles, courses string) (int, AnalysisResult) {
+		rr := httptest.NewRecorder()
+		handler.GetAnalysis(rr, as(httptest.NewRequest("GET", "/analysis/alice-essay", nil), userID, roles, courses))
+		var result AnalysisResult
+		json.NewDecoder(rr.Body).Decode(&result)
+		return rr.Code, result
+	}
+
+	t.Run("Student sees similar files of others without names", func(t *testing.T) {
+		code, result := getAnalysis("alice", "student", "cs101")
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		if sf := result.SimilarFiles[0]; sf.Name != "" || sf.FileID != "" || sf.Similarity != 0.8 {
+			t.Errorf("another student's file is not hidden: %+v", sf)
+		}
+		if sf := result.SimilarFiles[1]; sf.Name != "draft.txt" {
+			t.Errorf("own file is hidden: %+v", sf)
+		}
+		if mockRepo.AnalysisResult.SimilarFiles[0].Name != "bob.txt" {
+			t.Error("stored result was changed")
+		}
+	})
+
+	t.Run("Teacher of the course sees names", func(t *testing.T) {
+		code, result := getAnalysis("carol", "teacher", "cs101")
+		if code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+		if result.SimilarFiles[0].Name != "bob.txt" {
+			t.Errorf("expected bob.txt, got %+v", result.SimilarFiles[0])
+		}
+	})
+
+	t.Run("Other students are denied", func(t *testing.T) {
+		if code, _ := getAnalysis("bob", "student", "cs101"); code != http.StatusForbidden {
+			t.Errorf("analysis: expected status 403, got %d", code)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, as(httptest.NewRequest("POST", "/analyze/alice-essay", nil), "bob", "student", "cs101"))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("analyze: expected status 403, got %d", rr.Code)
+		}
+		if len(mockRepo.Jobs) != 0 {
+			t.Error("job was enqueued")
+		}
+
+		rr = httptest.NewRecorder()
+		handler.GetWordCloud(rr, as(httptest.NewRequest("GET", "/wordcloud/cloud1", nil), "bob", "student", "cs101"))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("word cloud: expected status 403, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Owner gets the word cloud", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.GetWordCloud(rr, as(httptest.NewRequest("GET", "/wordcloud/cloud1", nil), "alice", "student", ""))
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Only admins re-index", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.Reindex(rr, as(httptest.NewRequest("POST", "/reindex", nil), "carol", "teacher", "cs101"))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Unidentified calls are rejected", func(t *testing.T) {
+		forged := httptest.NewRequest("DELETE", "/files/alice-essay", nil)
+		forged.Header.Set(serviceTokenHeader, "guess")
+		for _, req := range []*http.Request{httptest.NewRequest("DELETE", "/files/alice-essay", nil), forged} {
+			rr := httptest.NewRecorder()
+			handler.PurgeFile(rr, req)
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("expected status 403, got %d", rr.Code)
+			}
+			rr = httptest.NewRecorder()
+			requireIdentity(handler.PurgeFile)(rr, req)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("expected status 401, got %d", rr.Code)
+			}
+		}
+	})
+}
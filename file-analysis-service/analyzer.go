@@ -1,189 +1,334 @@
 package main
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
-	"regexp"
 	"sort"
-	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-const (
-	maxTextLengthForWordCloud = 10000
-	minWordsForWordCloud      = 1
-)
+const minWordsForWordCloud = 1
+
+// AlgorithmVersion is stored with every result. Bump it whenever a change
+// affects the numbers, so cached results are not reused after an upgrade.
+const AlgorithmVersion = "9"
 
 type Analyzer struct {
-	repo         Repository
-	wordCloudAPI string
+	repo Repository
 }
 
-func NewAnalyzer(repo Repository, wordCloudAPI string) *Analyzer {
+func NewAnalyzer(repo Repository) *Analyzer {
 	return &Analyzer{
-		repo:         repo,
-		wordCloudAPI: wordCloudAPI,
+		repo: repo,
 	}
 }
 
 func (a *Analyzer) Analyze(fileID string) (*AnalysisResult, error) {
+	return a.AnalyzeWithOptions(context.Background(), fileID, DefaultOptions(), nil)
+}
+
+// AnalyzeWithOptions runs the analysis and reports the completed share of
+// work (0-100) through progress after every stage. Between stages it checks
+// ctx, so a cancelled analysis stops with ctx.Err() before it saves anything.
+func (a *Analyzer) AnalyzeWithOptions(ctx context.Context, fileID string, opts AnalysisOptions, progress func(int)) (*AnalysisResult, error) {
+	report := func(p int) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(p)
+		}
+		return nil
+	}
+
 	content, err := a.repo.GetFileContent(fileID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file content: %v", err)
 	}
+	if err := report(10); err != nil {
+		return nil, err
+	}
 
 	paragraphs := CountParagraphs(content)
 	words := CountWords(content)
-	characters := len([]rune(content))
+	characters := len([]rune(NormalizeLineEndings(content)))
+	statistics := ComputeStatistics(content, opts.Profile)
+	if err := report(20); err != nil {
+		return nil, err
+	}
 
-	_, similarFiles, err := a.calculatePlagiarism(content, fileID)
+	plagiarismRate, similarFiles, err := a.calculatePlagiarism(content, fileID, opts)
 	if err != nil {
-		log.Printf("Plagiarism calculation warning: %v", err)
+		// A result without the comparison would claim the text is original.
+		return nil, fmt.Errorf("failed to check for plagiarism: %v", err)
+	}
+	if err := report(60); err != nil {
+		return nil, err
 	}
 
 	wordCloudID := ""
 	if words >= minWordsForWordCloud {
-		id, err := a.generateWordCloud(content)
+		id, err := a.generateWordCloud(content, opts)
 		if err != nil {
 			log.Printf("Word cloud generation warning: %v", err)
 		} else {
 			wordCloudID = id
 		}
 	}
+	if err := report(90); err != nil {
+		return nil, err
+	}
+
+	// The hash is of the upload, as in the file metadata, not of the text
+	// extracted from it: CachedResult compares the two.
+	metadata := a.fileMetadata(fileID)
+	contentHash := ""
+	if metadata != nil {
+		contentHash = metadata.Hash
+	}
 
 	result := AnalysisResult{
-		ID:           uuid.New().String(),
-		FileID:       fileID,
-		Paragraphs:   paragraphs,
-		Words:        words,
-		Characters:   characters,
-		SimilarFiles: similarFiles,
-		WordCloudID:  wordCloudID,
+		ID:               uuid.New().String(),
+		FileID:           fileID,
+		Paragraphs:       paragraphs,
+		Words:            words,
+		Characters:       characters,
+		Statistics:       statistics,
+		SimilarFiles:     similarFiles,
+		PlagiarismRate:   plagiarismRate,
+		Originality:      100 - plagiarismRate,
+		Options:          opts,
+		WordCloudID:      wordCloudID,
+		ContentHash:      contentHash,
+		AlgorithmVersion: AlgorithmVersion,
+		CreatedAt:        time.Now().UTC(),
 	}
 
 	if err := a.repo.SaveAnalysis(result); err != nil {
 		return nil, fmt.Errorf("failed to save analysis result: %v", err)
 	}
+	result.File = metadata
+	report(100)
 
 	return &result, nil
 }
 
-func (a *Analyzer) calculatePlagiarism(content string, fileID string) (float64, []SimilarFile, error) {
-	files, err := a.repo.GetAllFilesExcept(fileID)
+// CachedResult returns the latest stored result for the file if it was made
+// by the current algorithm version with the same options from the current
+// file content and is not stale, and nil if the file has to be analyzed
+// again.
+func (a *Analyzer) CachedResult(fileID string, opts AnalysisOptions) (*AnalysisResult, error) {
+	latest, err := a.repo.GetAnalysisByFileID(fileID)
 	if err != nil {
-		return 0, nil, fmt.Errorf("failed to get files for comparison: %v", err)
+		return nil, fmt.Errorf("failed to get stored analysis: %v", err)
+	}
+	if latest == nil || latest.Stale || latest.AlgorithmVersion != AlgorithmVersion || latest.Options != opts {
+		return nil, nil
 	}
 
-	currentWords := strings.Fields(cleanText(content))
-	if len(currentWords) == 0 {
-		return 0, nil, nil
+	metadata, err := a.repo.GetFileMetadata(fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get file metadata: %v", err)
+	}
+	if metadata == nil || metadata.Hash != latest.ContentHash {
+		return nil, nil
 	}
 
-	var similarFiles []SimilarFile
-	totalUniqueWords := make(map[string]bool)
-	plagiarizedWords := make(map[string]bool)
+	latest.File = metadata
+	return latest, nil
+}
 
-	for _, file := range files {
-		fileWords := strings.Fields(cleanText(file.Content))
-		fileWordSet := make(map[string]bool)
+// fileMetadata looks up the metadata shown with a result. A result is still
+// useful without it, so failures are only logged.
+func (a *Analyzer) fileMetadata(fileID string) *FileMetadata {
+	metadata, err := a.repo.GetFileMetadata(fileID)
+	if err != nil {
+		log.Printf("Failed to get metadata of file %s: %v", fileID, err)
+		return nil
+	}
+	return metadata
+}
 
-		for _, word := range fileWords {
-			fileWordSet[word] = true
-			totalUniqueWords[word] = true
-		}
+func (a *Analyzer) calculatePlagiarism(content string, fileID string, opts AnalysisOptions) (float64, []SimilarFile, error) {
+	doc := NewDocument(fileID, content, NewTextProcessor(opts.Text, opts.Profile))
+	if len(doc.Tokens) == 0 {
+		return 0, nil, nil
+	}
 
-		matches := 0
-		for _, word := range currentWords {
-			if fileWordSet[word] {
-				plagiarizedWords[word] = true
-				matches++
-			}
-		}
+	strategy, err := NewSimilarityStrategy(a.repo, opts)
+	if err != nil {
+		return 0, nil, err
+	}
 
-		if len(fileWords) > 0 {
-			similarity := float64(matches) / float64(len(currentWords)) * 100
-			if similarity > 5 { // Порог в 5%
-				similarFiles = append(similarFiles, SimilarFile{
-					FileID:     file.ID,
-					Name:       file.Name,
-					Similarity: similarity,
-				})
-			}
+	// The index is built from unprocessed terms, see Reindex.
+	files, err := a.candidateFiles(fileID, Terms(content))
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get files for comparison: %v", err)
+	}
+
+	// Other versions of the same document are the author's own work.
+	versions, err := a.repo.GetOtherVersions(fileID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get document versions: %v", err)
+	}
+	ownVersions := make(map[string]bool, len(versions))
+	for _, id := range versions {
+		ownVersions[id] = true
+	}
+	var others []FileForComparison
+	for _, file := range files {
+		if !ownVersions[file.ID] {
+			others = append(others, file)
 		}
 	}
+	files = others
+
+	scored, err := strategy.Compare(doc, files)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s comparison failed: %v", strategy.Name(), err)
+	}
 
-	var plagiarismRate float64
-	if len(totalUniqueWords) > 0 {
-		plagiarismRate = float64(len(plagiarizedWords)) / float64(len(currentWords)) * 100
+	var similarFiles []SimilarFile
+	for _, sf := range scored {
+		// The trigram strategy searches all files, not only the candidates.
+		if sf.Similarity > opts.Threshold && !ownVersions[sf.FileID] {
+			similarFiles = append(similarFiles, sf)
+		}
 	}
 
 	sort.Slice(similarFiles, func(i, j int) bool {
 		return similarFiles[i].Similarity > similarFiles[j].Similarity
 	})
+	if opts.TopN > 0 && len(similarFiles) > opts.TopN {
+		similarFiles = similarFiles[:opts.TopN]
+	}
+
+	if err := a.addMatchEvidence(doc, files, similarFiles); err != nil {
+		return 0, nil, err
+	}
+
+	// Text matched by several sources is attributed to the most similar one,
+	// so contributions add up to the overall rate.
+	plagiarized := make([]bool, len(doc.Tokens))
+	plagiarizedCount := 0
+	for i := range similarFiles {
+		added := coveredTokens(doc.Tokens, similarFiles[i].Matches, plagiarized)
+		similarFiles[i].Contribution = float64(added) / float64(len(doc.Tokens)) * 100
+		plagiarizedCount += added
+	}
+
+	plagiarismRate := float64(plagiarizedCount) / float64(len(doc.Tokens)) * 100
 
 	return plagiarismRate, similarFiles, nil
 }
 
-func (a *Analyzer) generateWordCloud(content string) (string, error) {
-	cleanedContent := cleanText(content)
-	if len(strings.Fields(cleanedContent)) < minWordsForWordCloud {
-		return "", fmt.Errorf("not enough meaningful words after cleaning")
+// addMatchEvidence finds the shared passages for files reported by
+// strategies that only produce a score, so every strategy returns the same
+// evidence and a comparable plagiarism rate.
+func (a *Analyzer) addMatchEvidence(doc Document, candidates []FileForComparison, similarFiles []SimilarFile) error {
+	contents := make(map[string]string, len(candidates))
+	for _, file := range candidates {
+		contents[file.ID] = file.Content
 	}
 
-	cloudID := uuid.New().String()
+	var missing []string
+	for _, sf := range similarFiles {
+		if _, ok := contents[sf.FileID]; !ok && sf.Matches == nil {
+			missing = append(missing, sf.FileID)
+		}
+	}
+	if len(missing) > 0 {
+		files, err := a.repo.GetFilesByIDs(missing)
+		if err != nil {
+			return fmt.Errorf("failed to get similar files: %v", err)
+		}
+		for _, file := range files {
+			contents[file.ID] = file.Content
+		}
+	}
 
-	wordCloudURL := fmt.Sprintf("https://quickchart.io/wordcloud?text=%s&width=800&height=600&format=png&padding=2",
-		url.QueryEscape(cleanedContent))
+	for i := range similarFiles {
+		if similarFiles[i].Matches == nil {
+			similarFiles[i].Matches = FindMatches(doc.Tokens, doc.Tokenize(contents[similarFiles[i].FileID]))
+		}
+	}
+	return nil
+}
 
-	resp, err := http.Get(wordCloudURL)
-	if err != nil {
-		return "", fmt.Errorf("failed to download word cloud: %v", err)
+// candidateFiles adds the file to the fingerprint index and returns only the
+// files that share LSH buckets with it, so exact scoring does not have to
+// scan the whole corpus.
+func (a *Analyzer) candidateFiles(fileID string, terms []string) ([]FileForComparison, error) {
+	fp := NewFingerprint(fileID, terms)
+	if fp == nil {
+		return nil, nil
+	}
+
+	if err := a.repo.SaveFingerprint(*fp); err != nil {
+		return nil, fmt.Errorf("failed to index file: %v", err)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("word cloud API returned status %d", resp.StatusCode)
+	ids, err := a.repo.FindCandidates(fileID, fp.Buckets, maxCandidates)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find candidates: %v", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
 	}
 
-	imgData, err := io.ReadAll(resp.Body)
+	return a.repo.GetFilesByIDs(ids)
+}
+
+// Reindex rebuilds fingerprints for every stored file, including files that
+// were uploaded before the index existed and were never analyzed.
+func (a *Analyzer) Reindex() (int, error) {
+	files, err := a.repo.GetAllFilesExcept("")
 	if err != nil {
-		return "", fmt.Errorf("failed to read word cloud image: %v", err)
+		return 0, fmt.Errorf("failed to get files: %v", err)
 	}
 
-	if err := a.repo.SaveWordCloud(cloudID, imgData); err != nil {
-		return "", fmt.Errorf("failed to save word cloud to DB: %v", err)
+	indexed := 0
+	for _, file := range files {
+		fp := NewFingerprint(file.ID, Terms(file.Content))
+		if fp == nil {
+			continue
+		}
+		if err := a.repo.SaveFingerprint(*fp); err != nil {
+			return indexed, fmt.Errorf("failed to index file %s: %v", file.ID, err)
+		}
+		indexed++
 	}
 
-	return cloudID, nil
+	return indexed, nil
 }
 
-func cleanText(text string) string {
-	text = strings.ToLower(text)
+func (a *Analyzer) generateWordCloud(content string, opts AnalysisOptions) (string, error) {
+	terms := cloudTerms(content, opts.WordCloud, opts.Profile)
+	if len(terms) < minWordsForWordCloud {
+		return "", fmt.Errorf("not enough meaningful words after cleaning")
+	}
+
+	cloudID := uuid.New().String()
 
-	reg := regexp.MustCompile(`[^\w\s'-]`)
-	text = reg.ReplaceAllString(text, "")
+	imgData, err := RenderWordCloud(terms, opts.WordCloud)
+	if err != nil {
+		return "", fmt.Errorf("failed to render word cloud: %v", err)
+	}
 
-	text = strings.Join(strings.Fields(text), " ")
+	if err := a.repo.SaveWordCloud(cloudID, imgData, opts.WordCloud.ContentType()); err != nil {
+		return "", fmt.Errorf("failed to save word cloud to DB: %v", err)
+	}
 
-	return text
+	return cloudID, nil
 }
 
 func CountWords(text string) int {
-	words := strings.Fields(text)
-	return len(words)
+	return len(Tokenize(text))
 }
 
 func CountParagraphs(text string) int {
-	paragraphs := strings.Split(text, "\n\n")
-	nonEmptyParagraphs := 0
-	for _, p := range paragraphs {
-		if strings.TrimSpace(p) != "" {
-			nonEmptyParagraphs++
-		}
-	}
-	return nonEmptyParagraphs
+	return len(Paragraphs(text))
 }
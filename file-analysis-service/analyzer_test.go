@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"net/http"
 	"testing"
+	"time"
 )
 
 type MockRepository struct {
@@ -10,18 +13,28 @@ type MockRepository struct {
 	WordClouds     map[string][]byte
 	FileMetadatas  map[string]FileMetadata
 	AnalysisResult *AnalysisResult
+	Analyses       []AnalysisResult
 	SimilarFiles   []SimilarFile
+	Jobs           map[string]*Job
+	LockedBy       map[string]string
+	Fingerprints   map[string]Fingerprint
+	Versions       map[string][]string
 	ErrorMode      bool
+	// OnGetFileContent, when set, is called by GetFileContent.
+	OnGetFileContent func()
 }
 
 func (m *MockRepository) GetFileContent(fileID string) (string, error) {
+	if m.OnGetFileContent != nil {
+		m.OnGetFileContent()
+	}
 	if m.ErrorMode {
 		return "", errors.New("mock error")
 	}
 	return m.Files[fileID], nil
 }
 
-func (m *MockRepository) FindSimilarFiles(content, currentFileID string) ([]SimilarFile, error) {
+func (m *MockRepository) FindSimilarFiles(content, currentFileID string, threshold float64, limit int) ([]SimilarFile, error) {
 	if m.ErrorMode {
 		return nil, errors.New("mock error")
 	}
@@ -33,6 +46,7 @@ func (m *MockRepository) SaveAnalysis(result AnalysisResult) error {
 		return errors.New("mock error")
 	}
 	m.AnalysisResult = &result
+	m.Analyses = append(m.Analyses, result)
 	return nil
 }
 
@@ -40,7 +54,25 @@ func (m *MockRepository) GetAnalysisByFileID(fileID string) (*AnalysisResult, er
 	if m.ErrorMode {
 		return nil, errors.New("mock error")
 	}
-	return m.AnalysisResult, nil
+	if m.AnalysisResult == nil {
+		return nil, nil
+	}
+	// Like the database, every call returns a new copy.
+	result := *m.AnalysisResult
+	return &result, nil
+}
+
+func (m *MockRepository) GetAnalysisHistory(fileID string) ([]AnalysisResult, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	var history []AnalysisResult
+	for i := len(m.Analyses) - 1; i >= 0; i-- {
+		if m.Analyses[i].FileID == fileID {
+			history = append(history, m.Analyses[i])
+		}
+	}
+	return history, nil
 }
 
 func (m *MockRepository) GetFileMetadata(fileID string) (*FileMetadata, error) {
@@ -54,7 +86,7 @@ func (m *MockRepository) GetFileMetadata(fileID string) (*FileMetadata, error) {
 	return &metadata, nil
 }
 
-func (m *MockRepository) SaveWordCloud(id string, image []byte) error {
+func (m *MockRepository) SaveWordCloud(id string, image []byte, contentType string) error {
 	if m.ErrorMode {
 		return errors.New("mock error")
 	}
@@ -62,11 +94,37 @@ func (m *MockRepository) SaveWordCloud(id string, image []byte) error {
 	return nil
 }
 
-func (m *MockRepository) GetWordCloud(id string) ([]byte, error) {
+func (m *MockRepository) GetWordCloud(id string) ([]byte, string, error) {
+	if m.ErrorMode {
+		return nil, "", errors.New("mock error")
+	}
+	image, exists := m.WordClouds[id]
+	if !exists {
+		return nil, "", errors.New("not found")
+	}
+	return image, http.DetectContentType(image), nil
+}
+
+func (m *MockRepository) WordCloudFileID(id string) (string, error) {
+	for _, result := range m.Analyses {
+		if result.WordCloudID == id {
+			return result.FileID, nil
+		}
+	}
+	return "", nil
+}
+
+func (m *MockRepository) GetFileOwners(ids []string) (map[string]FileMetadata, error) {
 	if m.ErrorMode {
 		return nil, errors.New("mock error")
 	}
-	return m.WordClouds[id], nil
+	owners := make(map[string]FileMetadata)
+	for _, id := range ids {
+		if metadata, exists := m.FileMetadatas[id]; exists {
+			owners[id] = metadata
+		}
+	}
+	return owners, nil
 }
 
 func (m *MockRepository) GetAllFilesExcept(fileID string) ([]FileForComparison, error) {
@@ -85,6 +143,198 @@ func (m *MockRepository) GetAllFilesExcept(fileID string) ([]FileForComparison,
 	return files, nil
 }
 
+func (m *MockRepository) GetFilesByIDs(ids []string) ([]FileForComparison, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	var files []FileForComparison
+	for _, id := range ids {
+		if content, exists := m.Files[id]; exists {
+			files = append(files, FileForComparison{
+				ID:      id,
+				Content: content,
+			})
+		}
+	}
+	return files, nil
+}
+
+func (m *MockRepository) GetOtherVersions(fileID string) ([]string, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	return m.Versions[fileID], nil
+}
+
+func (m *MockRepository) SaveFingerprint(fp Fingerprint) error {
+	if m.ErrorMode {
+		return errors.New("mock error")
+	}
+	if m.Fingerprints == nil {
+		m.Fingerprints = make(map[string]Fingerprint)
+	}
+	m.Fingerprints[fp.FileID] = fp
+	return nil
+}
+
+// FindCandidates treats every file of the mock as already indexed.
+func (m *MockRepository) FindCandidates(fileID string, buckets []uint64, limit int) ([]string, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	var ids []string
+	for id, content := range m.Files {
+		if id == fileID {
+			continue
+		}
+		fp := NewFingerprint(id, Terms(content))
+		if fp == nil {
+			continue
+		}
+		for band, bucket := range fp.Buckets {
+			if buckets[band] == bucket {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	return ids, nil
+}
+
+func (m *MockRepository) CreateJob(job Job) (*Job, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	if m.Jobs == nil {
+		m.Jobs = make(map[string]*Job)
+	}
+	for _, existing := range m.Jobs {
+		if job.IdempotencyKey != "" && existing.FileID == job.FileID && existing.IdempotencyKey == job.IdempotencyKey {
+			return existing, nil
+		}
+	}
+	m.Jobs[job.ID] = &job
+	return &job, nil
+}
+
+func (m *MockRepository) GetJob(id string) (*Job, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	job, exists := m.Jobs[id]
+	if !exists {
+		return nil, nil
+	}
+	copied := *job
+	return &copied, nil
+}
+
+func (m *MockRepository) ClaimJob(workerID string, lease time.Duration) (*Job, error) {
+	for _, job := range m.Jobs {
+		if job.Status == JobQueued {
+			job.Status = JobRunning
+			job.Attempts++
+			if m.LockedBy == nil {
+				m.LockedBy = make(map[string]string)
+			}
+			m.LockedBy[job.ID] = workerID
+			copied := *job
+			return &copied, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) UpdateJobProgress(id, workerID string, progress int) error {
+	if m.LockedBy[id] != workerID {
+		return errLeaseLost
+	}
+	m.Jobs[id].Progress = progress
+	return nil
+}
+
+// unlock releases a job like the queries finishing it, which only match
+// while the worker holds the job.
+func (m *MockRepository) unlock(id, workerID string) error {
+	if m.LockedBy[id] != workerID {
+		return errLeaseLost
+	}
+	delete(m.LockedBy, id)
+	return nil
+}
+
+func (m *MockRepository) CompleteJob(id, workerID string, result AnalysisResult) error {
+	if err := m.unlock(id, workerID); err != nil {
+		return err
+	}
+	m.Jobs[id].Status = JobDone
+	m.Jobs[id].Progress = 100
+	m.Jobs[id].Result = &result
+	return nil
+}
+
+func (m *MockRepository) RetryJob(id, workerID, errMsg string, runAt time.Time) error {
+	if err := m.unlock(id, workerID); err != nil {
+		return err
+	}
+	m.Jobs[id].Status = JobQueued
+	m.Jobs[id].Error = errMsg
+	return nil
+}
+
+func (m *MockRepository) FailJob(id, workerID, errMsg string) error {
+	if err := m.unlock(id, workerID); err != nil {
+		return err
+	}
+	m.Jobs[id].Status = JobFailed
+	m.Jobs[id].Error = errMsg
+	return nil
+}
+
+func (m *MockRepository) ReleaseJob(id, workerID string) error {
+	if err := m.unlock(id, workerID); err != nil {
+		return err
+	}
+	m.Jobs[id].Status = JobQueued
+	m.Jobs[id].Attempts--
+	return nil
+}
+
+func (m *MockRepository) PurgeFile(fileID string) error {
+	if m.ErrorMode {
+		return errors.New("mock error")
+	}
+	delete(m.Files, fileID)
+	delete(m.Fingerprints, fileID)
+
+	var kept []AnalysisResult
+	for _, result := range m.Analyses {
+		if result.FileID == fileID {
+			delete(m.WordClouds, result.WordCloudID)
+			continue
+		}
+		var similar []SimilarFile
+		rate := 0.0
+		for _, sf := range result.SimilarFiles {
+			if sf.FileID != fileID {
+				similar = append(similar, sf)
+				rate += sf.Contribution
+			}
+		}
+		if len(similar) != len(result.SimilarFiles) {
+			result.SimilarFiles = similar
+			result.PlagiarismRate, result.Originality = rate, 100-rate
+			result.Stale = true
+		}
+		kept = append(kept, result)
+	}
+	m.Analyses = kept
+	return nil
+}
+
 func TestAnalyzer(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -100,7 +350,7 @@ func TestAnalyzer(t *testing.T) {
 				return &MockRepository{
 					Files: map[string]string{
 						"file1": "This is a test content with five words",
-						"file2": "Similar content with some matching words",
+						"file2": "Similar content: this is a test content with some matching words",
 					},
 					FileMetadatas: map[string]FileMetadata{
 						"file1": {ID: "file1", Name: "test.txt"},
@@ -162,7 +412,7 @@ func TestAnalyzer(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mockRepo := tt.repoSetup()
-			analyzer := NewAnalyzer(mockRepo, "http://mock-wordcloud")
+			analyzer := NewAnalyzer(mockRepo)
 
 			result, err := analyzer.Analyze(tt.fileID)
 
@@ -200,7 +450,7 @@ func TestWordCloudGeneration(t *testing.T) {
 		WordClouds: make(map[string][]byte),
 	}
 
-	analyzer := NewAnalyzer(mockRepo, "http://mock-wordcloud")
+	analyzer := NewAnalyzer(mockRepo)
 	result, err := analyzer.Analyze("file1")
 	if err != nil {
 		t.Fatalf("Analyze failed: %v", err)
@@ -214,3 +464,82 @@ func TestWordCloudGeneration(t *testing.T) {
 		t.Error("word cloud should be saved in repository")
 	}
 }
+
+func TestPlagiarismRate(t *testing.T) {
+	mockRepo := &MockRepository{
+		Files: map[string]string{
+			"file1": "alpha beta gamma delta epsilon zeta eta theta iota kappa lambda mu nu xi omicron pi rho sigma tau upsilon",
+			"file2": "alpha beta gamma delta epsilon zeta eta theta iota kappa lambda mu and then something different",
+			"file3": "unrelated start iota kappa lambda mu nu xi omicron pi and an unrelated end",
+		},
+		WordClouds: make(map[string][]byte),
+	}
+	analyzer := NewAnalyzer(mockRepo)
+
+	result, err := analyzer.Analyze("file1")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if len(result.SimilarFiles) != 2 {
+		t.Fatalf("expected 2 similar files, got %d", len(result.SimilarFiles))
+	}
+
+	// file2 covers words 1-12, file3 covers words 9-16: 16 of 20 words in total.
+	if result.PlagiarismRate != 80 {
+		t.Errorf("expected plagiarism rate 80, got %v", result.PlagiarismRate)
+	}
+
+	if result.Originality != 20 {
+		t.Errorf("expected originality 20, got %v", result.Originality)
+	}
+
+	total := 0.0
+	for _, sf := range result.SimilarFiles {
+		total += sf.Contribution
+	}
+	if total != result.PlagiarismRate {
+		t.Errorf("contributions add up to %v, expected %v", total, result.PlagiarismRate)
+	}
+
+	if result.SimilarFiles[0].FileID != "file2" || result.SimilarFiles[1].Contribution != 20 {
+		t.Errorf("unexpected breakdown %+v", result.SimilarFiles)
+	}
+	t.Run("Failed check is not saved", func(t *testing.T) {
+		mockRepo.Analyses = nil
+		opts := DefaultOptions()
+		opts.Strategy = "unknown"
+		if _, err := analyzer.AnalyzeWithOptions(context.Background(), "file1", opts, nil); err == nil {
+			t.Error("expected an error when plagiarism cannot be checked")
+		}
+		if len(mockRepo.Analyses) != 0 {
+			t.Errorf("a result without the check was saved: %+v", mockRepo.Analyses)
+		}
+	})
+}
+
+func TestOwnVersionsExcluded(t *testing.T) {
+	text := "alpha beta gamma delta epsilon zeta eta theta iota kappa lambda mu nu xi omicron pi rho sigma tau upsilon"
+	mockRepo := &MockRepository{
+		Files: map[string]string{
+			"v2":    text,
+			"v1":    text + " phi chi",
+			"other": "unrelated start iota kappa lambda mu nu xi omicron pi and an unrelated end",
+		},
+		Versions:   map[string][]string{"v2": {"v1"}},
+		WordClouds: make(map[string][]byte),
+	}
+	analyzer := NewAnalyzer(mockRepo)
+
+	result, err := analyzer.Analyze("v2")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	if len(result.SimilarFiles) != 1 || result.SimilarFiles[0].FileID != "other" {
+		t.Fatalf("expected only the other document to be reported, got %+v", result.SimilarFiles)
+	}
+	if result.PlagiarismRate != 40 {
+		t.Errorf("expected plagiarism rate 40, got %v", result.PlagiarismRate)
+	}
+}
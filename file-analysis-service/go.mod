@@ -5,7 +5,11 @@ go 1.24.0
 require (
 	github.com/aws/aws-sdk-go-v2/config v1.29.14
 	github.com/google/uuid v1.6.0
+	github.com/kljensen/snowball v0.10.0
 	github.com/lib/pq v1.10.9
+	github.com/rivo/uniseg v0.4.7
+	golang.org/x/image v0.29.0
+	golang.org/x/text v0.27.0
 )
 
 require (
@@ -15,7 +19,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/internal/s3shared v1.18.15 // indirect
 	github.com/fogleman/gg v1.3.0 // indirect
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0 // indirect
-	golang.org/x/image v0.5.0 // indirect
 )
 
 require (
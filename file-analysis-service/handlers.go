@@ -4,19 +4,31 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
+// idempotencyKeyHeader identifies a POST request the client or the gateway
+// may send more than once.
+const idempotencyKeyHeader = "Idempotency-Key"
+
 type Handler struct {
 	analyzer *Analyzer
+	repo     Repository
 }
 
 func NewHandler(analyzer *Analyzer) *Handler {
 	return &Handler{
 		analyzer: analyzer,
+		repo:     analyzer.repo,
 	}
 }
 
+// AnalyzeFile returns the stored result when the file and the algorithm have
+// not changed since the last run, unless force=true is given. Otherwise POST
+// enqueues an analysis job, and GET, kept for older clients, runs the
+// analysis synchronously within the request. Callers may analyze only the
+// files they may see.
 func (h *Handler) AnalyzeFile(w http.ResponseWriter, r *http.Request) {
 	fileID := strings.TrimPrefix(r.URL.Path, "/analyze/")
 	if fileID == "" {
@@ -24,16 +36,190 @@ func (h *Handler) AnalyzeFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	result, err := h.analyzer.Analyze(fileID)
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	principal := principalFrom(r)
+	if !h.authorizeFile(w, principal, fileID) {
+		return
+	}
+
+	opts, err := ParseAnalysisOptions(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	if !force {
+		cached, err := h.analyzer.CachedResult(fileID, opts)
+		if err != nil {
+			log.Printf("Failed to check cached analysis for %s: %v", fileID, err)
+		}
+		if cached != nil {
+			h.redactSimilarFiles(principal, cached)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(cached)
+			return
+		}
+	}
+
+	if r.Method == http.MethodPost {
+		h.enqueueAnalysis(w, r, fileID, opts)
+	} else {
+		h.analyzeNow(w, r, principal, fileID, opts)
+	}
+}
+
+// enqueueAnalysis creates an analysis job. A request repeated with the same
+// Idempotency-Key, such as a retry by the gateway, gets the job the first
+// one created.
+func (h *Handler) enqueueAnalysis(w http.ResponseWriter, r *http.Request, fileID string, opts AnalysisOptions) {
+	job := NewJob(fileID, opts)
+	job.IdempotencyKey = r.Header.Get(idempotencyKeyHeader)
+	stored, err := h.repo.CreateJob(job)
+	if err != nil {
+		http.Error(w, "Failed to enqueue analysis", http.StatusInternalServerError)
+		return
+	}
+	if stored.Options != opts {
+		http.Error(w, "Idempotency-Key was used for an analysis with other options", http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+stored.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{
+		"job_id": stored.ID,
+		"status": string(stored.Status),
+	})
+}
+
+func (h *Handler) analyzeNow(w http.ResponseWriter, r *http.Request, principal *Principal, fileID string, opts AnalysisOptions) {
+	result, err := h.analyzer.AnalyzeWithOptions(r.Context(), fileID, opts, nil)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	h.redactSimilarFiles(principal, result)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
 }
 
+// GetAnalysis serves /analysis/{fileID} with the latest stored result and
+// /analysis/{fileID}/history with all past runs, newest first.
+func (h *Handler) GetAnalysis(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/analysis/")
+	fileID, history := strings.CutSuffix(path, "/history")
+	if fileID == "" {
+		http.Error(w, "File ID is required", http.StatusBadRequest)
+		return
+	}
+	principal := principalFrom(r)
+	if !h.authorizeFile(w, principal, fileID) {
+		return
+	}
+
+	var (
+		response any
+		err      error
+	)
+	if history {
+		var results []AnalysisResult
+		results, err = h.repo.GetAnalysisHistory(fileID)
+		if results == nil {
+			results = []AnalysisResult{}
+		}
+		if len(results) > 0 {
+			file := h.analyzer.fileMetadata(fileID)
+			pointers := make([]*AnalysisResult, len(results))
+			for i := range results {
+				results[i].File = file
+				pointers[i] = &results[i]
+			}
+			h.redactSimilarFiles(principal, pointers...)
+		}
+		response = results
+	} else {
+		var result *AnalysisResult
+		result, err = h.repo.GetAnalysisByFileID(fileID)
+		if err == nil && result == nil {
+			http.Error(w, "Analysis not found", http.StatusNotFound)
+			return
+		}
+		if result != nil {
+			result.File = h.analyzer.fileMetadata(fileID)
+			h.redactSimilarFiles(principal, result)
+		}
+		response = result
+	}
+
+	if err != nil {
+		http.Error(w, "Failed to get analysis", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) Reindex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !principalFrom(r).Unrestricted() {
+		http.Error(w, "Only admins may re-index", http.StatusForbidden)
+		return
+	}
+
+	indexed, err := h.analyzer.Reindex()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"indexed": indexed})
+}
+
+// PurgeFile is called by the file storing service after a file was deleted.
+// It is idempotent, so the call can be retried until it succeeds.
+func (h *Handler) PurgeFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !principalFrom(r).Unrestricted() {
+		http.Error(w, "Only admins may purge files", http.StatusForbidden)
+		return
+	}
+
+	fileID := strings.TrimPrefix(r.URL.Path, "/files/")
+	if fileID == "" {
+		http.Error(w, "File ID is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.repo.PurgeFile(fileID); err != nil {
+		log.Printf("Purge error: %v", err)
+		http.Error(w, "Failed to purge file", http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// GetWordCloud serves a word cloud to callers who may see the analyzed file.
 func (h *Handler) GetWordCloud(w http.ResponseWriter, r *http.Request) {
 	cloudID := strings.TrimPrefix(r.URL.Path, "/wordcloud/")
 	if cloudID == "" {
@@ -41,14 +227,63 @@ func (h *Handler) GetWordCloud(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	imgData, err := h.analyzer.repo.GetWordCloud(cloudID)
+	if principal := principalFrom(r); !principal.Unrestricted() {
+		fileID, err := h.repo.WordCloudFileID(cloudID)
+		if err != nil {
+			http.Error(w, "Failed to get word cloud", http.StatusInternalServerError)
+			return
+		}
+		if fileID == "" {
+			http.Error(w, "Word cloud not found", http.StatusNotFound)
+			return
+		}
+		if !h.authorizeFile(w, principal, fileID) {
+			return
+		}
+	}
+
+	imgData, contentType, err := h.analyzer.repo.GetWordCloud(cloudID)
 	if err != nil {
 		http.Error(w, "Word cloud not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Type", contentType)
 	if _, err := w.Write(imgData); err != nil {
 		log.Printf("Failed to send word cloud: %v", err)
 	}
 }
+
+func (h *Handler) GetJob(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobID := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	if jobID == "" {
+		http.Error(w, "Job ID is required", http.StatusBadRequest)
+		return
+	}
+
+	job, err := h.repo.GetJob(jobID)
+	if err != nil {
+		http.Error(w, "Failed to get job", http.StatusInternalServerError)
+		return
+	}
+
+	if job == nil {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	principal := principalFrom(r)
+	if !h.authorizeFile(w, principal, job.FileID) {
+		return
+	}
+	if job.Result != nil {
+		h.redactSimilarFiles(principal, job.Result)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStoredAnalysis(t *testing.T) {
+	content := "Stored analysis content"
+	// The text is extracted from a DOCX, so it hashes differently from the upload.
+	hash := sha256.Sum256([]byte("PK\x03\x04" + content))
+
+	mockRepo := &MockRepository{
+		Files: map[string]string{
+			"file1": content,
+		},
+		FileMetadatas: map[string]FileMetadata{
+			"file1": {ID: "file1", Name: "test.docx", Hash: hex.EncodeToString(hash[:]), MimeType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document", LineCount: 1},
+		},
+		WordClouds: make(map[string][]byte),
+	}
+	analyzer := NewAnalyzer(mockRepo)
+	handler := NewHandler(analyzer)
+
+	t.Run("Get analysis before the first run", func(t *testing.T) {
+		req := internal(httptest.NewRequest("GET", "/analysis/file1", nil))
+		rr := httptest.NewRecorder()
+		handler.GetAnalysis(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	first, err := analyzer.Analyze("file1")
+	if err != nil {
+		t.Fatalf("Analyze failed: %v", err)
+	}
+
+	t.Run("Get latest analysis", func(t *testing.T) {
+		req := internal(httptest.NewRequest("GET", "/analysis/file1", nil))
+		rr := httptest.NewRecorder()
+		handler.GetAnalysis(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var result AnalysisResult
+		if err := json.NewDecoder(rr.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+
+		if result.ID != first.ID || result.AlgorithmVersion != AlgorithmVersion {
+			t.Errorf("unexpected stored result %+v", result)
+		}
+		if result.File == nil || result.File.Name != "test.docx" || result.File.MimeType != "application/vnd.openxmlformats-officedocument.wordprocessingml.document" || result.File.LineCount != 1 {
+			t.Errorf("expected file metadata in the result, got %+v", result.File)
+		}
+	})
+
+	t.Run("Unchanged file returns cached result", func(t *testing.T) {
+		req := internal(httptest.NewRequest("POST", "/analyze/file1", nil))
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		if len(mockRepo.Jobs) != 0 {
+			t.Error("no job should be enqueued for an unchanged file")
+		}
+	})
+
+	t.Run("Forced re-analysis keeps history", func(t *testing.T) {
+		req := internal(httptest.NewRequest("GET", "/analyze/file1?force=true", nil))
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		req = internal(httptest.NewRequest("GET", "/analysis/file1/history", nil))
+		rr = httptest.NewRecorder()
+		handler.GetAnalysis(rr, req)
+
+		var history []AnalysisResult
+		if err := json.NewDecoder(rr.Body).Decode(&history); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(history) != 2 {
+			t.Fatalf("expected 2 runs in history, got %d", len(history))
+		}
+
+		if history[1].ID != first.ID {
+			t.Error("expected the first run to be the oldest entry")
+		}
+	})
+
+	t.Run("Forced POST enqueues a job", func(t *testing.T) {
+		req := internal(httptest.NewRequest("POST", "/analyze/file1?force=true", nil))
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, req)
+
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("expected status %d, got %d", http.StatusAccepted, rr.Code)
+		}
+	})
+}
+
+func TestPurgeFile(t *testing.T) {
+	mockRepo := &MockRepository{
+		Files:      map[string]string{"deleted": "text"},
+		WordClouds: map[string][]byte{"cloud1": []byte("png")},
+		Analyses: []AnalysisResult{
+			{ID: "r1", FileID: "deleted", WordCloudID: "cloud1"},
+			{ID: "r2", FileID: "other", PlagiarismRate: 50, Originality: 50, SimilarFiles: []SimilarFile{
+				{FileID: "deleted", Contribution: 30},
+				{FileID: "kept", Contribution: 20},
+			}},
+		},
+	}
+	handler := NewHandler(NewAnalyzer(mockRepo))
+
+	req := internal(httptest.NewRequest("DELETE", "/files/deleted", nil))
+	rr := httptest.NewRecorder()
+	handler.PurgeFile(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if len(mockRepo.Analyses) != 1 || len(mockRepo.WordClouds) != 0 {
+		t.Errorf("expected analyses and word clouds of the file to be removed, got %+v", mockRepo.Analyses)
+	}
+	if similar := mockRepo.Analyses[0].SimilarFiles; len(similar) != 1 || similar[0].FileID != "kept" {
+		t.Errorf("expected mentions of the file to be removed, got %+v", similar)
+	}
+	if result := mockRepo.Analyses[0]; result.PlagiarismRate != 20 || result.Originality != 80 || !result.Stale {
+		t.Errorf("expected a stale result with the rate of the kept file, got %+v", result)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.PurgeFile(rr, internal(httptest.NewRequest("DELETE", "/files/deleted", nil)))
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("expected repeated purge to succeed, got %d", rr.Code)
+	}
+}
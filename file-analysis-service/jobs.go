@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobQueued  JobStatus = "queued"
+	JobRunning JobStatus = "running"
+	JobDone    JobStatus = "done"
+	JobFailed  JobStatus = "failed"
+)
+
+const (
+	defaultMaxAttempts  = 5
+	defaultJobLease     = 5 * time.Minute
+	defaultPollInterval = time.Second
+	retryBaseDelay      = 5 * time.Second
+	retryMaxDelay       = 5 * time.Minute
+)
+
+type Job struct {
+	ID          string          `json:"id"`
+	FileID      string          `json:"file_id"`
+	Status      JobStatus       `json:"status"`
+	Progress    int             `json:"progress"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	Options     AnalysisOptions `json:"options"`
+	Error       string          `json:"error,omitempty"`
+	Result      *AnalysisResult `json:"result,omitempty"`
+	CreatedAt   time.Time       `json:"created_at"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+	// IdempotencyKey is the Idempotency-Key of the request that created the
+	// job, so a repeated request gets the same job.
+	IdempotencyKey string `json:"-"`
+}
+
+func NewJob(fileID string, opts AnalysisOptions) Job {
+	now := time.Now().UTC()
+	return Job{
+		ID:          uuid.New().String(),
+		FileID:      fileID,
+		Options:     opts,
+		Status:      JobQueued,
+		MaxAttempts: defaultMaxAttempts,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+// Worker claims queued analysis jobs from the repository and runs them. Any
+// number of workers, in one process or in several replicas, can share a queue.
+type Worker struct {
+	id           string
+	repo         Repository
+	analyzer     *Analyzer
+	lease        time.Duration
+	pollInterval time.Duration
+}
+
+func NewWorker(id string, repo Repository, analyzer *Analyzer) *Worker {
+	return &Worker{
+		id:           id,
+		repo:         repo,
+		analyzer:     analyzer,
+		lease:        defaultJobLease,
+		pollInterval: defaultPollInterval,
+	}
+}
+
+// Run processes jobs until ctx is cancelled. A job in progress at that
+// moment is put back in the queue, so another worker can take it over at
+// once instead of waiting for the lease to expire.
+func (w *Worker) Run(ctx context.Context) {
+	log.Printf("Analysis worker %s started", w.id)
+	for ctx.Err() == nil {
+		processed, err := w.ProcessNext(ctx)
+		if err != nil {
+			log.Printf("Worker %s error: %v", w.id, err)
+		}
+		if processed {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(w.pollInterval):
+		}
+	}
+	log.Printf("Analysis worker %s stopped", w.id)
+}
+
+// ProcessNext claims a single job and runs it. It reports whether a job was
+// claimed, so the caller knows if it should poll again right away.
+func (w *Worker) ProcessNext(ctx context.Context) (bool, error) {
+	job, err := w.repo.ClaimJob(w.id, w.lease)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim job: %v", err)
+	}
+	if job == nil {
+		return false, nil
+	}
+
+	if job.Attempts > job.MaxAttempts {
+		return true, w.finish(job, w.repo.FailJob(job.ID, w.id, "maximum number of attempts exceeded"))
+	}
+
+	progress := func(p int) {
+		if err := w.repo.UpdateJobProgress(job.ID, w.id, p); err != nil {
+			log.Printf("Failed to update progress of job %s: %v", job.ID, err)
+		}
+	}
+
+	// The job stays locked until the analysis has returned, so nothing it
+	// still writes can race with a worker that claims the job next.
+	result, err := w.analyzer.AnalyzeWithOptions(ctx, job.FileID, job.Options, progress)
+	if err != nil && ctx.Err() != nil {
+		log.Printf("Worker %s is stopping, releasing job %s", w.id, job.ID)
+		return true, w.finish(job, w.repo.ReleaseJob(job.ID, w.id))
+	}
+	if err != nil {
+		if job.Attempts >= job.MaxAttempts {
+			return true, w.finish(job, w.repo.FailJob(job.ID, w.id, err.Error()))
+		}
+		runAt := time.Now().Add(retryDelay(job.Attempts))
+		return true, w.finish(job, w.repo.RetryJob(job.ID, w.id, err.Error(), runAt))
+	}
+	return true, w.finish(job, w.repo.CompleteJob(job.ID, w.id, *result))
+}
+
+// finish describes the error of updating a processed job. A lost lease
+// means the job was claimed again after this worker took too long, and the
+// other worker's outcome stands.
+func (w *Worker) finish(job *Job, err error) error {
+	if errors.Is(err, errLeaseLost) {
+		return fmt.Errorf("job %s was taken over by another worker, outcome discarded", job.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update job %s: %v", job.ID, err)
+	}
+	return nil
+}
+
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAnalysisJobs(t *testing.T) {
+	mockRepo := &MockRepository{
+		Files: map[string]string{
+			"file1": "Some text to analyze",
+		},
+		WordClouds: make(map[string][]byte),
+	}
+	analyzer := NewAnalyzer(mockRepo)
+	handler := NewHandler(analyzer)
+	worker := NewWorker("test-worker", mockRepo, analyzer)
+
+	var jobID string
+
+	t.Run("Enqueue analysis", func(t *testing.T) {
+		req := internal(httptest.NewRequest("POST", "/analyze/file1", nil))
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, req)
+
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d, got %d", http.StatusAccepted, rr.Code)
+		}
+
+		var response map[string]string
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		jobID = response["job_id"]
+		if mockRepo.Jobs[jobID] == nil {
+			t.Fatal("job was not saved in repository")
+		}
+
+		if rr.Header().Get("Location") != "/jobs/"+jobID {
+			t.Errorf("unexpected Location header %q", rr.Header().Get("Location"))
+		}
+	})
+
+	t.Run("Worker processes job", func(t *testing.T) {
+		processed, err := worker.ProcessNext(context.Background())
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !processed {
+			t.Fatal("expected a job to be processed")
+		}
+
+		processed, _ = worker.ProcessNext(context.Background())
+		if processed {
+			t.Error("expected the queue to be empty")
+		}
+	})
+
+	t.Run("Get finished job", func(t *testing.T) {
+		req := internal(httptest.NewRequest("GET", "/jobs/"+jobID, nil))
+		rr := httptest.NewRecorder()
+		handler.GetJob(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		var job Job
+		if err := json.NewDecoder(rr.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+
+		if job.Status != JobDone || job.Progress != 100 {
+			t.Errorf("expected finished job, got status %s progress %d", job.Status, job.Progress)
+		}
+
+		if job.Result == nil || job.Result.Words != 4 {
+			t.Errorf("expected job result with 4 words, got %+v", job.Result)
+		}
+	})
+
+	t.Run("Repeated request with Idempotency-Key", func(t *testing.T) {
+		enqueue := func(query string) *httptest.ResponseRecorder {
+			req := internal(httptest.NewRequest("POST", "/analyze/file1?force=true"+query, nil))
+			req.Header.Set(idempotencyKeyHeader, "k1")
+			rr := httptest.NewRecorder()
+			handler.AnalyzeFile(rr, req)
+			return rr
+		}
+
+		first, second := enqueue(""), enqueue("")
+		if first.Code != http.StatusAccepted || second.Code != http.StatusAccepted {
+			t.Fatalf("expected status %d twice, got %d and %d", http.StatusAccepted, first.Code, second.Code)
+		}
+		if first.Header().Get("Location") != second.Header().Get("Location") {
+			t.Error("repeated request created another job")
+		}
+		if rr := enqueue("&top=1"); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status %d for other options, got %d", http.StatusUnprocessableEntity, rr.Code)
+		}
+	})
+
+	t.Run("Get non-existent job", func(t *testing.T) {
+		req := internal(httptest.NewRequest("GET", "/jobs/nonexistent", nil))
+		rr := httptest.NewRecorder()
+		handler.GetJob(rr, req)
+
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestJobLeases(t *testing.T) {
+	mockRepo := &MockRepository{
+		Files: map[string]string{"file1": "Some text to analyze"},
+		Jobs: map[string]*Job{
+			"job1": {ID: "job1", FileID: "file1", Status: JobQueued, MaxAttempts: 3},
+		},
+		WordClouds: make(map[string][]byte),
+	}
+	analyzer := NewAnalyzer(mockRepo)
+
+	t.Run("Stopping worker releases job", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		mockRepo.OnGetFileContent = cancel
+		defer func() { mockRepo.OnGetFileContent = nil }()
+
+		processed, err := NewWorker("stopping", mockRepo, analyzer).ProcessNext(ctx)
+		if err != nil || !processed {
+			t.Fatalf("expected a released job, got %v, %v", processed, err)
+		}
+		if job := mockRepo.Jobs["job1"]; job.Status != JobQueued || job.Attempts != 0 || job.Progress != 0 {
+			t.Errorf("expected a queued job without attempts, got status %s attempts %d progress %d", job.Status, job.Attempts, job.Progress)
+		}
+		if len(mockRepo.Analyses) != 0 {
+			t.Error("cancelled analysis was saved")
+		}
+	})
+
+	t.Run("Worker that lost its lease", func(t *testing.T) {
+		stale, err := mockRepo.ClaimJob("stale", time.Minute)
+		if err != nil || stale == nil {
+			t.Fatalf("failed to claim job: %v", err)
+		}
+		// The lease expired and another worker claimed the job and finished it.
+		mockRepo.Jobs["job1"].Status = JobQueued
+		current, _ := mockRepo.ClaimJob("current", time.Minute)
+		if err := mockRepo.CompleteJob(current.ID, "current", AnalysisResult{FileID: "file1"}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		if err := mockRepo.UpdateJobProgress(stale.ID, "stale", 50); !errors.Is(err, errLeaseLost) {
+			t.Errorf("progress: expected errLeaseLost, got %v", err)
+		}
+		if err := mockRepo.FailJob(stale.ID, "stale", "timeout"); !errors.Is(err, errLeaseLost) {
+			t.Errorf("expected errLeaseLost, got %v", err)
+		}
+		if job := mockRepo.Jobs["job1"]; job.Status != JobDone {
+			t.Errorf("stale worker overwrote the result: status %s", job.Status)
+		}
+	})
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt  int
+		expected time.Duration
+	}{
+		{attempt: 1, expected: 5 * time.Second},
+		{attempt: 2, expected: 10 * time.Second},
+		{attempt: 4, expected: 40 * time.Second},
+		{attempt: 20, expected: retryMaxDelay},
+	}
+
+	for _, tt := range tests {
+		if got := retryDelay(tt.attempt); got != tt.expected {
+			t.Errorf("attempt %d: expected %v, got %v", tt.attempt, tt.expected, got)
+		}
+	}
+}
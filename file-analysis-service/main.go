@@ -1,18 +1,50 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+// shutdownTimeout is how long requests in progress may take to finish when
+// the service is stopped.
+const shutdownTimeout = 10 * time.Second
+
 func main() {
+	if path := os.Getenv("ANALYSIS_PROFILES_FILE"); path != "" {
+		if err := LoadProfiles(path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	serviceToken = os.Getenv("SERVICE_TOKEN")
+	if serviceToken == "" {
+		log.Println("SERVICE_TOKEN is not set, requests from other services are rejected")
+	}
+
 	repo := NewPostgresRepository()
-	analyzer := NewAnalyzer(repo, os.Getenv("WORDCLOUD_API_URL"))
+	analyzer := NewAnalyzer(repo)
 	handler := NewHandler(analyzer)
 
-	http.HandleFunc("/analyze/", handler.AnalyzeFile)
-	http.HandleFunc("/wordcloud/", handler.GetWordCloud)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	workers := startWorkers(ctx, repo, analyzer)
+
+	http.HandleFunc("/analyze/", requireIdentity(handler.AnalyzeFile))
+	http.HandleFunc("/analysis/", requireIdentity(handler.GetAnalysis))
+	http.HandleFunc("/jobs/", requireIdentity(handler.GetJob))
+	http.HandleFunc("/wordcloud/", requireIdentity(handler.GetWordCloud))
+	http.HandleFunc("/reindex", requireIdentity(handler.Reindex))
+	http.HandleFunc("/files/", requireIdentity(handler.PurgeFile))
 
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -23,6 +55,44 @@ func main() {
 		port = "8082"
 	}
 
-	log.Printf("File Analysis Service is running on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("File Analysis Service is running on :%s", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to finish requests: %v", err)
+	}
+	workers.Wait()
+}
+
+// startWorkers starts the analysis workers. They stop when ctx is
+// cancelled; the returned group waits for them.
+func startWorkers(ctx context.Context, repo Repository, analyzer *Analyzer) *sync.WaitGroup {
+	count := 2
+	if value, err := strconv.Atoi(os.Getenv("ANALYSIS_WORKERS")); err == nil && value >= 0 {
+		count = value
+	}
+
+	// A restarted container keeps its hostname, so the process ID keeps it
+	// from passing for its predecessor in the lease checks.
+	var workers sync.WaitGroup
+	hostname, _ := os.Hostname()
+	process := uuid.New().String()
+	for i := 0; i < count; i++ {
+		worker := NewWorker(fmt.Sprintf("%s-%s-%d", hostname, process, i), repo, analyzer)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			worker.Run(ctx)
+		}()
+	}
+	return &workers
 }
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"strings"
+)
+
+const (
+	shingleSize   = 3
+	signatureSize = 128
+	lshBands      = 64
+	lshRows       = signatureSize / lshBands
+	maxCandidates = 100
+	minHashSeed   = 0x5eed5eed5eed5eed
+)
+
+// minHashSeeds are fixed for the lifetime of the index: signatures stored in
+// the database are only comparable when computed with the same seeds.
+var minHashSeeds = func() [signatureSize]uint64 {
+	var seeds [signatureSize]uint64
+	state := uint64(minHashSeed)
+	for i := range seeds {
+		state += 0x9e3779b97f4a7c15
+		seeds[i] = mix64(state)
+	}
+	return seeds
+}()
+
+// Fingerprint is the MinHash signature of a document together with the LSH
+// bucket it falls into for every band.
+type Fingerprint struct {
+	FileID    string
+	Signature []uint64
+	Buckets   []uint64
+	Shingles  int
+	// Text is the normalized text, which the trigram strategy searches.
+	Text string
+}
+
+// Shingles returns the hashes of all distinct word n-grams of terms. Texts
+// shorter than the shingle size produce a single shingle.
+func Shingles(terms []string) map[uint64]struct{} {
+	shingles := make(map[uint64]struct{})
+	if len(terms) == 0 {
+		return shingles
+	}
+
+	size := shingleSize
+	if len(terms) < size {
+		size = len(terms)
+	}
+
+	for i := 0; i+size <= len(terms); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(terms[i:i+size], " ")))
+		shingles[h.Sum64()] = struct{}{}
+	}
+	return shingles
+}
+
+func NewFingerprint(fileID string, terms []string) *Fingerprint {
+	shingles := Shingles(terms)
+	if len(shingles) == 0 {
+		return nil
+	}
+
+	signature := make([]uint64, signatureSize)
+	for i := range signature {
+		signature[i] = math.MaxUint64
+	}
+
+	for shingle := range shingles {
+		for i, seed := range minHashSeeds {
+			if v := mix64(shingle ^ seed); v < signature[i] {
+				signature[i] = v
+			}
+		}
+	}
+
+	return &Fingerprint{
+		FileID:    fileID,
+		Signature: signature,
+		Buckets:   lshBuckets(signature),
+		Shingles:  len(shingles),
+		Text:      strings.Join(terms, " "),
+	}
+}
+
+// EstimateJaccard approximates the Jaccard similarity of the shingle sets
+// behind two signatures.
+func EstimateJaccard(a, b []uint64) float64 {
+	if len(a) == 0 || len(a) != len(b) {
+		return 0
+	}
+
+	equal := 0
+	for i := range a {
+		if a[i] == b[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(a))
+}
+
+func lshBuckets(signature []uint64) []uint64 {
+	buckets := make([]uint64, lshBands)
+	buf := make([]byte, 8)
+
+	for band := 0; band < lshBands; band++ {
+		h := fnv.New64a()
+		binary.LittleEndian.PutUint64(buf, uint64(band))
+		h.Write(buf)
+		for _, v := range signature[band*lshRows : (band+1)*lshRows] {
+			binary.LittleEndian.PutUint64(buf, v)
+			h.Write(buf)
+		}
+		buckets[band] = h.Sum64()
+	}
+	return buckets
+}
+
+// mix64 is the splitmix64 finalizer.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func sharesBucket(a, b *Fingerprint) bool {
+	for band := range a.Buckets {
+		if a.Buckets[band] == b.Buckets[band] {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFingerprint(t *testing.T) {
+	original := Terms("Плагиат — это присвоение авторства на чужое произведение науки или искусства, " +
+		"на чужие идеи или изобретения. Плагиат может быть нарушением авторско-правового " +
+		"законодательства и патентного законодательства.")
+	copied := append(append([]string{}, original...), "также", "это", "нарушение", "этики")
+	unrelated := Terms("The quick brown fox jumps over the lazy dog while the cat sleeps on the warm windowsill " +
+		"and the birds sing their morning songs in the old oak tree.")
+
+	t.Run("Identical texts", func(t *testing.T) {
+		a := NewFingerprint("a", original)
+		b := NewFingerprint("b", original)
+
+		if EstimateJaccard(a.Signature, b.Signature) != 1 {
+			t.Error("identical texts must have identical signatures")
+		}
+		if !sharesBucket(a, b) {
+			t.Error("identical texts must share LSH buckets")
+		}
+		// The trigram strategy searches the stored text with the query
+		// normalized the same way.
+		if a.Text != NormalizeText(strings.Join(original, " ")) {
+			t.Errorf("unexpected normalized text %q", a.Text)
+		}
+	})
+
+	t.Run("Near duplicate", func(t *testing.T) {
+		a := NewFingerprint("a", original)
+		b := NewFingerprint("b", copied)
+
+		sa, sb := Shingles(original), Shingles(copied)
+		shared := 0
+		for s := range sa {
+			if _, ok := sb[s]; ok {
+				shared++
+			}
+		}
+		exact := float64(shared) / float64(len(sa)+len(sb)-shared)
+
+		if estimate := EstimateJaccard(a.Signature, b.Signature); math.Abs(estimate-exact) > 0.15 {
+			t.Errorf("estimate %.2f is too far from exact Jaccard %.2f", estimate, exact)
+		}
+		if !sharesBucket(a, b) {
+			t.Error("near duplicates must share LSH buckets")
+		}
+	})
+
+	t.Run("Unrelated texts", func(t *testing.T) {
+		a := NewFingerprint("a", original)
+		b := NewFingerprint("b", unrelated)
+
+		if EstimateJaccard(a.Signature, b.Signature) > 0.1 {
+			t.Error("unrelated texts should have a low similarity estimate")
+		}
+		if sharesBucket(a, b) {
+			t.Error("unrelated texts should not share LSH buckets")
+		}
+	})
+
+	t.Run("Empty text", func(t *testing.T) {
+		if NewFingerprint("empty", nil) != nil {
+			t.Error("empty text should not produce a fingerprint")
+		}
+	})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// AnalysisOptions select how similar files are found and reported. They are
+// stored with every result and every queued job.
+type AnalysisOptions struct {
+	Profile   string           `json:"profile"`
+	Strategy  string           `json:"strategy"`
+	Threshold float64          `json:"threshold"`
+	TopN      int              `json:"top_n"`
+	Text      TextOptions      `json:"text"`
+	WordCloud WordCloudOptions `json:"word_cloud"`
+	// StopWordsHash identifies the custom stop words of the profile, so a
+	// stored result is not reused after they change.
+	StopWordsHash string `json:"stop_words_hash,omitempty"`
+}
+
+// profileConfig is a profile as read from ANALYSIS_PROFILES_FILE. Custom
+// stop words are kept outside AnalysisOptions so the options stay comparable.
+type profileConfig struct {
+	AnalysisOptions
+	CustomStopWords []string `json:"custom_stop_words"`
+}
+
+const defaultProfile = "default"
+
+var profiles = map[string]AnalysisOptions{
+	"default": {Strategy: StrategyWinnowing, Threshold: 5},
+	"strict":  {Strategy: StrategyWinnowing, Threshold: 1, TopN: 50},
+	"topic":   {Strategy: StrategyTFIDF, Threshold: 30, TopN: 10, Text: TextOptions{StopWords: true, Stemming: true}},
+	"quick":   {Strategy: StrategyTrigram, Threshold: 30, TopN: 5},
+}
+
+// profileStopWords holds the custom stop words of loaded profiles by name.
+var profileStopWords = map[string][]string{}
+
+func DefaultOptions() AnalysisOptions {
+	opts, _ := ProfileOptions(defaultProfile)
+	return opts
+}
+
+func ProfileOptions(name string) (AnalysisOptions, error) {
+	opts, exists := profiles[name]
+	if !exists {
+		return AnalysisOptions{}, fmt.Errorf("unknown profile %q", name)
+	}
+	opts.Profile = name
+	opts.StopWordsHash = stopWordsHash(profileStopWords[name])
+	if opts.WordCloud == (WordCloudOptions{}) {
+		opts.WordCloud = DefaultWordCloudOptions()
+	}
+	return opts, nil
+}
+
+// stopWordsHash returns a short hash of the normalized stop words, or "" if
+// there are none.
+func stopWordsHash(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	normalized := make([]string, len(words))
+	for i, word := range words {
+		normalized[i] = NormalizeWord(word)
+	}
+	slices.Sort(normalized)
+	hash := sha256.Sum256([]byte(strings.Join(slices.Compact(normalized), "\n")))
+	return hex.EncodeToString(hash[:8])
+}
+
+// LoadProfiles adds the profiles from a JSON object of name to options to
+// the built-in ones, replacing built-in profiles with the same name. A
+// profile may list its own stop words in "custom_stop_words".
+func LoadProfiles(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles: %v", err)
+	}
+
+	var loaded map[string]profileConfig
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("failed to parse profiles: %v", err)
+	}
+
+	for name, config := range loaded {
+		opts := config.AnalysisOptions
+		if opts.WordCloud == (WordCloudOptions{}) {
+			opts.WordCloud = DefaultWordCloudOptions()
+		}
+		if err := opts.Validate(); err != nil {
+			return fmt.Errorf("profile %q: %v", name, err)
+		}
+		profiles[name] = opts
+		profileStopWords[name] = config.CustomStopWords
+	}
+	return nil
+}
+
+// ParseAnalysisOptions starts from the profile given in the "profile"
+// parameter, or the default one, and applies the "strategy", "threshold",
+// "top", text processing and word cloud parameters on top of it.
+func ParseAnalysisOptions(query url.Values) (AnalysisOptions, error) {
+	name := query.Get("profile")
+	if name == "" {
+		name = defaultProfile
+	}
+
+	opts, err := ProfileOptions(name)
+	if err != nil {
+		return opts, err
+	}
+
+	if strategy := query.Get("strategy"); strategy != "" {
+		opts.Strategy = strategy
+	}
+
+	if value := query.Get("threshold"); value != "" {
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid threshold %q", value)
+		}
+		opts.Threshold = threshold
+	}
+
+	if value := query.Get("top"); value != "" {
+		top, err := strconv.Atoi(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid top %q", value)
+		}
+		opts.TopN = top
+	}
+
+	for param, target := range map[string]*bool{
+		"stop_words":       &opts.Text.StopWords,
+		"stemming":         &opts.Text.Stemming,
+		"cloud_stop_words": &opts.WordCloud.StopWords,
+		"cloud_stemming":   &opts.WordCloud.Stemming,
+	} {
+		if value := query.Get(param); value != "" {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s %q", param, value)
+			}
+			*target = enabled
+		}
+	}
+
+	for param, target := range map[string]*int{
+		"width":     &opts.WordCloud.Width,
+		"height":    &opts.WordCloud.Height,
+		"max_words": &opts.WordCloud.MaxWords,
+	} {
+		if value := query.Get(param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s %q", param, value)
+			}
+			*target = n
+		}
+	}
+
+	if palette := query.Get("palette"); palette != "" {
+		opts.WordCloud.Palette = palette
+	}
+	if format := query.Get("format"); format != "" {
+		opts.WordCloud.Format = format
+	}
+
+	return opts, opts.Validate()
+}
+
+func (o AnalysisOptions) Validate() error {
+	if !IsKnownStrategy(o.Strategy) {
+		return fmt.Errorf("unknown strategy %q", o.Strategy)
+	}
+	if o.Threshold < 0 || o.Threshold > 100 {
+		return fmt.Errorf("threshold must be between 0 and 100")
+	}
+	if o.TopN < 0 {
+		return fmt.Errorf("top must not be negative")
+	}
+	return o.WordCloud.Validate()
+}
@@ -3,52 +3,101 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"regexp"
-	"strings"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type SimilarFile struct {
-	FileID     string  `json:"file_id"`
-	Name       string  `json:"name"`
-	Similarity float64 `json:"similarity"`
+	// FileID and Name are empty for files the caller may not see.
+	FileID       string        `json:"file_id,omitempty"`
+	Name         string        `json:"name,omitempty"`
+	Similarity   float64       `json:"similarity"`
+	Contribution float64       `json:"contribution"`
+	Matches      []MatchedSpan `json:"matches,omitempty"`
 }
 
 type AnalysisResult struct {
-	ID           string        `json:"id"`
-	FileID       string        `json:"file_id"`
-	Paragraphs   int           `json:"paragraphs"`
-	Words        int           `json:"words"`
-	Characters   int           `json:"characters"`
-	SimilarFiles []SimilarFile `json:"similar_files"`
-	WordCloudID  string        `json:"word_cloud_id"`
+	ID               string          `json:"id"`
+	FileID           string          `json:"file_id"`
+	Paragraphs       int             `json:"paragraphs"`
+	Words            int             `json:"words"`
+	Characters       int             `json:"characters"`
+	Statistics       TextStatistics  `json:"statistics"`
+	SimilarFiles     []SimilarFile   `json:"similar_files"`
+	PlagiarismRate   float64         `json:"plagiarism_rate"`
+	Originality      float64         `json:"originality"`
+	Options          AnalysisOptions `json:"options"`
+	WordCloudID      string          `json:"word_cloud_id"`
+	ContentHash      string          `json:"content_hash"`
+	AlgorithmVersion string          `json:"algorithm_version"`
+	CreatedAt        time.Time       `json:"created_at"`
+	// Stale is set when a file found similar was deleted after the run. The
+	// rate then only counts the remaining files, and the file is analyzed
+	// again on the next request.
+	Stale bool `json:"stale,omitempty"`
+	// File is the metadata of the analyzed file. It is not stored with the
+	// result but looked up when the result is served.
+	File *FileMetadata `json:"file,omitempty"`
 }
 
+// FileMetadata is the file as described by the file storing service.
 type FileMetadata struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Hash     string `json:"hash"`
-	Location string `json:"location"`
+	ID           string    `json:"id"`
+	DocumentID   string    `json:"document_id"`
+	Version      int       `json:"version"`
+	Name         string    `json:"name"`
+	Hash         string    `json:"hash"`
+	Location     string    `json:"location"`
+	TextLocation string    `json:"text_location"`
+	MimeType     string    `json:"mime_type"`
+	Encoding     string    `json:"encoding,omitempty"`
+	LineCount    int       `json:"line_count"`
+	Size         int64     `json:"size_bytes"`
+	Uploader     string    `json:"uploader,omitempty"`
+	CourseID     string    `json:"course_id,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type Repository interface {
 	GetFileContent(fileID string) (string, error)
-	FindSimilarFiles(content, currentFileID string) ([]SimilarFile, error)
+	FindSimilarFiles(content, currentFileID string, threshold float64, limit int) ([]SimilarFile, error)
 	SaveAnalysis(result AnalysisResult) error
 	GetAnalysisByFileID(fileID string) (*AnalysisResult, error)
+	GetAnalysisHistory(fileID string) ([]AnalysisResult, error)
 	GetFileMetadata(fileID string) (*FileMetadata, error)
-	SaveWordCloud(id string, image []byte) error
-	GetWordCloud(id string) ([]byte, error)
+	SaveWordCloud(id string, image []byte, contentType string) error
+	GetWordCloud(id string) ([]byte, string, error)
+	WordCloudFileID(id string) (string, error)
+	GetFileOwners(ids []string) (map[string]FileMetadata, error)
 	GetAllFilesExcept(fileID string) ([]FileForComparison, error)
+	GetFilesByIDs(ids []string) ([]FileForComparison, error)
+	GetOtherVersions(fileID string) ([]string, error)
+	SaveFingerprint(fp Fingerprint) error
+	FindCandidates(fileID string, buckets []uint64, limit int) ([]string, error)
+	// CreateJob saves the job and returns it, or returns the job created
+	// earlier for the same file with the same idempotency key.
+	CreateJob(job Job) (*Job, error)
+	GetJob(id string) (*Job, error)
+	ClaimJob(workerID string, lease time.Duration) (*Job, error)
+	UpdateJobProgress(id, workerID string, progress int) error
+	CompleteJob(id, workerID string, result AnalysisResult) error
+	RetryJob(id, workerID, errMsg string, runAt time.Time) error
+	FailJob(id, workerID, errMsg string) error
+	ReleaseJob(id, workerID string) error
+	PurgeFile(fileID string) error
 }
 
+// errLeaseLost is returned when a worker finishes a job it no longer holds.
+var errLeaseLost = errors.New("job lease lost to another worker")
+
 type PostgresRepository struct {
 	db *sql.DB
 }
@@ -81,7 +130,7 @@ func NewPostgresRepository() *PostgresRepository {
 	_, err = db.Exec(`
     CREATE TABLE IF NOT EXISTS analysis_results (
         id TEXT PRIMARY KEY,
-        file_id TEXT NOT NULL UNIQUE,
+        file_id TEXT NOT NULL,
         paragraphs INTEGER NOT NULL,
         words INTEGER NOT NULL,
         characters INTEGER NOT NULL,
@@ -93,6 +142,25 @@ func NewPostgresRepository() *PostgresRepository {
 		log.Fatal(err)
 	}
 
+	// Earlier versions kept a single result per file. Every run is now stored
+	// as a separate row, so the unique key is dropped and run details added.
+	for _, stmt := range []string{
+		"ALTER TABLE analysis_results DROP CONSTRAINT IF EXISTS analysis_results_file_id_key",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS content_hash TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS algorithm_version TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS plagiarism_rate DOUBLE PRECISION NOT NULL DEFAULT 0",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS originality DOUBLE PRECISION NOT NULL DEFAULT 100",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS options JSONB NOT NULL DEFAULT '{}'",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS statistics JSONB NOT NULL DEFAULT '{}'",
+		"ALTER TABLE analysis_results ADD COLUMN IF NOT EXISTS stale BOOLEAN NOT NULL DEFAULT false",
+		"CREATE INDEX IF NOT EXISTS analysis_results_file_id_idx ON analysis_results (file_id, created_at DESC)",
+	} {
+		if _, err = db.Exec(stmt); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS word_clouds (
 			id TEXT PRIMARY KEY,
@@ -103,15 +171,143 @@ func NewPostgresRepository() *PostgresRepository {
 		log.Fatal(err)
 	}
 
+	_, err = db.Exec("ALTER TABLE word_clouds ADD COLUMN IF NOT EXISTS content_type TEXT NOT NULL DEFAULT 'image/png'")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS analysis_jobs (
+			id TEXT PRIMARY KEY,
+			file_id TEXT NOT NULL,
+			status TEXT NOT NULL,
+			progress INTEGER NOT NULL DEFAULT 0,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			max_attempts INTEGER NOT NULL,
+			options JSONB NOT NULL DEFAULT '{}',
+			last_error TEXT NOT NULL DEFAULT '',
+			result JSONB,
+			locked_by TEXT,
+			locked_until TIMESTAMPTZ,
+			run_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec("ALTER TABLE analysis_jobs ADD COLUMN IF NOT EXISTS options JSONB NOT NULL DEFAULT '{}'")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec("ALTER TABLE analysis_jobs ADD COLUMN IF NOT EXISTS idempotency_key TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE UNIQUE INDEX IF NOT EXISTS analysis_jobs_idempotency_key_idx
+		ON analysis_jobs (file_id, idempotency_key)
+		WHERE idempotency_key <> ''
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE INDEX IF NOT EXISTS analysis_jobs_pending_idx
+		ON analysis_jobs (run_at)
+		WHERE status IN ('queued', 'running')
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS fingerprints (
+			file_id TEXT PRIMARY KEY,
+			signature BIGINT[] NOT NULL,
+			shingles INTEGER NOT NULL,
+			updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Files indexed before the column was added have no text until /reindex.
+	_, err = db.Exec("ALTER TABLE fingerprints ADD COLUMN IF NOT EXISTS normalized_text TEXT")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	_, err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS lsh_buckets (
+			band SMALLINT NOT NULL,
+			bucket BIGINT NOT NULL,
+			file_id TEXT NOT NULL REFERENCES fingerprints(file_id) ON DELETE CASCADE,
+			PRIMARY KEY (band, bucket, file_id)
+		)
+	`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	return &PostgresRepository{db: db}
 }
 
 func (r *PostgresRepository) GetAllFilesExcept(fileID string) ([]FileForComparison, error) {
+	return r.filesWithContent(`
+        SELECT id, name
+        FROM file_metadata
+        WHERE id != $1`, fileID)
+}
+
+func (r *PostgresRepository) GetFilesByIDs(ids []string) ([]FileForComparison, error) {
+	return r.filesWithContent(`
+        SELECT id, name
+        FROM file_metadata
+        WHERE id = ANY($1)`, pq.Array(ids))
+}
+
+// GetOtherVersions returns the IDs of the other versions of the document the
+// file belongs to. Documents are kept in file_metadata by the file storing
+// service.
+func (r *PostgresRepository) GetOtherVersions(fileID string) ([]string, error) {
 	rows, err := r.db.Query(`
-        SELECT fm.id, fm.name, fc.content 
-        FROM file_metadata fm
-        JOIN file_content fc ON fm.location = fc.location
-        WHERE fm.id != $1`, fileID)
+        SELECT id
+        FROM file_metadata
+        WHERE document_id = (SELECT document_id FROM file_metadata WHERE id = $1)
+        AND id != $1`, fileID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// filesWithContent runs a query returning id and name and fetches the texts
+// of the files from the file storing service. For documents such as DOCX or
+// PDF this is the extracted text, not the original.
+func (r *PostgresRepository) filesWithContent(query string, args ...any) ([]FileForComparison, error) {
+	fileStoringURL := os.Getenv("FILE_STORING_SERVICE_URL")
+	if fileStoringURL == "" {
+		return nil, fmt.Errorf("FILE_STORING_SERVICE_URL not set")
+	}
+
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -120,15 +316,116 @@ func (r *PostgresRepository) GetAllFilesExcept(fileID string) ([]FileForComparis
 	var files []FileForComparison
 	for rows.Next() {
 		var f FileForComparison
-		if err := rows.Scan(&f.ID, &f.Name, &f.Content); err != nil {
+		if err := rows.Scan(&f.ID, &f.Name); err != nil {
 			return nil, err
 		}
 		files = append(files, f)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	for i := range files {
+		content, err := fetchContent(client, fileStoringURL, files[i].ID)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %v", files[i].ID, err)
+		}
+		files[i].Content = content
+	}
 
 	return files, nil
 }
 
+// SaveFingerprint replaces the stored signature and LSH buckets of a file.
+func (r *PostgresRepository) SaveFingerprint(fp Fingerprint) error {
+	signature := make([]int64, len(fp.Signature))
+	for i, v := range fp.Signature {
+		signature[i] = int64(v)
+	}
+
+	bands := make([]int64, len(fp.Buckets))
+	buckets := make([]int64, len(fp.Buckets))
+	for i, v := range fp.Buckets {
+		bands[i] = int64(i)
+		buckets[i] = int64(v)
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO fingerprints (file_id, signature, shingles, normalized_text, updated_at)
+        VALUES ($1, $2, $3, $4, now())
+        ON CONFLICT (file_id) DO UPDATE
+        SET signature = EXCLUDED.signature,
+            shingles = EXCLUDED.shingles,
+            normalized_text = EXCLUDED.normalized_text,
+            updated_at = EXCLUDED.updated_at
+    `, fp.FileID, pq.Array(signature), fp.Shingles, fp.Text)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM lsh_buckets WHERE file_id = $1", fp.FileID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`
+        INSERT INTO lsh_buckets (band, bucket, file_id)
+        SELECT band, bucket, $1
+        FROM unnest($2::bigint[], $3::bigint[]) AS b(band, bucket)
+    `, fp.FileID, pq.Array(bands), pq.Array(buckets))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// FindCandidates returns files that share at least one LSH bucket with the
+// given ones, the files sharing the most buckets first.
+func (r *PostgresRepository) FindCandidates(fileID string, buckets []uint64, limit int) ([]string, error) {
+	bands := make([]int64, len(buckets))
+	values := make([]int64, len(buckets))
+	for i, v := range buckets {
+		bands[i] = int64(i)
+		values[i] = int64(v)
+	}
+
+	rows, err := r.db.Query(`
+        SELECT lb.file_id
+        FROM lsh_buckets lb
+        JOIN unnest($2::bigint[], $3::bigint[]) AS q(band, bucket)
+          ON lb.band = q.band AND lb.bucket = q.bucket
+        WHERE lb.file_id != $1
+        GROUP BY lb.file_id
+        ORDER BY count(*) DESC
+        LIMIT $4
+    `, fileID, pq.Array(bands), pq.Array(values), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
 func (r *PostgresRepository) GetFileMetadata(fileID string) (*FileMetadata, error) {
 	fileStoringURL := os.Getenv("FILE_STORING_SERVICE_URL")
 	if fileStoringURL == "" {
@@ -136,7 +433,7 @@ func (r *PostgresRepository) GetFileMetadata(fileID string) (*FileMetadata, erro
 	}
 
 	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Get(fmt.Sprintf("%s/files/%s", fileStoringURL, fileID))
+	resp, err := serviceGet(client, fmt.Sprintf("%s/files/%s", fileStoringURL, fileID))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get file metadata: %v", err)
 	}
@@ -154,28 +451,40 @@ func (r *PostgresRepository) GetFileMetadata(fileID string) (*FileMetadata, erro
 	return &metadata, nil
 }
 
-func (r *PostgresRepository) FindSimilarFiles(content, currentFileID string) ([]SimilarFile, error) {
-	normalizedContent := normalizeText(content)
+// errTrigramIndexIncomplete is returned by FindSimilarFiles while some
+// indexed files have no normalized text, which a reindex adds.
+var errTrigramIndexIncomplete = errors.New("trigram index is incomplete, run POST /reindex")
+
+// FindSimilarFiles compares the document with every indexed file using
+// pg_trgm. The threshold is a fraction between 0 and 1. Both sides are
+// normalized by NormalizeText: the indexed texts are stored with the
+// fingerprints, so the search does not depend on the blob store of the file
+// storing service.
+func (r *PostgresRepository) FindSimilarFiles(content, currentFileID string, threshold float64, limit int) ([]SimilarFile, error) {
+	var incomplete bool
+	err := r.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM fingerprints WHERE normalized_text IS NULL)",
+	).Scan(&incomplete)
+	if err != nil {
+		return nil, fmt.Errorf("query error: %v", err)
+	}
+	if incomplete {
+		return nil, errTrigramIndexIncomplete
+	}
 
 	rows, err := r.db.Query(`
-        WITH normalized AS (
-            SELECT 
-                file_metadata.id, 
-                file_metadata.location, 
-                $2 AS norm_content
-            FROM file_content
-            JOIN file_metadata ON file_content.location = file_metadata.location
-            WHERE file_metadata.id != $1
-            AND file_content.content IS NOT NULL
-        )
-        SELECT 
-            id, 
-            similarity($2, norm_content) AS similarity
-        FROM normalized
-        WHERE similarity($2, norm_content) > 0.3
+        SELECT id, name, similarity
+        FROM (
+            SELECT file_metadata.id, file_metadata.name,
+                similarity($2, fingerprints.normalized_text) AS similarity
+            FROM fingerprints
+            JOIN file_metadata ON file_metadata.id = fingerprints.file_id
+            WHERE fingerprints.file_id != $1
+        ) scored
+        WHERE similarity > $3
         ORDER BY similarity DESC
-        LIMIT 5
-    `, currentFileID, normalizedContent)
+        LIMIT $4
+    `, currentFileID, NormalizeText(content), threshold, limit)
 
 	if err != nil {
 		return nil, fmt.Errorf("query error: %v", err)
@@ -185,7 +494,7 @@ func (r *PostgresRepository) FindSimilarFiles(content, currentFileID string) ([]
 	var results []SimilarFile
 	for rows.Next() {
 		var sf SimilarFile
-		if err := rows.Scan(&sf.FileID, &sf.Similarity); err != nil {
+		if err := rows.Scan(&sf.FileID, &sf.Name, &sf.Similarity); err != nil {
 			return nil, fmt.Errorf("scan error: %v", err)
 		}
 		results = append(results, sf)
@@ -198,60 +507,106 @@ func (r *PostgresRepository) FindSimilarFiles(content, currentFileID string) ([]
 	return results, nil
 }
 
-func normalizeText(text string) string {
-	text = strings.ToLower(text)
-
-	reg := regexp.MustCompile(`[^\w\s]`)
-	text = reg.ReplaceAllString(text, " ")
-
-	text = strings.Join(strings.Fields(text), " ")
-
-	return text
-}
 func (r *PostgresRepository) SaveAnalysis(result AnalysisResult) error {
 	similarFilesJSON, err := json.Marshal(result.SimilarFiles)
 	if err != nil {
 		return fmt.Errorf("failed to marshal similar files: %v", err)
 	}
 
+	optionsJSON, err := json.Marshal(result.Options)
+	if err != nil {
+		return fmt.Errorf("failed to marshal options: %v", err)
+	}
+
+	statisticsJSON, err := json.Marshal(result.Statistics)
+	if err != nil {
+		return fmt.Errorf("failed to marshal statistics: %v", err)
+	}
+
 	_, err = r.db.Exec(`
         INSERT INTO analysis_results 
-        (id, file_id, paragraphs, words, characters, similar_files, word_cloud_url)
-        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        (id, file_id, paragraphs, words, characters, similar_files, word_cloud_url,
+         content_hash, algorithm_version, created_at, plagiarism_rate, originality,
+         options, statistics)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
     `, result.ID, result.FileID, result.Paragraphs, result.Words,
-		result.Characters, similarFilesJSON, result.WordCloudID)
+		result.Characters, similarFilesJSON, result.WordCloudID,
+		result.ContentHash, result.AlgorithmVersion, result.CreatedAt,
+		result.PlagiarismRate, result.Originality, optionsJSON, statisticsJSON)
 	return err
 }
 
-func (r *PostgresRepository) SaveWordCloud(id string, image []byte) error {
+func (r *PostgresRepository) SaveWordCloud(id string, image []byte, contentType string) error {
 	_, err := r.db.Exec(
-		"INSERT INTO word_clouds (id, image) VALUES ($1, $2)",
-		id, image,
+		"INSERT INTO word_clouds (id, image, content_type) VALUES ($1, $2, $3)",
+		id, image, contentType,
 	)
 	return err
 }
 
-func (r *PostgresRepository) GetWordCloud(id string) ([]byte, error) {
-	var image []byte
+func (r *PostgresRepository) GetWordCloud(id string) ([]byte, string, error) {
+	var (
+		image       []byte
+		contentType string
+	)
 	err := r.db.QueryRow(
-		"SELECT image FROM word_clouds WHERE id = $1",
+		"SELECT image, content_type FROM word_clouds WHERE id = $1",
 		id,
-	).Scan(&image)
-	return image, err
+	).Scan(&image, &contentType)
+	return image, contentType, err
 }
 
-func (r *PostgresRepository) GetAnalysisByFileID(fileID string) (*AnalysisResult, error) {
+// WordCloudFileID returns the file a word cloud was generated for, or "" if
+// no stored result refers to it.
+func (r *PostgresRepository) WordCloudFileID(id string) (string, error) {
+	var fileID string
+	err := r.db.QueryRow(
+		"SELECT file_id FROM analysis_results WHERE word_cloud_url = $1 LIMIT 1",
+		id,
+	).Scan(&fileID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return fileID, err
+}
+
+// GetFileOwners returns the uploader and course of the given files, read
+// from file_metadata of the file storing service. Only ID, Uploader and
+// CourseID are set.
+func (r *PostgresRepository) GetFileOwners(ids []string) (map[string]FileMetadata, error) {
+	rows, err := r.db.Query(`
+        SELECT id, uploader, course_id
+        FROM file_metadata
+        WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	owners := make(map[string]FileMetadata)
+	for rows.Next() {
+		var file FileMetadata
+		if err := rows.Scan(&file.ID, &file.Uploader, &file.CourseID); err != nil {
+			return nil, err
+		}
+		owners[file.ID] = file
+	}
+	return owners, rows.Err()
+}
+
+const analysisColumns = `id, file_id, paragraphs, words, characters,
+	similar_files, word_cloud_url, content_hash, algorithm_version, created_at,
+	plagiarism_rate, originality, options, statistics, stale`
+
+func scanAnalysis(row interface{ Scan(...any) error }) (*AnalysisResult, error) {
 	var (
 		result           AnalysisResult
 		similarFilesJSON []byte
+		optionsJSON      []byte
+		statisticsJSON   []byte
 	)
 
-	err := r.db.QueryRow(`
-        SELECT id, file_id, paragraphs, words, characters, 
-               similar_files, word_cloud_url
-        FROM analysis_results
-        WHERE file_id = $1
-    `, fileID).Scan(
+	err := row.Scan(
 		&result.ID,
 		&result.FileID,
 		&result.Paragraphs,
@@ -259,7 +614,42 @@ func (r *PostgresRepository) GetAnalysisByFileID(fileID string) (*AnalysisResult
 		&result.Characters,
 		&similarFilesJSON,
 		&result.WordCloudID,
+		&result.ContentHash,
+		&result.AlgorithmVersion,
+		&result.CreatedAt,
+		&result.PlagiarismRate,
+		&result.Originality,
+		&optionsJSON,
+		&statisticsJSON,
+		&result.Stale,
 	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(similarFilesJSON, &result.SimilarFiles); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal similar files: %v", err)
+	}
+
+	if err := json.Unmarshal(optionsJSON, &result.Options); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal options: %v", err)
+	}
+
+	if err := json.Unmarshal(statisticsJSON, &result.Statistics); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal statistics: %v", err)
+	}
+
+	return &result, nil
+}
+
+func (r *PostgresRepository) GetAnalysisByFileID(fileID string) (*AnalysisResult, error) {
+	result, err := scanAnalysis(r.db.QueryRow(`
+        SELECT `+analysisColumns+`
+        FROM analysis_results
+        WHERE file_id = $1
+        ORDER BY created_at DESC
+        LIMIT 1
+    `, fileID))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -268,11 +658,31 @@ func (r *PostgresRepository) GetAnalysisByFileID(fileID string) (*AnalysisResult
 		return nil, err
 	}
 
-	if err := json.Unmarshal(similarFilesJSON, &result.SimilarFiles); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal similar files: %v", err)
+	return result, nil
+}
+
+func (r *PostgresRepository) GetAnalysisHistory(fileID string) ([]AnalysisResult, error) {
+	rows, err := r.db.Query(`
+        SELECT `+analysisColumns+`
+        FROM analysis_results
+        WHERE file_id = $1
+        ORDER BY created_at DESC
+    `, fileID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return &result, nil
+	var history []AnalysisResult
+	for rows.Next() {
+		result, err := scanAnalysis(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, *result)
+	}
+
+	return history, rows.Err()
 }
 
 func (r *PostgresRepository) GetFileContent(fileID string) (string, error) {
@@ -282,30 +692,33 @@ func (r *PostgresRepository) GetFileContent(fileID string) (string, error) {
 	}
 
 	client := &http.Client{Timeout: 10 * time.Second}
+	return fetchContent(client, fileStoringURL, fileID)
+}
 
-	resp, err := client.Get(fmt.Sprintf("%s/files/%s", fileStoringURL, fileID))
+// serviceGet makes a GET request to the file storing service with the
+// service token, which gives access to the files of all users.
+func serviceGet(client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to get file metadata: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("file not found")
-	}
-
-	var metadata struct {
-		Location string `json:"location"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&metadata); err != nil {
-		return "", fmt.Errorf("failed to decode metadata: %v", err)
+		return nil, err
 	}
+	req.Header.Set(serviceTokenHeader, serviceToken)
+	return client.Do(req)
+}
 
-	resp, err = client.Get(fmt.Sprintf("%s/files/content/%s", fileStoringURL, metadata.Location))
+// fetchContent downloads the text of a file from the file storing service,
+// which owns the blob storage. Contents are not guaranteed to be in this
+// database.
+func fetchContent(client *http.Client, fileStoringURL, fileID string) (string, error) {
+	resp, err := serviceGet(client, fmt.Sprintf("%s/files/%s/text", fileStoringURL, url.PathEscape(fileID)))
 	if err != nil {
 		return "", fmt.Errorf("failed to get file content: %v", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("file not found")
+	}
 	if resp.StatusCode != http.StatusOK {
 		return "", fmt.Errorf("file content not found")
 	}
@@ -317,3 +730,216 @@ func (r *PostgresRepository) GetFileContent(fileID string) (string, error) {
 
 	return string(content), nil
 }
+
+const jobColumns = `id, file_id, status, progress, attempts, max_attempts,
+	options, last_error, result, created_at, updated_at`
+
+func scanJob(row interface{ Scan(...any) error }) (*Job, error) {
+	var (
+		job         Job
+		optionsJSON []byte
+		resultJSON  []byte
+	)
+
+	err := row.Scan(
+		&job.ID,
+		&job.FileID,
+		&job.Status,
+		&job.Progress,
+		&job.Attempts,
+		&job.MaxAttempts,
+		&optionsJSON,
+		&job.Error,
+		&resultJSON,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(optionsJSON, &job.Options); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal job options: %v", err)
+	}
+
+	if resultJSON != nil {
+		if err := json.Unmarshal(resultJSON, &job.Result); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal job result: %v", err)
+		}
+	}
+
+	return &job, nil
+}
+
+func (r *PostgresRepository) CreateJob(job Job) (*Job, error) {
+	optionsJSON, err := json.Marshal(job.Options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal job options: %v", err)
+	}
+
+	result, err := r.db.Exec(`
+        INSERT INTO analysis_jobs
+        (id, file_id, status, progress, attempts, max_attempts, options, idempotency_key, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        ON CONFLICT (file_id, idempotency_key) WHERE idempotency_key <> '' DO NOTHING
+    `, job.ID, job.FileID, job.Status, job.Progress, job.Attempts,
+		job.MaxAttempts, optionsJSON, job.IdempotencyKey, job.CreatedAt, job.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 1 {
+		return &job, err
+	}
+	return scanJob(r.db.QueryRow(
+		"SELECT "+jobColumns+" FROM analysis_jobs WHERE file_id = $1 AND idempotency_key = $2",
+		job.FileID, job.IdempotencyKey,
+	))
+}
+
+func (r *PostgresRepository) GetJob(id string) (*Job, error) {
+	return scanJob(r.db.QueryRow(
+		"SELECT "+jobColumns+" FROM analysis_jobs WHERE id = $1",
+		id,
+	))
+}
+
+// ClaimJob locks the oldest runnable job for the given worker. Jobs whose
+// lease has expired are considered abandoned by a crashed worker and are
+// claimed again.
+func (r *PostgresRepository) ClaimJob(workerID string, lease time.Duration) (*Job, error) {
+	return scanJob(r.db.QueryRow(`
+        UPDATE analysis_jobs
+        SET status = 'running',
+            attempts = attempts + 1,
+            locked_by = $1,
+            locked_until = now() + make_interval(secs => $2),
+            updated_at = now()
+        WHERE id = (
+            SELECT id FROM analysis_jobs
+            WHERE (status = 'queued' AND run_at <= now())
+               OR (status = 'running' AND locked_until < now())
+            ORDER BY run_at
+            FOR UPDATE SKIP LOCKED
+            LIMIT 1
+        )
+        RETURNING `+jobColumns,
+		workerID, lease.Seconds(),
+	))
+}
+
+// UpdateJobProgress and the methods that finish a job only update it while
+// the worker still holds it. A worker whose lease expired and whose job was claimed again gets
+// errLeaseLost instead of overwriting the other worker's result.
+
+func (r *PostgresRepository) UpdateJobProgress(id, workerID string, progress int) error {
+	return r.finishJob(
+		"UPDATE analysis_jobs SET progress = $3, updated_at = now() WHERE id = $1 AND locked_by = $2",
+		id, workerID, progress,
+	)
+}
+
+func (r *PostgresRepository) CompleteJob(id, workerID string, result AnalysisResult) error {
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job result: %v", err)
+	}
+
+	return r.finishJob(`
+        UPDATE analysis_jobs
+        SET status = 'done', progress = 100, result = $3, last_error = '',
+            locked_by = NULL, locked_until = NULL, updated_at = now()
+        WHERE id = $1 AND locked_by = $2
+    `, id, workerID, resultJSON)
+}
+
+func (r *PostgresRepository) RetryJob(id, workerID, errMsg string, runAt time.Time) error {
+	return r.finishJob(`
+        UPDATE analysis_jobs
+        SET status = 'queued', progress = 0, last_error = $3, run_at = $4,
+            locked_by = NULL, locked_until = NULL, updated_at = now()
+        WHERE id = $1 AND locked_by = $2
+    `, id, workerID, errMsg, runAt)
+}
+
+func (r *PostgresRepository) FailJob(id, workerID, errMsg string) error {
+	return r.finishJob(`
+        UPDATE analysis_jobs
+        SET status = 'failed', last_error = $3,
+            locked_by = NULL, locked_until = NULL, updated_at = now()
+        WHERE id = $1 AND locked_by = $2
+    `, id, workerID, errMsg)
+}
+
+// ReleaseJob puts a job a stopping worker has not finished back in the
+// queue. The attempt is not counted, since the job did not fail.
+func (r *PostgresRepository) ReleaseJob(id, workerID string) error {
+	return r.finishJob(`
+        UPDATE analysis_jobs
+        SET status = 'queued', progress = 0, attempts = attempts - 1, run_at = now(),
+            locked_by = NULL, locked_until = NULL, updated_at = now()
+        WHERE id = $1 AND locked_by = $2
+    `, id, workerID)
+}
+
+func (r *PostgresRepository) finishJob(query string, args ...any) error {
+	result, err := r.db.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+// PurgeFile removes everything stored about a deleted file: its analyses and
+// their word clouds, its jobs and fingerprint, and the entries for it in the
+// similar files of other analyses. Purging an unknown file is not an error,
+// so the file storing service can safely retry.
+func (r *PostgresRepository) PurgeFile(fileID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range []string{
+		`DELETE FROM word_clouds WHERE id IN (
+            SELECT word_cloud_url FROM analysis_results WHERE file_id = $1)`,
+		"DELETE FROM analysis_results WHERE file_id = $1",
+		"DELETE FROM analysis_jobs WHERE file_id = $1",
+		"DELETE FROM lsh_buckets WHERE file_id = $1",
+		"DELETE FROM fingerprints WHERE file_id = $1",
+		// Contributions add up to the rate, so the rate of a result that
+		// found the file is what the other files contributed. Text they
+		// share with the file was attributed to it, so the result is marked
+		// stale to be analyzed again.
+		`UPDATE analysis_results ar
+        SET similar_files = remaining.files,
+            plagiarism_rate = remaining.rate,
+            originality = 100 - remaining.rate,
+            stale = true
+        FROM (
+            SELECT a.id,
+                COALESCE(jsonb_agg(sf ORDER BY n) FILTER (WHERE sf->>'file_id' != $1), '[]'::jsonb) AS files,
+                COALESCE(sum((sf->>'contribution')::double precision) FILTER (WHERE sf->>'file_id' != $1), 0) AS rate
+            FROM analysis_results a, jsonb_array_elements(a.similar_files) WITH ORDINALITY AS e(sf, n)
+            WHERE a.similar_files @> jsonb_build_array(jsonb_build_object('file_id', $1::text))
+            GROUP BY a.id
+        ) remaining
+        WHERE ar.id = remaining.id`,
+	} {
+		if _, err := tx.Exec(statement, fileID); err != nil {
+			return fmt.Errorf("failed to purge file %s: %v", fileID, err)
+		}
+	}
+
+	return tx.Commit()
+}
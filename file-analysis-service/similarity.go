@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	StrategyWinnowing   = "winnowing"
+	StrategyJaccard     = "jaccard"
+	StrategyContainment = "containment"
+	StrategyTFIDF       = "tfidf"
+	StrategyTrigram     = "trigram"
+	StrategyOverlap     = "overlap"
+)
+
+// Document is the submitted file prepared for comparison. Candidate texts
+// have to be prepared with Tokenize and TermsOf, so they go through the same
+// stop-word filtering and stemming as the document.
+type Document struct {
+	FileID  string
+	Content string
+	Tokens  []Token
+	Terms   []string
+
+	text *TextProcessor
+}
+
+// NewDocument prepares the content with text, which may be nil to compare
+// plain normalized terms.
+func NewDocument(fileID, content string, text *TextProcessor) Document {
+	doc := Document{FileID: fileID, Content: content, text: text}
+	doc.Tokens = doc.Tokenize(content)
+	doc.Terms = doc.TermsOf(content)
+	return doc
+}
+
+func (d Document) Tokenize(text string) []Token {
+	return d.text.Tokenize(text)
+}
+
+func (d Document) TermsOf(text string) []string {
+	return d.text.Terms(text)
+}
+
+// SimilarityStrategy scores the submitted document against the candidate
+// files. Similarity is reported in percent; filtering by threshold and
+// sorting are left to the caller.
+type SimilarityStrategy interface {
+	Name() string
+	Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error)
+}
+
+func IsKnownStrategy(name string) bool {
+	switch name {
+	case StrategyWinnowing, StrategyJaccard, StrategyContainment,
+		StrategyTFIDF, StrategyTrigram, StrategyOverlap:
+		return true
+	}
+	return false
+}
+
+// NewSimilarityStrategy returns the strategy for opts. The trigram strategy
+// searches the database itself and uses the threshold and limit from opts.
+func NewSimilarityStrategy(repo Repository, opts AnalysisOptions) (SimilarityStrategy, error) {
+	switch opts.Strategy {
+	case StrategyWinnowing:
+		return winnowingStrategy{}, nil
+	case StrategyJaccard:
+		return jaccardStrategy{}, nil
+	case StrategyContainment:
+		return containmentStrategy{}, nil
+	case StrategyTFIDF:
+		return tfidfStrategy{}, nil
+	case StrategyTrigram:
+		limit := opts.TopN
+		if limit == 0 {
+			limit = maxCandidates
+		}
+		return trigramStrategy{repo: repo, threshold: opts.Threshold / 100, limit: limit}, nil
+	case StrategyOverlap:
+		return overlapStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", opts.Strategy)
+}
+
+// winnowingStrategy scores a file by the share of the document covered by
+// passages shared with it.
+type winnowingStrategy struct{}
+
+func (winnowingStrategy) Name() string { return StrategyWinnowing }
+
+func (winnowingStrategy) Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error) {
+	var similar []SimilarFile
+	for _, file := range candidates {
+		matches := FindMatches(doc.Tokens, doc.Tokenize(file.Content))
+		if len(matches) == 0 {
+			continue
+		}
+
+		matched := coveredTokens(doc.Tokens, matches, make([]bool, len(doc.Tokens)))
+		similar = append(similar, SimilarFile{
+			FileID:     file.ID,
+			Name:       file.Name,
+			Similarity: float64(matched) / float64(len(doc.Tokens)) * 100,
+			Matches:    matches,
+		})
+	}
+	return similar, nil
+}
+
+// jaccardStrategy compares the sets of word shingles of both documents.
+type jaccardStrategy struct{}
+
+func (jaccardStrategy) Name() string { return StrategyJaccard }
+
+func (jaccardStrategy) Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error) {
+	current := Shingles(doc.Terms)
+	return compareEach(candidates, func(file FileForComparison) float64 {
+		other := Shingles(doc.TermsOf(file.Content))
+		shared := sharedCount(current, other)
+		union := len(current) + len(other) - shared
+		if union == 0 {
+			return 0
+		}
+		return float64(shared) / float64(union) * 100
+	}), nil
+}
+
+// containmentStrategy reports which share of the document's shingles occurs
+// in the other file. Unlike Jaccard it is not lowered when the source is
+// much longer than the submitted document.
+type containmentStrategy struct{}
+
+func (containmentStrategy) Name() string { return StrategyContainment }
+
+func (containmentStrategy) Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error) {
+	current := Shingles(doc.Terms)
+	return compareEach(candidates, func(file FileForComparison) float64 {
+		if len(current) == 0 {
+			return 0
+		}
+		shared := sharedCount(current, Shingles(doc.TermsOf(file.Content)))
+		return float64(shared) / float64(len(current)) * 100
+	}), nil
+}
+
+// tfidfStrategy computes the cosine similarity of TF-IDF vectors. Document
+// frequencies are counted over the document and its candidates.
+type tfidfStrategy struct{}
+
+func (tfidfStrategy) Name() string { return StrategyTFIDF }
+
+func (tfidfStrategy) Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error) {
+	counts := make([]map[string]int, len(candidates))
+	df := make(map[string]int)
+
+	current := termCounts(doc.Terms)
+	for term := range current {
+		df[term]++
+	}
+	for i, file := range candidates {
+		counts[i] = termCounts(doc.TermsOf(file.Content))
+		for term := range counts[i] {
+			df[term]++
+		}
+	}
+
+	n := float64(len(candidates) + 1)
+	weights := func(tf map[string]int) map[string]float64 {
+		w := make(map[string]float64, len(tf))
+		for term, count := range tf {
+			w[term] = float64(count) * (math.Log((n+1)/float64(df[term]+1)) + 1)
+		}
+		return w
+	}
+
+	currentWeights := weights(current)
+	var similar []SimilarFile
+	for i, file := range candidates {
+		similarity := cosine(currentWeights, weights(counts[i])) * 100
+		if similarity > 0 {
+			similar = append(similar, SimilarFile{FileID: file.ID, Name: file.Name, Similarity: similarity})
+		}
+	}
+	return similar, nil
+}
+
+// trigramStrategy delegates to pg_trgm and searches the whole corpus instead
+// of the LSH candidates.
+type trigramStrategy struct {
+	repo      Repository
+	threshold float64
+	limit     int
+}
+
+func (trigramStrategy) Name() string { return StrategyTrigram }
+
+func (s trigramStrategy) Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error) {
+	similar, err := s.repo.FindSimilarFiles(doc.Content, doc.FileID, s.threshold, s.limit)
+	if err != nil {
+		return nil, err
+	}
+	for i := range similar {
+		similar[i].Similarity *= 100
+	}
+	return similar, nil
+}
+
+// overlapStrategy counts the words of the document that also occur anywhere
+// in the other file.
+type overlapStrategy struct{}
+
+func (overlapStrategy) Name() string { return StrategyOverlap }
+
+func (overlapStrategy) Compare(doc Document, candidates []FileForComparison) ([]SimilarFile, error) {
+	return compareEach(candidates, func(file FileForComparison) float64 {
+		if len(doc.Terms) == 0 {
+			return 0
+		}
+		fileWordSet := termCounts(doc.TermsOf(file.Content))
+		matches := 0
+		for _, word := range doc.Terms {
+			if fileWordSet[word] > 0 {
+				matches++
+			}
+		}
+		return float64(matches) / float64(len(doc.Terms)) * 100
+	}), nil
+}
+
+func compareEach(candidates []FileForComparison, score func(FileForComparison) float64) []SimilarFile {
+	var similar []SimilarFile
+	for _, file := range candidates {
+		if similarity := score(file); similarity > 0 {
+			similar = append(similar, SimilarFile{FileID: file.ID, Name: file.Name, Similarity: similarity})
+		}
+	}
+	return similar
+}
+
+func sharedCount(a, b map[uint64]struct{}) int {
+	shared := 0
+	for s := range a {
+		if _, ok := b[s]; ok {
+			shared++
+		}
+	}
+	return shared
+}
+
+func termCounts(terms []string) map[string]int {
+	counts := make(map[string]int)
+	for _, term := range terms {
+		counts[term]++
+	}
+	return counts
+}
+
+func cosine(a, b map[string]float64) float64 {
+	var dot, normA, normB float64
+	for term, w := range a {
+		dot += w * b[term]
+		normA += w * w
+	}
+	for _, w := range b {
+		normB += w * w
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestSimilarityStrategies(t *testing.T) {
+	doc := NewDocument("doc", "one two three four five six seven eight", nil)
+	candidates := []FileForComparison{
+		{ID: "copy", Name: "copy.txt", Content: "one two three four five six seven eight"},
+		{ID: "half", Name: "half.txt", Content: "one two three four five six nine ten eleven twelve thirteen fourteen"},
+		{ID: "other", Name: "other.txt", Content: "completely different words here"},
+	}
+
+	tests := []struct {
+		strategy string
+		expected map[string]float64
+	}{
+		{
+			strategy: StrategyWinnowing,
+			expected: map[string]float64{"copy": 100, "half": 75},
+		},
+		{
+			strategy: StrategyJaccard,
+			expected: map[string]float64{"copy": 100, "half": 4.0 / 12 * 100},
+		},
+		{
+			strategy: StrategyContainment,
+			expected: map[string]float64{"copy": 100, "half": 4.0 / 6 * 100},
+		},
+		{
+			strategy: StrategyOverlap,
+			expected: map[string]float64{"copy": 100, "half": 75},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			strategy, err := NewSimilarityStrategy(nil, AnalysisOptions{Strategy: tt.strategy})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			similar, err := strategy.Compare(doc, candidates)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(similar) != len(tt.expected) {
+				t.Fatalf("expected %d similar files, got %d", len(tt.expected), len(similar))
+			}
+
+			for _, sf := range similar {
+				if math.Abs(sf.Similarity-tt.expected[sf.FileID]) > 1e-9 {
+					t.Errorf("%s: expected similarity %v, got %v", sf.FileID, tt.expected[sf.FileID], sf.Similarity)
+				}
+			}
+		})
+	}
+
+	t.Run(StrategyTFIDF, func(t *testing.T) {
+		strategy, _ := NewSimilarityStrategy(nil, AnalysisOptions{Strategy: StrategyTFIDF})
+		similar, err := strategy.Compare(doc, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scores := make(map[string]float64)
+		for _, sf := range similar {
+			scores[sf.FileID] = sf.Similarity
+		}
+
+		if math.Abs(scores["copy"]-100) > 1e-9 {
+			t.Errorf("expected identical file to score 100, got %v", scores["copy"])
+		}
+		if scores["half"] <= 0 || scores["half"] >= scores["copy"] {
+			t.Errorf("expected partial match to score between 0 and 100, got %v", scores["half"])
+		}
+		if _, exists := scores["other"]; exists {
+			t.Error("unrelated file should not be reported")
+		}
+	})
+}
+
+func TestParseAnalysisOptions(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		expected    AnalysisOptions
+		expectError bool
+	}{
+		{
+			name:     "Default profile",
+			query:    "",
+			expected: AnalysisOptions{Profile: "default", Strategy: StrategyWinnowing, Threshold: 5, WordCloud: DefaultWordCloudOptions()},
+		},
+		{
+			name:     "Named profile",
+			query:    "profile=quick",
+			expected: AnalysisOptions{Profile: "quick", Strategy: StrategyTrigram, Threshold: 30, TopN: 5, WordCloud: DefaultWordCloudOptions()},
+		},
+		{
+			name:     "Overrides on top of a profile",
+			query:    "profile=topic&strategy=jaccard&threshold=12.5&top=3",
+			expected: AnalysisOptions{Profile: "topic", Strategy: StrategyJaccard, Threshold: 12.5, TopN: 3, Text: TextOptions{StopWords: true, Stemming: true}, WordCloud: DefaultWordCloudOptions()},
+		},
+		{
+			name:  "Word cloud options",
+			query: "width=400&height=300&palette=dark&max_words=20&format=svg",
+			expected: AnalysisOptions{Profile: "default", Strategy: StrategyWinnowing, Threshold: 5, WordCloud: WordCloudOptions{
+				Width: 400, Height: 300, Palette: "dark", MaxWords: 20, Format: WordCloudSVG, StopWords: true, Stemming: true,
+			}},
+		},
+		{
+			name:  "Text processing",
+			query: "stop_words=true&stemming=1&cloud_stemming=false",
+			expected: AnalysisOptions{Profile: "default", Strategy: StrategyWinnowing, Threshold: 5,
+				Text:      TextOptions{StopWords: true, Stemming: true},
+				WordCloud: WordCloudOptions{Width: 800, Height: 600, Palette: "default", MaxWords: 100, Format: WordCloudPNG, StopWords: true},
+			},
+		},
+		{
+			name:        "Invalid flag",
+			query:       "stemming=maybe",
+			expectError: true,
+		},
+		{
+			name:        "Unknown palette",
+			query:       "palette=rainbow",
+			expectError: true,
+		},
+		{
+			name:        "Unknown strategy",
+			query:       "strategy=magic",
+			expectError: true,
+		},
+		{
+			name:        "Unknown profile",
+			query:       "profile=missing",
+			expectError: true,
+		},
+		{
+			name:        "Threshold out of range",
+			query:       "threshold=150",
+			expectError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, _ := url.ParseQuery(tt.query)
+			opts, err := ParseAnalysisOptions(query)
+
+			if tt.expectError {
+				if err == nil {
+					t.Error("expected error, got nil")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if opts != tt.expected {
+				t.Errorf("expected %+v, got %+v", tt.expected, opts)
+			}
+		})
+	}
+}
+
+func TestAnalyzeWithStrategy(t *testing.T) {
+	mockRepo := &MockRepository{
+		Files: map[string]string{
+			"file1": "one two three four five six seven eight",
+			"file2": "one two three four five six nine ten eleven twelve",
+			"file3": "one two three four five six seven eight",
+		},
+		WordClouds: make(map[string][]byte),
+	}
+	analyzer := NewAnalyzer(mockRepo)
+	handler := NewHandler(analyzer)
+
+	t.Run("Strategy, threshold and top are applied and recorded", func(t *testing.T) {
+		req := internal(httptest.NewRequest("GET", "/analyze/file1?strategy=containment&threshold=50&top=1", nil))
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		result := mockRepo.AnalysisResult
+		if result.Options.Strategy != StrategyContainment {
+			t.Errorf("expected strategy to be recorded, got %q", result.Options.Strategy)
+		}
+		if len(result.SimilarFiles) != 1 || result.SimilarFiles[0].FileID != "file3" {
+			t.Fatalf("expected only the identical file, got %+v", result.SimilarFiles)
+		}
+		if len(result.SimilarFiles[0].Matches) == 0 {
+			t.Error("expected matched passages for a score-only strategy")
+		}
+	})
+
+	t.Run("Invalid strategy", func(t *testing.T) {
+		req := internal(httptest.NewRequest("POST", "/analyze/file1?strategy=magic", nil))
+		rr := httptest.NewRecorder()
+		handler.AnalyzeFile(rr, req)
+
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	topTermsCount = 10
+	mtldThreshold = 0.72
+)
+
+// TextStatistics are the statistics of a text beyond the basic counts.
+// Averages are per sentence and per word, lengths are in characters.
+type TextStatistics struct {
+	Sentences          int             `json:"sentences"`
+	CharactersNoSpaces int             `json:"characters_no_spaces"`
+	AvgSentenceLength  float64         `json:"avg_sentence_length"`
+	AvgWordLength      float64         `json:"avg_word_length"`
+	TypeTokenRatio     float64         `json:"type_token_ratio"`
+	MTLD               float64         `json:"mtld"`
+	Language           string          `json:"language,omitempty"`
+	Readability        *Readability    `json:"readability,omitempty"`
+	TopTerms           []TermFrequency `json:"top_terms"`
+	TopBigrams         []TermFrequency `json:"top_bigrams"`
+}
+
+// Readability is the Flesch reading ease for English texts and Oborneva's
+// adaptation of it for Russian ones. Higher scores mean easier texts.
+type Readability struct {
+	Index string  `json:"index"`
+	Score float64 `json:"score"`
+}
+
+type TermFrequency struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+var blankLines = regexp.MustCompile(`\n[ \t\f\v]*\n`)
+
+// NormalizeLineEndings converts Windows and old Mac line endings to "\n".
+func NormalizeLineEndings(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n")
+}
+
+// Paragraphs splits text on blank lines and drops empty paragraphs.
+func Paragraphs(text string) []string {
+	var paragraphs []string
+	for _, p := range blankLines.Split(NormalizeLineEndings(text), -1) {
+		if strings.TrimSpace(p) != "" {
+			paragraphs = append(paragraphs, p)
+		}
+	}
+	return paragraphs
+}
+
+// abbreviations end with a period that does not end the sentence. Entries
+// are lowercase and without the final period.
+var abbreviations = map[string]bool{
+	"т.е": true, "т.д": true, "т.п": true, "т.к": true, "т.н": true, "др": true,
+	"пр": true, "см": true, "ср": true, "г": true, "гг": true, "в": true, "вв": true,
+	"им": true, "ул": true, "д": true, "стр": true, "рис": true, "табл": true,
+	"с": true, "п": true, "тыс": true, "млн": true, "млрд": true, "руб": true,
+	"коп": true, "проф": true, "акад": true, "доц": true, "напр": true,
+	"mr": true, "mrs": true, "ms": true, "dr": true, "prof": true, "st": true,
+	"jr": true, "sr": true, "vs": true, "etc": true, "e.g": true, "i.e": true,
+	"fig": true, "no": true, "vol": true, "p": true, "pp": true, "approx": true,
+	"inc": true, "ltd": true, "co": true,
+}
+
+// Sentences splits every paragraph into sentences at ".", "!", "?" and "…"
+// followed by a space and a capital letter, digit or quote. Periods after
+// known abbreviations and single-letter initials do not end a sentence, and
+// a paragraph always ends one.
+func Sentences(text string) []string {
+	var sentences []string
+	for _, paragraph := range Paragraphs(text) {
+		runes := []rune(paragraph)
+		start := 0
+		for i := 0; i < len(runes); i++ {
+			if !isTerminator(runes[i]) {
+				continue
+			}
+
+			end := i + 1
+			for end < len(runes) && (isTerminator(runes[end]) || isClosing(runes[end])) {
+				end++
+			}
+			i = end - 1
+
+			next := end
+			for next < len(runes) && unicode.IsSpace(runes[next]) {
+				next++
+			}
+			if next == end || next == len(runes) || !startsSentence(runes[next]) {
+				continue
+			}
+			if runes[end-1] == '.' && isAbbreviation(runes[start:end]) {
+				continue
+			}
+
+			sentences = appendSentence(sentences, runes[start:end])
+			start = next
+		}
+		sentences = appendSentence(sentences, runes[start:])
+	}
+	return sentences
+}
+
+func appendSentence(sentences []string, runes []rune) []string {
+	if sentence := strings.TrimSpace(string(runes)); len(Tokenize(sentence)) > 0 {
+		sentences = append(sentences, sentence)
+	}
+	return sentences
+}
+
+func isTerminator(r rune) bool {
+	return r == '.' || r == '!' || r == '?' || r == '…'
+}
+
+func isClosing(r rune) bool {
+	return strings.ContainsRune(`"')]»”’`, r)
+}
+
+func startsSentence(r rune) bool {
+	return unicode.IsUpper(r) || unicode.IsDigit(r) || strings.ContainsRune(`"'(«“—-`, r)
+}
+
+// isAbbreviation reports whether the sentence candidate ends with an
+// abbreviation or an initial such as "А." in "А. С. Пушкин".
+func isAbbreviation(candidate []rune) bool {
+	text := strings.TrimRight(string(candidate), ".")
+	last := text
+	if i := strings.LastIndexFunc(text, unicode.IsSpace); i >= 0 {
+		last = text[i+1:]
+	}
+	last = strings.TrimLeft(last, `"'(«“`)
+
+	if abbreviations[strings.ToLower(last)] {
+		return true
+	}
+	letters := []rune(last)
+	return len(letters) == 1 && unicode.IsUpper(letters[0])
+}
+
+// ComputeStatistics computes the extended statistics of text. Top terms and
+// bigrams leave out stop words, including the custom ones of the profile, and
+// bigrams never span two sentences.
+func ComputeStatistics(text, profile string) TextStatistics {
+	text = NormalizeLineEndings(text)
+	tokens := Tokenize(text)
+	runes := []rune(text)
+
+	sentences := Sentences(text)
+	stats := TextStatistics{
+		Sentences:  len(sentences),
+		TopTerms:   []TermFrequency{},
+		TopBigrams: []TermFrequency{},
+	}
+
+	for _, r := range runes {
+		if !unicode.IsSpace(r) {
+			stats.CharactersNoSpaces++
+		}
+	}
+
+	if len(tokens) == 0 {
+		return stats
+	}
+
+	terms := make([]string, len(tokens))
+	letters := 0
+	for i, t := range tokens {
+		terms[i] = t.Term
+		letters += t.End - t.Start
+	}
+
+	stats.AvgWordLength = float64(letters) / float64(len(tokens))
+	if stats.Sentences > 0 {
+		stats.AvgSentenceLength = float64(len(tokens)) / float64(stats.Sentences)
+	}
+	stats.TypeTokenRatio = float64(len(termCounts(terms))) / float64(len(terms))
+	stats.MTLD = MTLD(terms)
+	stats.Language = dominantLanguage(terms)
+	stats.Readability = readability(stats.Language, terms, stats.Sentences)
+
+	stop := NewTextProcessor(TextOptions{StopWords: true}, profile)
+	var content []string
+	bigrams := make(map[string]int)
+	for _, term := range terms {
+		if !stop.IsStopWord(term) {
+			content = append(content, term)
+		}
+	}
+	for _, sentence := range sentences {
+		words := Terms(sentence)
+		for i := 0; i+1 < len(words); i++ {
+			if !stop.IsStopWord(words[i]) && !stop.IsStopWord(words[i+1]) {
+				bigrams[words[i]+" "+words[i+1]]++
+			}
+		}
+	}
+	stats.TopTerms = topFrequencies(termCounts(content), topTermsCount)
+	stats.TopBigrams = topFrequencies(bigrams, topTermsCount)
+
+	return stats
+}
+
+// MTLD is the measure of textual lexical diversity: the mean length of runs
+// of words that keep the type-token ratio above 0.72, averaged over a
+// forward and a backward pass. Unlike the plain ratio it does not depend on
+// the text length. Texts too short to complete a run get their length.
+func MTLD(terms []string) float64 {
+	reversed := make([]string, len(terms))
+	for i, term := range terms {
+		reversed[len(terms)-1-i] = term
+	}
+	return (mtldPass(terms) + mtldPass(reversed)) / 2
+}
+
+func mtldPass(terms []string) float64 {
+	factors := 0.0
+	types := make(map[string]bool)
+	count := 0
+	for _, term := range terms {
+		types[term] = true
+		count++
+		if float64(len(types))/float64(count) <= mtldThreshold {
+			factors++
+			types = make(map[string]bool)
+			count = 0
+		}
+	}
+	if count > 0 {
+		ttr := float64(len(types)) / float64(count)
+		factors += (1 - ttr) / (1 - mtldThreshold)
+	}
+	if factors == 0 {
+		return float64(len(terms))
+	}
+	return float64(len(terms)) / factors
+}
+
+func dominantLanguage(terms []string) string {
+	counts := make(map[string]int)
+	for _, term := range terms {
+		counts[TermLanguage(term)]++
+	}
+	switch {
+	case counts[LanguageRussian] == 0 && counts[LanguageEnglish] == 0:
+		return ""
+	case counts[LanguageRussian] >= counts[LanguageEnglish]:
+		return LanguageRussian
+	}
+	return LanguageEnglish
+}
+
+// readability uses only the words of the given language, so numbers and
+// quotes in another language do not skew the syllable count.
+func readability(language string, terms []string, sentences int) *Readability {
+	words, syllables := 0, 0
+	for _, term := range terms {
+		if TermLanguage(term) == language {
+			words++
+			syllables += countSyllables(term, language)
+		}
+	}
+	if words == 0 || sentences == 0 {
+		return nil
+	}
+
+	wordsPerSentence := float64(words) / float64(sentences)
+	syllablesPerWord := float64(syllables) / float64(words)
+
+	if language == LanguageRussian {
+		return &Readability{
+			Index: "oborneva",
+			Score: 206.835 - 1.3*wordsPerSentence - 60.1*syllablesPerWord,
+		}
+	}
+	return &Readability{
+		Index: "flesch",
+		Score: 206.835 - 1.015*wordsPerSentence - 84.6*syllablesPerWord,
+	}
+}
+
+// countSyllables counts vowels in Russian words and groups of vowels in
+// English ones, ignoring a silent final "e". Every word has a syllable.
+func countSyllables(term, language string) int {
+	count := 0
+	if language == LanguageRussian {
+		for _, r := range term {
+			if strings.ContainsRune("аеёиоуыэюя", r) {
+				count++
+			}
+		}
+	} else {
+		runes := []rune(term)
+		previous := false
+		for i, r := range runes {
+			vowel := strings.ContainsRune("aeiouy", r)
+			if vowel && !previous && !(r == 'e' && i == len(runes)-1 && count > 0) {
+				count++
+			}
+			previous = vowel
+		}
+	}
+	return max(count, 1)
+}
+
+func topFrequencies(counts map[string]int, limit int) []TermFrequency {
+	frequencies := make([]TermFrequency, 0, len(counts))
+	for term, count := range counts {
+		frequencies = append(frequencies, TermFrequency{Term: term, Count: count})
+	}
+
+	sort.Slice(frequencies, func(i, j int) bool {
+		if frequencies[i].Count != frequencies[j].Count {
+			return frequencies[i].Count > frequencies[j].Count
+		}
+		return frequencies[i].Term < frequencies[j].Term
+	})
+
+	if len(frequencies) > limit {
+		frequencies = frequencies[:limit]
+	}
+	return frequencies
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestSentences(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "Simple sentences",
+			text:     "Первое предложение. Второе! Третье? Hello world.",
+			expected: []string{"Первое предложение.", "Второе!", "Третье?", "Hello world."},
+		},
+		{
+			name:     "Abbreviations and initials",
+			text:     "Это книги, тетради и т.д. Их написал А. С. Пушкин в 1830 г. Mr. Smith read them, e.g. Onegin.",
+			expected: []string{"Это книги, тетради и т.д. Их написал А. С. Пушкин в 1830 г. Mr. Smith read them, e.g. Onegin."},
+		},
+		{
+			name:     "Ellipsis, quotes and lowercase continuation",
+			text:     "Он сказал: «Иди.» Потом... помолчал. Конец?!",
+			expected: []string{"Он сказал: «Иди.»", "Потом... помолчал.", "Конец?!"},
+		},
+		{
+			name:     "Paragraph without final punctuation",
+			text:     "Заголовок\r\n\r\nТекст абзаца. Еще одно",
+			expected: []string{"Заголовок", "Текст абзаца.", "Еще одно"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Sentences(tt.text)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestCountParagraphsLineEndings(t *testing.T) {
+	for name, text := range map[string]string{
+		"Unix":          "Первый абзац.\n\nВторой абзац.\n \nТретий.",
+		"Windows":       "Первый абзац.\r\n\r\nВторой абзац.\r\n \r\nТретий.",
+		"Old Mac":       "Первый абзац.\r\rВторой абзац.\r\rТретий.",
+		"Extra newline": "Первый абзац.\n\n\n\nВторой абзац.\n\nТретий.\n",
+	} {
+		if got := CountParagraphs(text); got != 3 {
+			t.Errorf("%s: expected 3 paragraphs, got %d", name, got)
+		}
+	}
+}
+
+func TestComputeStatistics(t *testing.T) {
+	t.Run("Russian text", func(t *testing.T) {
+		text := "Кошка спит на окне. Кошка любит солнце и тепло.\r\n\r\nСобака спит у двери."
+		stats := ComputeStatistics(text, "")
+
+		if stats.Sentences != 3 {
+			t.Errorf("expected 3 sentences, got %d", stats.Sentences)
+		}
+		if stats.AvgSentenceLength != 13.0/3 {
+			t.Errorf("expected %v words per sentence, got %v", 13.0/3, stats.AvgSentenceLength)
+		}
+		if stats.CharactersNoSpaces != 56 {
+			t.Errorf("expected 56 characters without spaces, got %d", stats.CharactersNoSpaces)
+		}
+		if stats.TypeTokenRatio != 11.0/13 {
+			t.Errorf("expected type-token ratio %v, got %v", 11.0/13, stats.TypeTokenRatio)
+		}
+		if stats.Language != LanguageRussian || stats.Readability == nil || stats.Readability.Index != "oborneva" {
+			t.Fatalf("expected Oborneva readability for Russian, got %q %+v", stats.Language, stats.Readability)
+		}
+
+		if stats.TopTerms[0] != (TermFrequency{Term: "кошка", Count: 2}) {
+			t.Errorf("expected the most frequent term first, got %+v", stats.TopTerms)
+		}
+		for _, tf := range stats.TopTerms {
+			if tf.Term == "и" || tf.Term == "на" {
+				t.Errorf("stop word %q in top terms", tf.Term)
+			}
+		}
+		bigrams := []TermFrequency{{"кошка любит", 1}, {"кошка спит", 1}, {"любит солнце", 1}, {"собака спит", 1}}
+		if !reflect.DeepEqual(stats.TopBigrams, bigrams) {
+			t.Errorf("unexpected bigrams %+v", stats.TopBigrams)
+		}
+	})
+
+	t.Run("English readability", func(t *testing.T) {
+		easy := ComputeStatistics("The cat sat. The dog ran. We had fun.", "")
+		hard := ComputeStatistics("Institutional accountability necessitates comprehensive organizational transparency.", "")
+
+		if easy.Readability == nil || easy.Readability.Index != "flesch" || hard.Readability == nil {
+			t.Fatalf("expected Flesch readability, got %+v and %+v", easy.Readability, hard.Readability)
+		}
+		if easy.Readability.Score <= hard.Readability.Score {
+			t.Errorf("expected simple text to be easier: %v <= %v", easy.Readability.Score, hard.Readability.Score)
+		}
+	})
+
+	t.Run("Empty text", func(t *testing.T) {
+		stats := ComputeStatistics(" \r\n ", "")
+		if stats.Sentences != 0 || stats.Readability != nil || len(stats.TopTerms) != 0 {
+			t.Errorf("expected empty statistics, got %+v", stats)
+		}
+	})
+}
+
+func TestMTLD(t *testing.T) {
+	repetitive := Terms("the cat the cat the cat the cat the cat the cat the cat the cat")
+	diverse := Terms("one two three four five six seven eight nine ten eleven twelve the cat sat on a mat")
+
+	if MTLD(repetitive) >= MTLD(diverse) {
+		t.Errorf("expected repetitive text to be less diverse: %v >= %v", MTLD(repetitive), MTLD(diverse))
+	}
+	if got := MTLD(Terms("a b a b a b a b")); math.Abs(got-4) > 1e-9 {
+		t.Errorf("unexpected MTLD %v", got)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"strings"
+	"unicode"
+
+	"github.com/kljensen/snowball/english"
+	"github.com/kljensen/snowball/russian"
+)
+
+const (
+	LanguageRussian = "ru"
+	LanguageEnglish = "en"
+)
+
+//go:embed stopwords/*.txt
+var stopWordFiles embed.FS
+
+var builtinStopWords = map[string]map[string]bool{
+	LanguageRussian: loadStopWords("stopwords/ru.txt"),
+	LanguageEnglish: loadStopWords("stopwords/en.txt"),
+}
+
+func loadStopWords(name string) map[string]bool {
+	data, err := stopWordFiles.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+
+	words := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words[NormalizeWord(line)] = true
+	}
+	return words
+}
+
+// TextOptions enable stop-word filtering and stemming of normalized terms.
+type TextOptions struct {
+	StopWords bool `json:"stop_words"`
+	Stemming  bool `json:"stemming"`
+}
+
+// TextProcessor applies TextOptions to tokens. The language of every term is
+// detected separately, so mixed Russian and English texts are handled too.
+type TextProcessor struct {
+	opts       TextOptions
+	customStop map[string]bool
+}
+
+// NewTextProcessor returns a processor for opts that also drops the custom
+// stop words of the given profile when stop-word filtering is enabled.
+func NewTextProcessor(opts TextOptions, profile string) *TextProcessor {
+	custom := make(map[string]bool)
+	for _, word := range profileStopWords[profile] {
+		custom[NormalizeWord(word)] = true
+	}
+	return &TextProcessor{opts: opts, customStop: custom}
+}
+
+func (p *TextProcessor) IsStopWord(term string) bool {
+	if p.customStop[term] {
+		return true
+	}
+	return builtinStopWords[TermLanguage(term)][term]
+}
+
+// Process filters and stems tokens in place of their terms. Offsets are kept,
+// so spans built from processed tokens still point into the original text.
+func (p *TextProcessor) Process(tokens []Token) []Token {
+	if p == nil || (!p.opts.StopWords && !p.opts.Stemming) {
+		return tokens
+	}
+
+	processed := make([]Token, 0, len(tokens))
+	for _, t := range tokens {
+		if p.opts.StopWords && p.IsStopWord(t.Term) {
+			continue
+		}
+		if p.opts.Stemming {
+			t.Term = Stem(t.Term)
+		}
+		processed = append(processed, t)
+	}
+	return processed
+}
+
+func (p *TextProcessor) Tokenize(text string) []Token {
+	return p.Process(Tokenize(text))
+}
+
+func (p *TextProcessor) Terms(text string) []string {
+	tokens := p.Tokenize(text)
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = t.Term
+	}
+	return terms
+}
+
+// TermLanguage guesses the language of a single term by its script.
+func TermLanguage(term string) string {
+	for _, r := range term {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			return LanguageRussian
+		case unicode.Is(unicode.Latin, r):
+			return LanguageEnglish
+		}
+	}
+	return ""
+}
+
+// Stem applies the Snowball stemmer for the language of the term and leaves
+// terms in other scripts unchanged.
+func Stem(term string) string {
+	switch TermLanguage(term) {
+	case LanguageRussian:
+		return russian.Stem(term, true)
+	case LanguageEnglish:
+		return english.Stem(term, true)
+	}
+	return term
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"maps"
+	"reflect"
+	"testing"
+)
+
+func TestTextProcessor(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     TextOptions
+		text     string
+		expected []string
+	}{
+		{
+			name:     "Disabled",
+			text:     "Анализ и the analysis",
+			expected: []string{"анализ", "и", "the", "analysis"},
+		},
+		{
+			name:     "Stop words in both languages",
+			opts:     TextOptions{StopWords: true},
+			text:     "Анализ текста и the analysis of texts",
+			expected: []string{"анализ", "текста", "analysis", "texts"},
+		},
+		{
+			name:     "Russian word forms share a stem",
+			opts:     TextOptions{Stemming: true},
+			text:     "анализ анализа анализом",
+			expected: []string{"анализ", "анализ", "анализ"},
+		},
+		{
+			name:     "English word forms share a stem",
+			opts:     TextOptions{StopWords: true, Stemming: true},
+			text:     "The connected connections are connecting",
+			expected: []string{"connect", "connect", "connect"},
+		},
+		{
+			name:     "Numbers are kept",
+			opts:     TextOptions{StopWords: true, Stemming: true},
+			text:     "в 2024 году",
+			expected: []string{"2024", "год"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := NewTextProcessor(tt.opts, "").Terms(tt.text)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("Offsets are kept", func(t *testing.T) {
+		text := "Это анализом текста"
+		tokens := NewTextProcessor(TextOptions{StopWords: true, Stemming: true}, "").Tokenize(text)
+		runes := []rune(text)
+
+		if len(tokens) != 2 {
+			t.Fatalf("expected 2 tokens, got %d", len(tokens))
+		}
+		if got := string(runes[tokens[0].Start:tokens[0].End]); got != "анализом" {
+			t.Errorf("expected first token to cover %q, got %q", "анализом", got)
+		}
+	})
+
+	t.Run("Custom stop words of a profile", func(t *testing.T) {
+		useProfile(t, "lab", AnalysisOptions{Strategy: StrategyWinnowing}, "Вариант", "задание")
+
+		got := NewTextProcessor(TextOptions{StopWords: true}, "lab").Terms("Задание вариант 3: анализ")
+		if !reflect.DeepEqual(got, []string{"3", "анализ"}) {
+			t.Errorf("expected custom stop words to be removed, got %q", got)
+		}
+
+		before, _ := ProfileOptions("lab")
+		useProfile(t, "lab", AnalysisOptions{Strategy: StrategyWinnowing}, "Вариант", "задание", "отчет")
+		if after, _ := ProfileOptions("lab"); after == before {
+			t.Error("options must change with the stop words, or cached results are reused")
+		}
+	})
+}
+
+// useProfile registers a profile for the test and restores the previous
+// profiles when it ends.
+func useProfile(t *testing.T, name string, opts AnalysisOptions, stopWords ...string) {
+	savedProfiles, savedStopWords := maps.Clone(profiles), maps.Clone(profileStopWords)
+	t.Cleanup(func() {
+		profiles, profileStopWords = savedProfiles, savedStopWords
+	})
+	profiles[name] = opts
+	profileStopWords[name] = stopWords
+}
+
+func TestCloudTerms(t *testing.T) {
+	opts := DefaultWordCloudOptions()
+	terms := cloudTerms("Анализ и анализа, анализом и анализа", opts, "")
+
+	expected := []string{"анализа", "анализа", "анализа", "анализа"}
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("expected word forms grouped under the most frequent one, got %q", terms)
+	}
+}
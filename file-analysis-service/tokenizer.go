@@ -0,0 +1,123 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Token is a normalized word together with its position in the original
+// text. Start and End are rune offsets, End is exclusive.
+type Token struct {
+	Term  string
+	Start int
+	End   int
+}
+
+// Tokenize splits text into words using UAX #29 word boundaries. Words joined
+// by a hyphen ("что-то", "well-known") are kept together, apostrophes inside
+// words are preserved and every term is normalized with NormalizeWord.
+func Tokenize(text string) []Token {
+	var (
+		tokens  []Token
+		pending *Token
+		joiner  bool
+		offset  int
+		state   = -1
+		word    string
+		rest    = text
+	)
+
+	flush := func() {
+		if pending != nil {
+			if term := NormalizeWord(pending.Term); term != "" {
+				pending.Term = term
+				tokens = append(tokens, *pending)
+			}
+			pending = nil
+		}
+		joiner = false
+	}
+
+	for len(rest) > 0 {
+		word, rest, state = uniseg.FirstWordInString(rest, state)
+		length := utf8.RuneCountInString(word)
+		start := offset
+		offset += length
+
+		switch {
+		case isWordSegment(word):
+			if pending != nil && joiner {
+				pending.Term += "-" + word
+				pending.End = offset
+				joiner = false
+				continue
+			}
+			flush()
+			pending = &Token{Term: word, Start: start, End: offset}
+		case isHyphen(word) && pending != nil && !joiner:
+			joiner = true
+		default:
+			flush()
+		}
+	}
+	flush()
+
+	return tokens
+}
+
+// Terms returns only the normalized words of text.
+func Terms(text string) []string {
+	tokens := Tokenize(text)
+	terms := make([]string, len(tokens))
+	for i, t := range tokens {
+		terms[i] = t.Term
+	}
+	return terms
+}
+
+// NormalizeText joins the normalized words of text with single spaces.
+func NormalizeText(text string) string {
+	return strings.Join(Terms(text), " ")
+}
+
+// NormalizeWord applies NFC normalization, lowercases the word, folds "ё" to
+// "е", unifies apostrophes and hyphens and trims punctuation at the edges.
+func NormalizeWord(word string) string {
+	word = norm.NFC.String(word)
+	word = strings.ToLower(word)
+
+	word = strings.Map(func(r rune) rune {
+		switch r {
+		case 'ё':
+			return 'е'
+		case '’', 'ʼ', '‘', '`':
+			return '\''
+		case '‐', '‑', '–':
+			return '-'
+		}
+		return r
+	}, word)
+
+	return strings.Trim(word, "'-")
+}
+
+func isWordSegment(segment string) bool {
+	for _, r := range segment {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHyphen(segment string) bool {
+	switch segment {
+	case "-", "‐", "‑", "–":
+		return true
+	}
+	return false
+}
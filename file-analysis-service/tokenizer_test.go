@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTerms(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		expected []string
+	}{
+		{
+			name:     "English text",
+			text:     "Hello, World! It's a well-known test.",
+			expected: []string{"hello", "world", "it's", "a", "well-known", "test"},
+		},
+		{
+			name:     "Russian text",
+			text:     "Ёжик пошёл в лес — что-то искать.",
+			expected: []string{"ежик", "пошел", "в", "лес", "что-то", "искать"},
+		},
+		{
+			name:     "Mixed languages and numbers",
+			text:     "Анализ text 2024 года",
+			expected: []string{"анализ", "text", "2024", "года"},
+		},
+		{
+			name:     "Decomposed characters are composed",
+			text:     "ёлка",
+			expected: []string{"елка"},
+		},
+		{
+			name:     "Typographic apostrophe",
+			text:     "don’t",
+			expected: []string{"don't"},
+		},
+		{
+			name:     "En dash joins words",
+			text:     "трасса Москва–Петербург",
+			expected: []string{"трасса", "москва-петербург"},
+		},
+		{
+			name:     "Dangling hyphens",
+			text:     "слово - другое -",
+			expected: []string{"слово", "другое"},
+		},
+		{
+			name:     "Empty text",
+			text:     "  \n\t ",
+			expected: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Terms(tt.text)
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestTokenizeOffsets(t *testing.T) {
+	text := "Привет, мир-сосед!"
+	tokens := Tokenize(text)
+	runes := []rune(text)
+
+	if len(tokens) != 2 {
+		t.Fatalf("expected 2 tokens, got %d", len(tokens))
+	}
+
+	if got := string(runes[tokens[0].Start:tokens[0].End]); got != "Привет" {
+		t.Errorf("expected first token to cover %q, got %q", "Привет", got)
+	}
+
+	if got := string(runes[tokens[1].Start:tokens[1].End]); got != "мир-сосед" {
+		t.Errorf("expected second token to cover %q, got %q", "мир-сосед", got)
+	}
+}
+
+func TestCountWordsUnicode(t *testing.T) {
+	if got := CountWords("Это тестовый текст, not ASCII only."); got != 6 {
+		t.Errorf("expected 6 words, got %d", got)
+	}
+}
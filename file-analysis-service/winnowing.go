@@ -0,0 +1,169 @@
+package main
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// Winnowing parameters: k-grams of winnowK tokens and windows of winnowW
+// k-grams. Every shared passage of at least winnowK+winnowW-1 tokens is
+// guaranteed to be found, shorter coincidences below winnowK are ignored.
+const (
+	winnowK = 4
+	winnowW = 3
+)
+
+// MatchedSpan is a passage of the submitted document that also occurs in a
+// source document. Offsets are rune offsets, ends are exclusive.
+type MatchedSpan struct {
+	Start       int `json:"start"`
+	End         int `json:"end"`
+	SourceStart int `json:"source_start"`
+	SourceEnd   int `json:"source_end"`
+	Tokens      int `json:"tokens"`
+}
+
+type winnowFingerprint struct {
+	hash uint64
+	pos  int
+}
+
+// Winnow selects the MOSS-style fingerprints of a token sequence: the
+// minimum k-gram hash of every window, rightmost on ties.
+func Winnow(tokens []Token) []winnowFingerprint {
+	hashes := kgramHashes(tokens)
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	window := winnowW
+	if len(hashes) < window {
+		window = len(hashes)
+	}
+
+	var fingerprints []winnowFingerprint
+	last := -1
+	for start := 0; start+window <= len(hashes); start++ {
+		min := start
+		for i := start + 1; i < start+window; i++ {
+			if hashes[i] <= hashes[min] {
+				min = i
+			}
+		}
+		if min != last {
+			fingerprints = append(fingerprints, winnowFingerprint{hash: hashes[min], pos: min})
+			last = min
+		}
+	}
+	return fingerprints
+}
+
+// FindMatches returns the passages shared by the submitted and the source
+// token sequences. Matching fingerprints are used as seeds and extended in
+// both directions over equal tokens.
+func FindMatches(submitted, source []Token) []MatchedSpan {
+	sourcePositions := make(map[uint64][]int)
+	for _, fp := range Winnow(source) {
+		sourcePositions[fp.hash] = append(sourcePositions[fp.hash], fp.pos)
+	}
+
+	type run struct{ start, end, sourceStart int }
+	var runs []run
+
+	covered := func(i, j int) bool {
+		for _, r := range runs {
+			if i >= r.start && i < r.end && j-i == r.sourceStart-r.start {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, fp := range Winnow(submitted) {
+		for _, j := range sourcePositions[fp.hash] {
+			i := fp.pos
+			if covered(i, j) || !tokensEqual(submitted, source, i, j, winnowK) {
+				continue
+			}
+
+			start, sourceStart := i, j
+			for start > 0 && sourceStart > 0 && submitted[start-1].Term == source[sourceStart-1].Term {
+				start--
+				sourceStart--
+			}
+
+			end, sourceEnd := i+winnowK, j+winnowK
+			for end < len(submitted) && sourceEnd < len(source) && submitted[end].Term == source[sourceEnd].Term {
+				end++
+				sourceEnd++
+			}
+
+			runs = append(runs, run{start: start, end: end, sourceStart: sourceStart})
+		}
+	}
+
+	sort.Slice(runs, func(a, b int) bool {
+		return runs[a].start < runs[b].start
+	})
+
+	spans := make([]MatchedSpan, 0, len(runs))
+	for _, r := range runs {
+		length := r.end - r.start
+		spans = append(spans, MatchedSpan{
+			Start:       submitted[r.start].Start,
+			End:         submitted[r.end-1].End,
+			SourceStart: source[r.sourceStart].Start,
+			SourceEnd:   source[r.sourceStart+length-1].End,
+			Tokens:      length,
+		})
+	}
+	return spans
+}
+
+// coveredTokens marks the submitted tokens that lie inside any of the spans.
+func coveredTokens(tokens []Token, spans []MatchedSpan, covered []bool) int {
+	count := 0
+	for _, span := range spans {
+		i := sort.Search(len(tokens), func(i int) bool {
+			return tokens[i].Start >= span.Start
+		})
+		for ; i < len(tokens) && tokens[i].End <= span.End; i++ {
+			if !covered[i] {
+				covered[i] = true
+				count++
+			}
+		}
+	}
+	return count
+}
+
+func kgramHashes(tokens []Token) []uint64 {
+	if len(tokens) < winnowK {
+		return nil
+	}
+
+	hashes := make([]uint64, 0, len(tokens)-winnowK+1)
+	terms := make([]string, winnowK)
+	for i := 0; i+winnowK <= len(tokens); i++ {
+		for j := range terms {
+			terms[j] = tokens[i+j].Term
+		}
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(terms, " ")))
+		hashes = append(hashes, h.Sum64())
+	}
+	return hashes
+}
+
+func tokensEqual(a, b []Token, i, j, n int) bool {
+	if i+n > len(a) || j+n > len(b) {
+		return false
+	}
+	for k := 0; k < n; k++ {
+		if a[i+k].Term != b[j+k].Term {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestFindMatches(t *testing.T) {
+	submitted := "Введение. Плагиат — это умышленное присвоение авторства чужого произведения науки или искусства. Конец."
+	source := "В словаре сказано: плагиат это умышленное присвоение авторства чужого произведения науки или искусства, " +
+		"а также чужих идей."
+
+	t.Run("Shared passage with offsets in both documents", func(t *testing.T) {
+		matches := FindMatches(Tokenize(submitted), Tokenize(source))
+		if len(matches) != 1 {
+			t.Fatalf("expected 1 matched span, got %d", len(matches))
+		}
+
+		m := matches[0]
+		want := "Плагиат — это умышленное присвоение авторства чужого произведения науки или искусства"
+		if got := string([]rune(submitted)[m.Start:m.End]); got != want {
+			t.Errorf("unexpected submitted passage %q", got)
+		}
+
+		wantSource := "плагиат это умышленное присвоение авторства чужого произведения науки или искусства"
+		if got := string([]rune(source)[m.SourceStart:m.SourceEnd]); got != wantSource {
+			t.Errorf("unexpected source passage %q", got)
+		}
+
+		if m.Tokens != 10 {
+			t.Errorf("expected 10 matched tokens, got %d", m.Tokens)
+		}
+	})
+
+	t.Run("Shared vocabulary without shared passages", func(t *testing.T) {
+		a := "плагиат искусства науки авторства чужого произведения"
+		b := "произведения чужого авторства науки искусства плагиат"
+		if matches := FindMatches(Tokenize(a), Tokenize(b)); len(matches) != 0 {
+			t.Errorf("expected no matches for reordered vocabulary, got %d", len(matches))
+		}
+	})
+
+	t.Run("Text shorter than a k-gram", func(t *testing.T) {
+		if matches := FindMatches(Tokenize("два слова"), Tokenize("два слова")); len(matches) != 0 {
+			t.Errorf("expected no matches, got %d", len(matches))
+		}
+	})
+}
+
+func TestCalculatePlagiarismScore(t *testing.T) {
+	mockRepo := &MockRepository{
+		Files: map[string]string{
+			"file1": "one two three four five six seven eight nine ten",
+			"file2": "one two three four five six something else entirely",
+		},
+	}
+	analyzer := NewAnalyzer(mockRepo)
+
+	_, similar, err := analyzer.calculatePlagiarism(mockRepo.Files["file1"], "file1", DefaultOptions())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(similar) != 1 {
+		t.Fatalf("expected 1 similar file, got %d", len(similar))
+	}
+
+	if similar[0].Similarity != 60 {
+		t.Errorf("expected similarity 60, got %v", similar[0].Similarity)
+	}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+const (
+	WordCloudPNG = "png"
+	WordCloudSVG = "svg"
+)
+
+const (
+	minFontSize    = 12
+	maxFontSize    = 96
+	wordPadding    = 2
+	spiralStep     = 0.1
+	spiralTurnGain = 1.5
+)
+
+// WordCloudOptions control how the word cloud of an analysis is rendered.
+// With Stemming, word forms are counted together and shown in their most
+// frequent form.
+type WordCloudOptions struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Palette   string `json:"palette"`
+	MaxWords  int    `json:"max_words"`
+	Format    string `json:"format"`
+	StopWords bool   `json:"stop_words"`
+	Stemming  bool   `json:"stemming"`
+}
+
+func DefaultWordCloudOptions() WordCloudOptions {
+	return WordCloudOptions{
+		Width:     800,
+		Height:    600,
+		Palette:   "default",
+		MaxWords:  100,
+		Format:    WordCloudPNG,
+		StopWords: true,
+		Stemming:  true,
+	}
+}
+
+func (o WordCloudOptions) Validate() error {
+	if o.Width < 100 || o.Width > 4000 || o.Height < 100 || o.Height > 4000 {
+		return fmt.Errorf("word cloud size must be between 100 and 4000 pixels")
+	}
+	if _, exists := palettes[o.Palette]; !exists {
+		return fmt.Errorf("unknown palette %q", o.Palette)
+	}
+	if o.MaxWords < 1 || o.MaxWords > 500 {
+		return fmt.Errorf("max_words must be between 1 and 500")
+	}
+	if o.Format != WordCloudPNG && o.Format != WordCloudSVG {
+		return fmt.Errorf("unknown word cloud format %q", o.Format)
+	}
+	return nil
+}
+
+func (o WordCloudOptions) ContentType() string {
+	if o.Format == WordCloudSVG {
+		return "image/svg+xml"
+	}
+	return "image/png"
+}
+
+type palette struct {
+	Background color.RGBA
+	Colors     []color.RGBA
+}
+
+var palettes = map[string]palette{
+	"default": {
+		Background: rgb(0xffffff),
+		Colors:     []color.RGBA{rgb(0x1f77b4), rgb(0xff7f0e), rgb(0x2ca02c), rgb(0xd62728), rgb(0x9467bd), rgb(0x8c564b)},
+	},
+	"pastel": {
+		Background: rgb(0xfdfdf8),
+		Colors:     []color.RGBA{rgb(0x7aa6c2), rgb(0xe8a87c), rgb(0x85c7a2), rgb(0xd8839c), rgb(0xb39ddb)},
+	},
+	"dark": {
+		Background: rgb(0x1e1e24),
+		Colors:     []color.RGBA{rgb(0xf6c85f), rgb(0x6fb1e0), rgb(0x9dd866), rgb(0xff8c69), rgb(0xca472f)},
+	},
+	"mono": {
+		Background: rgb(0xffffff),
+		Colors:     []color.RGBA{rgb(0x0b3c5d), rgb(0x328cc1), rgb(0x1d2731), rgb(0x5e7f99)},
+	},
+}
+
+func rgb(v uint32) color.RGBA {
+	return color.RGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}
+}
+
+type placedWord struct {
+	Text     string
+	Size     float64
+	X        float64
+	Baseline float64
+	Box      image.Rectangle
+	Color    color.RGBA
+}
+
+// wordFont is the bundled Go Regular font. It covers Latin, Cyrillic and
+// Greek, so no system fonts are needed.
+var (
+	wordFont     *opentype.Font
+	wordFontErr  error
+	wordFontOnce sync.Once
+)
+
+// faceCache holds font faces by size for a single rendering. Faces are not
+// safe for concurrent use, so they are never shared between renderings.
+type faceCache map[int]font.Face
+
+func (c faceCache) face(size int) (font.Face, error) {
+	wordFontOnce.Do(func() {
+		wordFont, wordFontErr = opentype.Parse(goregular.TTF)
+	})
+	if wordFontErr != nil {
+		return nil, wordFontErr
+	}
+
+	if face, exists := c[size]; exists {
+		return face, nil
+	}
+
+	face, err := opentype.NewFace(wordFont, &opentype.FaceOptions{
+		Size:    float64(size),
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+	if err != nil {
+		return nil, err
+	}
+	c[size] = face
+	return face, nil
+}
+
+// cloudTerms returns the terms of the content to show in the word cloud.
+// With stemming every term is replaced by the most frequent form of its stem.
+func cloudTerms(content string, opts WordCloudOptions, profile string) []string {
+	text := NewTextProcessor(TextOptions{StopWords: opts.StopWords}, profile)
+	terms := text.Terms(content)
+	if !opts.Stemming {
+		return terms
+	}
+
+	forms := make(map[string]map[string]int)
+	stems := make([]string, len(terms))
+	for i, term := range terms {
+		stems[i] = Stem(term)
+		if forms[stems[i]] == nil {
+			forms[stems[i]] = make(map[string]int)
+		}
+		forms[stems[i]][term]++
+	}
+
+	display := make(map[string]string, len(forms))
+	for stem, counts := range forms {
+		best := ""
+		for form, count := range counts {
+			if best == "" || count > counts[best] || (count == counts[best] && form < best) {
+				best = form
+			}
+		}
+		display[stem] = best
+	}
+
+	for i, stem := range stems {
+		terms[i] = display[stem]
+	}
+	return terms
+}
+
+// countWords returns the most frequent terms, most frequent first. Ties are
+// broken alphabetically to keep the output stable.
+func countWords(terms []string, limit int) []TermFrequency {
+	return topFrequencies(termCounts(terms), limit)
+}
+
+// RenderWordCloud lays the terms out on an Archimedean spiral starting from
+// the center, largest first, skipping positions that collide with words
+// already placed, and encodes the result in the requested format.
+func RenderWordCloud(terms []string, opts WordCloudOptions) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	words := countWords(terms, opts.MaxWords)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("no words to render")
+	}
+
+	faces := make(faceCache)
+	placed, err := layoutWords(faces, words, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Format == WordCloudSVG {
+		return renderSVG(placed, opts), nil
+	}
+	return renderPNG(faces, placed, opts)
+}
+
+func layoutWords(faces faceCache, words []TermFrequency, opts WordCloudOptions) ([]placedWord, error) {
+	pal := palettes[opts.Palette]
+	bounds := image.Rect(0, 0, opts.Width, opts.Height)
+
+	maxCount := float64(words[0].Count)
+	minCount := float64(words[len(words)-1].Count)
+	largest := math.Min(maxFontSize, float64(opts.Height)/4)
+
+	var placed []placedWord
+	for i, w := range words {
+		size := largest
+		if maxCount > minCount {
+			weight := (float64(w.Count) - minCount) / (maxCount - minCount)
+			size = minFontSize + (largest-minFontSize)*math.Sqrt(weight)
+		}
+
+		for ; size >= minFontSize; size *= 0.8 {
+			word, ok, err := placeWord(faces, w.Term, size, bounds, placed)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				word.Color = pal.Colors[i%len(pal.Colors)]
+				placed = append(placed, word)
+				break
+			}
+		}
+	}
+	return placed, nil
+}
+
+func placeWord(faces faceCache, text string, size float64, bounds image.Rectangle, placed []placedWord) (placedWord, bool, error) {
+	face, err := faces.face(int(size))
+	if err != nil {
+		return placedWord{}, false, err
+	}
+
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil()
+	ascent := metrics.Ascent.Ceil()
+	height := ascent + metrics.Descent.Ceil()
+
+	centerX := float64(bounds.Dx()) / 2
+	centerY := float64(bounds.Dy()) / 2
+	ratio := float64(bounds.Dy()) / float64(bounds.Dx())
+	maxRadius := math.Hypot(centerX, centerY)
+
+	for t := 0.0; ; t += spiralStep {
+		r := spiralTurnGain * t
+		if r > maxRadius {
+			return placedWord{}, false, nil
+		}
+
+		x := int(centerX + r*math.Cos(t) - float64(width)/2)
+		y := int(centerY + r*ratio*math.Sin(t) - float64(height)/2)
+		box := image.Rect(x, y, x+width, y+height)
+		if !box.In(bounds) || collides(box, placed) {
+			continue
+		}
+
+		return placedWord{
+			Text:     text,
+			Size:     float64(int(size)),
+			X:        float64(x),
+			Baseline: float64(y + ascent),
+			Box:      box,
+		}, true, nil
+	}
+}
+
+func collides(box image.Rectangle, placed []placedWord) bool {
+	padded := box.Inset(-wordPadding)
+	for _, p := range placed {
+		if padded.Overlaps(p.Box) {
+			return true
+		}
+	}
+	return false
+}
+
+func renderPNG(faces faceCache, words []placedWord, opts WordCloudOptions) ([]byte, error) {
+	pal := palettes[opts.Palette]
+	img := image.NewRGBA(image.Rect(0, 0, opts.Width, opts.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(pal.Background), image.Point{}, draw.Src)
+
+	for _, w := range words {
+		face, err := faces.face(int(w.Size))
+		if err != nil {
+			return nil, err
+		}
+
+		d := font.Drawer{
+			Dst:  img,
+			Src:  image.NewUniform(w.Color),
+			Face: face,
+			Dot:  fixed.P(int(w.X), int(w.Baseline)),
+		}
+		d.DrawString(w.Text)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, fmt.Errorf("failed to encode PNG: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// renderSVG embeds the bundled font, so the text is drawn with the same
+// metrics that were used for the layout.
+func renderSVG(words []placedWord, opts WordCloudOptions) []byte {
+	pal := palettes[opts.Palette]
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`,
+		opts.Width, opts.Height, opts.Width, opts.Height)
+	fmt.Fprintf(&buf, `<style>@font-face{font-family:"Go";src:url(data:font/ttf;base64,%s)}text{font-family:"Go",sans-serif}</style>`,
+		base64.StdEncoding.EncodeToString(goregular.TTF))
+	fmt.Fprintf(&buf, `<rect width="100%%" height="100%%" fill="%s"/>`, hexColor(pal.Background))
+
+	for _, w := range words {
+		fmt.Fprintf(&buf, `<text x="%g" y="%g" font-size="%g" fill="%s">%s</text>`,
+			w.X, w.Baseline, w.Size, hexColor(w.Color), html.EscapeString(w.Text))
+	}
+
+	buf.WriteString(`</svg>`)
+	return buf.Bytes()
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestRenderWordCloud(t *testing.T) {
+	terms := Terms("анализ анализ анализ текста текста облако слов word cloud cloud привет мир")
+
+	t.Run("PNG of the requested size", func(t *testing.T) {
+		opts := DefaultWordCloudOptions()
+		opts.Width, opts.Height = 400, 300
+
+		data, err := RenderWordCloud(terms, opts)
+		if err != nil {
+			t.Fatalf("RenderWordCloud failed: %v", err)
+		}
+
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("output is not a PNG: %v", err)
+		}
+
+		if img.Bounds().Dx() != 400 || img.Bounds().Dy() != 300 {
+			t.Errorf("expected 400x300 image, got %v", img.Bounds())
+		}
+	})
+
+	t.Run("SVG with Cyrillic words", func(t *testing.T) {
+		opts := DefaultWordCloudOptions()
+		opts.Format = WordCloudSVG
+		opts.Palette = "dark"
+
+		data, err := RenderWordCloud(terms, opts)
+		if err != nil {
+			t.Fatalf("RenderWordCloud failed: %v", err)
+		}
+
+		svg := string(data)
+		for _, word := range []string{">анализ<", ">облако<", ">cloud<"} {
+			if !strings.Contains(svg, word) {
+				t.Errorf("SVG does not contain %s", word)
+			}
+		}
+		if !strings.Contains(svg, `fill="#1e1e24"`) {
+			t.Error("SVG does not use the palette background")
+		}
+	})
+
+	t.Run("Words do not overlap and respect the limit", func(t *testing.T) {
+		opts := DefaultWordCloudOptions()
+		opts.MaxWords = 5
+
+		faces := make(faceCache)
+		placed, err := layoutWords(faces, countWords(terms, opts.MaxWords), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(placed) != 5 {
+			t.Fatalf("expected 5 placed words, got %d", len(placed))
+		}
+
+		if placed[0].Text != "анализ" || placed[0].Size <= placed[len(placed)-1].Size {
+			t.Error("the most frequent word should be placed first with the largest font")
+		}
+
+		for i := range placed {
+			for j := i + 1; j < len(placed); j++ {
+				if placed[i].Box.Overlaps(placed[j].Box) {
+					t.Errorf("%q overlaps %q", placed[i].Text, placed[j].Text)
+				}
+			}
+		}
+	})
+
+	t.Run("No words", func(t *testing.T) {
+		if _, err := RenderWordCloud(nil, DefaultWordCloudOptions()); err == nil {
+			t.Error("expected error for empty input")
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Roles assigned by the gateway. Any identified caller may work with the
+// files it uploaded; teachers also see the files of their courses, and
+// only admins may see and delete everything.
+const (
+	roleTeacher = "teacher"
+	roleAdmin   = "admin"
+)
+
+// Headers with the roles and courses of the caller, set by the gateway next
+// to uploaderHeader.
+const (
+	rolesHeader   = "X-User-Roles"
+	coursesHeader = "X-User-Courses"
+)
+
+// serviceTokenHeader carries the token other services authenticate with.
+// The gateway never forwards it from clients.
+const serviceTokenHeader = "X-Service-Token"
+
+// serviceToken is the SERVICE_TOKEN shared by the services. Requests that
+// present it come from another service and are not restricted. Without a
+// token no request is.
+var serviceToken string
+
+// Principal is the caller a request was made for: a user or, if Service is
+// set, another service.
+type Principal struct {
+	UserID  string
+	Roles   []string
+	Courses []string
+	Service bool
+}
+
+// FileAccess restricts a listing to the files uploaded by UserID and the
+// files of Courses.
+type FileAccess struct {
+	UserID  string
+	Courses []string
+}
+
+// principalFrom returns the service that presented the service token or
+// the user identified by the gateway, and nil if the request has neither.
+func principalFrom(r *http.Request) *Principal {
+	if isServiceToken(r.Header.Get(serviceTokenHeader)) {
+		return &Principal{Service: true}
+	}
+	userID := r.Header.Get(uploaderHeader)
+	if userID == "" {
+		return nil
+	}
+	return &Principal{
+		UserID:  userID,
+		Roles:   splitList(r.Header.Get(rolesHeader)),
+		Courses: splitList(r.Header.Get(coursesHeader)),
+	}
+}
+
+func isServiceToken(token string) bool {
+	return serviceToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(serviceToken)) == 1
+}
+
+// requireIdentity rejects requests made neither for a user nor by a
+// service with 401.
+func requireIdentity(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if principalFrom(r) == nil {
+			http.Error(w, "Caller identity required", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Unrestricted reports whether the caller is an admin or another service.
+// An unidentified caller may do nothing.
+func (p *Principal) Unrestricted() bool {
+	return p != nil && (p.Service || slices.Contains(p.Roles, roleAdmin))
+}
+
+func (p *Principal) teaches(course string) bool {
+	return course != "" && slices.Contains(p.Roles, roleTeacher) && slices.Contains(p.Courses, course)
+}
+
+func (p *Principal) CanRead(file *FileMetadata) bool {
+	if p == nil {
+		return false
+	}
+	return p.Unrestricted() || file.Uploader == p.UserID || p.teaches(file.CourseID)
+}
+
+// CanUpload reports whether the caller may upload to the course. Files
+// without a course are visible to their uploader and admins only.
+func (p *Principal) CanUpload(course string) bool {
+	if p == nil {
+		return false
+	}
+	return p.Unrestricted() || course == "" || slices.Contains(p.Courses, course)
+}
+
+// Access returns the files the caller may list, nil for all of them.
+func (p *Principal) Access() *FileAccess {
+	if p.Unrestricted() {
+		return nil
+	}
+	access := &FileAccess{UserID: p.UserID}
+	if slices.Contains(p.Roles, roleTeacher) {
+		access.Courses = p.Courses
+	}
+	return access
+}
+
+// checkUpload rejects uploads to a course the caller is not enrolled in and
+// new versions of documents the caller cannot see.
+func (h *Handler) checkUpload(w http.ResponseWriter, p *Principal, courseID, documentID string) bool {
+	if courseID != "" && !validDocumentID(courseID) {
+		http.Error(w, "Invalid course_id", http.StatusBadRequest)
+		return false
+	}
+	if !p.CanUpload(courseID) {
+		http.Error(w, "Not enrolled in course "+courseID, http.StatusForbidden)
+		return false
+	}
+	if documentID == "" || p.Unrestricted() {
+		return true
+	}
+	latest, err := h.repo.GetVersion(documentID, 0)
+	if err != nil {
+		http.Error(w, "Failed to get document", http.StatusInternalServerError)
+		return false
+	}
+	if latest != nil && !p.CanRead(latest) {
+		http.Error(w, "Access to the document denied", http.StatusForbidden)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func init() {
+	serviceToken = "test-service-token"
+}
+
+// internal marks a request as made by another service.
+func internal(req *http.Request) *http.Request {
+	req.Header.Set(serviceTokenHeader, serviceToken)
+	return req
+}
+
+// as marks a request as made by a user identified by the gateway.
+func as(req *http.Request, userID, roles, courses string) *http.Request {
+	req.Header.Del(serviceTokenHeader)
+	req.Header.Set(uploaderHeader, userID)
+	req.Header.Set(rolesHeader, roles)
+	req.Header.Set(coursesHeader, courses)
+	return req
+}
+
+func TestAccessControl(t *testing.T) {
+	mockRepo := &MockRepository{Files: map[string]FileMetadata{
+		"alice-essay": {ID: "alice-essay", DocumentID: "alice-essay", Version: 1, Name: "alice.txt", Location: "a", TextLocation: "a", Uploader: "alice", CourseID: "cs101"},
+		"bob-essay":   {ID: "bob-essay", DocumentID: "bob-essay", Version: 1, Name: "bob.txt", Location: "b", TextLocation: "b", Uploader: "bob", CourseID: "math"},
+	}}
+	blobs := NewMockBlobStore()
+	blobs.Blobs["a"] = []byte("Alice's essay")
+	blobs.Blobs["b"] = []byte("Bob's essay")
+	handler := NewHandler(mockRepo, blobs, 1024)
+
+	get := func(req *http.Request) int {
+		rr := httptest.NewRecorder()
+		handler.File(rr, req)
+		return rr.Code
+	}
+
+	tests := []struct {
+		name     string
+		userID   string
+		roles    string
+		courses  string
+		path     string
+		expected int
+	}{
+		{"Student reads own file", "alice", "student", "cs101", "/files/alice-essay", http.StatusOK},
+		{"Student reads own content", "alice", "student", "cs101", "/files/alice-essay/content", http.StatusOK},
+		{"Student reads classmate's file", "bob", "student", "cs101", "/files/alice-essay", http.StatusForbidden},
+		{"Student reads classmate's text", "bob", "student", "cs101", "/files/alice-essay/text", http.StatusForbidden},
+		{"Teacher reads file of own course", "carol", "teacher", "cs101", "/files/alice-essay/content", http.StatusOK},
+		{"Teacher reads file of other course", "carol", "teacher", "cs101", "/files/bob-essay", http.StatusForbidden},
+		{"Student of course is not a teacher", "dave", "student", "cs101,math", "/files/bob-essay", http.StatusForbidden},
+		{"Admin reads any file", "root", "admin", "", "/files/bob-essay/text", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := as(httptest.NewRequest("GET", tt.path, nil), tt.userID, tt.roles, tt.courses)
+			if code := get(req); code != tt.expected {
+				t.Errorf("expected status %d, got %d", tt.expected, code)
+			}
+		})
+	}
+
+	t.Run("Internal calls are not restricted", func(t *testing.T) {
+		if code := get(internal(httptest.NewRequest("GET", "/files/bob-essay/text", nil))); code != http.StatusOK {
+			t.Errorf("expected status 200, got %d", code)
+		}
+	})
+
+	t.Run("Unidentified calls are rejected", func(t *testing.T) {
+		forged := httptest.NewRequest("GET", "/files/bob-essay/text", nil)
+		forged.Header.Set(serviceTokenHeader, "guess")
+		for _, req := range []*http.Request{httptest.NewRequest("GET", "/files/bob-essay/text", nil), forged} {
+			if code := get(req); code != http.StatusForbidden {
+				t.Errorf("expected status 403, got %d", code)
+			}
+			rr := httptest.NewRecorder()
+			requireIdentity(handler.File)(rr, req)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("expected status 401, got %d", rr.Code)
+			}
+		}
+	})
+
+	t.Run("Listing shows visible files only", func(t *testing.T) {
+		for _, tt := range []struct {
+			userID, roles, courses string
+			expected               int
+		}{
+			{"alice", "student", "cs101", 1},
+			{"carol", "teacher", "cs101,math", 2},
+			{"eve", "student", "cs101,math", 0},
+			{"root", "admin", "", 2},
+		} {
+			rr := httptest.NewRecorder()
+			handler.Files(rr, as(httptest.NewRequest("GET", "/files", nil), tt.userID, tt.roles, tt.courses))
+			var response FileListResponse
+			json.NewDecoder(rr.Body).Decode(&response)
+			if len(response.Files) != tt.expected {
+				t.Errorf("%s: expected %d files, got %d", tt.userID, tt.expected, len(response.Files))
+			}
+		}
+	})
+
+	t.Run("Only admins delete", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.File(rr, as(httptest.NewRequest("DELETE", "/files/alice-essay", nil), "carol", "teacher", "cs101"))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("teacher: expected status 403, got %d", rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		handler.File(rr, as(httptest.NewRequest("DELETE", "/files/alice-essay", nil), "root", "admin", ""))
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("admin: expected status 204, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Document history", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.Document(rr, as(httptest.NewRequest("GET", "/documents/bob-essay/latest", nil), "alice", "student", ""))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Upload", func(t *testing.T) {
+		upload := func(userID, roles, courses string, fields map[string]string, content string) *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			handler.Files(rr, as(uploadFormRequest(fields, "essay.txt", content), userID, roles, courses))
+			return rr
+		}
+
+		if rr := upload("alice", "student", "cs101", map[string]string{"course_id": "math"}, "New essay"); rr.Code != http.StatusForbidden {
+			t.Errorf("course not enrolled in: expected status 403, got %d", rr.Code)
+		}
+		if rr := upload("alice", "student", "", map[string]string{"document_id": "bob-essay"}, "Bob's essay, v2"); rr.Code != http.StatusForbidden {
+			t.Errorf("version of another's document: expected status 403, got %d", rr.Code)
+		}
+
+		rr := upload("alice", "student", "cs101", map[string]string{"course_id": "cs101"}, "New essay")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d: %s", rr.Code, rr.Body.String())
+		}
+		var response UploadResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		if file := mockRepo.Files[response.ID]; file.CourseID != "cs101" || file.Uploader != "alice" {
+			t.Errorf("unexpected file %+v", file)
+		}
+
+		// A copy is stored for its uploader, so it is checked for plagiarism,
+		// and the response does not show that the content was known.
+		rr = upload("bob", "student", "cs101", nil, "New essay")
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("copy of another's file: expected status 201, got %d", rr.Code)
+		}
+		var copied UploadResponse
+		json.NewDecoder(rr.Body).Decode(&copied)
+		original, duplicate := mockRepo.Files[response.ID], mockRepo.Files[copied.ID]
+		if duplicate.ID == original.ID || duplicate.Uploader != "bob" || duplicate.Location != original.Location {
+			t.Errorf("expected bob's own file sharing the blob, got %+v", duplicate)
+		}
+		if rr := upload("alice", "student", "cs101", nil, "New essay"); rr.Code != http.StatusOK {
+			t.Errorf("own duplicate: expected status 200, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Resumable upload belongs to its uploader", func(t *testing.T) {
+		req := tusRequest("POST", "/uploads", "")
+		req.Header.Set("Upload-Length", "5")
+		req.Header.Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("a.txt")))
+		rr := httptest.NewRecorder()
+		handler.Uploads(rr, as(req, "alice", "student", ""))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d", rr.Code)
+		}
+
+		location := rr.Header().Get("Location")
+
+		rr = httptest.NewRecorder()
+		handler.Upload(rr, as(tusRequest("HEAD", location, ""), "bob", "student", ""))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status 403, got %d", rr.Code)
+		}
+	})
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ErrBlobNotFound is returned by BlobStore.Get for unknown keys.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps file contents by key. The key is the location stored in
+// file_metadata, which holds nothing but this pointer.
+type BlobStore interface {
+	Put(key string, r io.Reader) error
+	Get(key string) (io.ReadCloser, error)
+	Delete(key string) error
+	// Move renames a blob, replacing any blob stored under the new key.
+	Move(from, to string) error
+	Keys() ([]string, error)
+}
+
+// NewBlobStore returns the backend named by kind: "postgres", "fs" or "s3".
+// The filesystem and S3 backends are configured from the environment.
+func NewBlobStore(kind string, db *sql.DB) (BlobStore, error) {
+	switch kind {
+	case "", "postgres":
+		return NewPostgresBlobStore(db)
+	case "fs":
+		return NewFSBlobStore(getEnv("BLOB_DIR", "/data/blobs"))
+	case "s3":
+		return NewS3BlobStore(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Bucket:    getEnv("S3_BUCKET", "files"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Region:    os.Getenv("S3_REGION"),
+			UseSSL:    os.Getenv("S3_USE_SSL") == "true",
+		})
+	}
+	return nil, fmt.Errorf("unknown blob store %q", kind)
+}
+
+func getEnv(key, defaultValue string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return defaultValue
+}
+
+// postgresChunkSize is the size of the parts PostgresBlobStore splits
+// contents into, and so the most of a content it holds in memory.
+const postgresChunkSize = 1 << 20
+
+// PostgresBlobStore keeps contents in the database, split into parts of
+// postgresChunkSize bytes in the file_content_chunks table. Contents are
+// streamed in and out a part at a time. Rows of the file_content table,
+// where contents were kept whole before, are still read, moved and deleted.
+type PostgresBlobStore struct {
+	db *sql.DB
+}
+
+func NewPostgresBlobStore(db *sql.DB) (*PostgresBlobStore, error) {
+	for _, statement := range []string{
+		`CREATE TABLE IF NOT EXISTS file_content (
+			location TEXT PRIMARY KEY,
+			content TEXT NOT NULL
+		)`,
+		"ALTER TABLE file_content ADD COLUMN IF NOT EXISTS data BYTEA",
+		"ALTER TABLE file_content ALTER COLUMN content DROP NOT NULL",
+		`CREATE TABLE IF NOT EXISTS file_content_chunks (
+			location TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			data BYTEA NOT NULL,
+			PRIMARY KEY (location, seq)
+		)`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			return nil, err
+		}
+	}
+	return &PostgresBlobStore{db: db}, nil
+}
+
+// Put writes all parts in one transaction, so a replaced content is never
+// seen half written. An empty content is stored as a single empty part.
+func (s *PostgresBlobStore) Put(key string, r io.Reader) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteContent(tx, key); err != nil {
+		return err
+	}
+	buf := make([]byte, postgresChunkSize)
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		if n > 0 || seq == 0 {
+			if _, err := tx.Exec(
+				"INSERT INTO file_content_chunks (location, seq, data) VALUES ($1, $2, $3)",
+				key, seq, buf[:n],
+			); err != nil {
+				return err
+			}
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return tx.Commit()
+}
+
+func deleteContent(tx *sql.Tx, key string) error {
+	if _, err := tx.Exec("DELETE FROM file_content_chunks WHERE location = $1", key); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM file_content WHERE location = $1", key)
+	return err
+}
+
+// Get returns a reader that fetches the parts one by one. Rows written to
+// file_content before contents were split are read whole.
+func (s *PostgresBlobStore) Get(key string) (io.ReadCloser, error) {
+	var first []byte
+	err := s.db.QueryRow(
+		"SELECT data FROM file_content_chunks WHERE location = $1 AND seq = 0", key,
+	).Scan(&first)
+	if err == nil {
+		return io.NopCloser(&postgresChunkReader{db: s.db, key: key, seq: 0, chunk: first}), nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	var (
+		data    []byte
+		content sql.NullString
+	)
+	err = s.db.QueryRow("SELECT data, content FROM file_content WHERE location = $1", key).Scan(&data, &content)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		data = []byte(content.String)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// postgresChunkReader reads a content part by part, holding one part.
+type postgresChunkReader struct {
+	db    *sql.DB
+	key   string
+	seq   int
+	chunk []byte
+	done  bool
+}
+
+func (r *postgresChunkReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		r.seq++
+		err := r.db.QueryRow(
+			"SELECT data FROM file_content_chunks WHERE location = $1 AND seq = $2", r.key, r.seq,
+		).Scan(&r.chunk)
+		if err == sql.ErrNoRows {
+			r.done = true
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (s *PostgresBlobStore) Delete(key string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteContent(tx, key); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresBlobStore) Move(from, to string) error {
+	if from == to {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteContent(tx, to); err != nil {
+		return err
+	}
+	moved := int64(0)
+	for _, table := range []string{"file_content_chunks", "file_content"} {
+		result, err := tx.Exec("UPDATE "+table+" SET location = $2 WHERE location = $1", from, to)
+		if err != nil {
+			return err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		moved += rows
+	}
+	if moved == 0 {
+		return ErrBlobNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *PostgresBlobStore) Keys() ([]string, error) {
+	rows, err := s.db.Query(`
+		SELECT location FROM file_content_chunks WHERE seq = 0
+		UNION
+		SELECT location FROM file_content`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// FSBlobStore keeps every blob in its own file under root. Files are written
+// to a temporary name first, so readers never see a partial blob.
+type FSBlobStore struct {
+	root string
+}
+
+func NewFSBlobStore(root string) (*FSBlobStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &FSBlobStore{root: root}, nil
+}
+
+// path maps the key to a file inside root and rejects keys that would
+// escape it.
+func (s *FSBlobStore) path(key string) (string, error) {
+	if key == "" || !filepath.IsLocal(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.root, key), nil
+}
+
+func (s *FSBlobStore) Put(key string, r io.Reader) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *FSBlobStore) Get(key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	return file, err
+}
+
+func (s *FSBlobStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *FSBlobStore) Move(from, to string) error {
+	fromPath, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	toPath, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), 0o755); err != nil {
+		return err
+	}
+	if err := os.Rename(fromPath, toPath); errors.Is(err, os.ErrNotExist) {
+		return ErrBlobNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *FSBlobStore) Keys() ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(s.root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), ".upload-") {
+			return nil
+		}
+		key, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(key))
+		return nil
+	})
+	return keys, err
+}
+
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Region    string
+	UseSSL    bool
+}
+
+// S3BlobStore keeps blobs in a bucket of an S3-compatible service such as
+// MinIO. The bucket is created if it does not exist.
+type S3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+func NewS3BlobStore(cfg S3Config) (*S3BlobStore, error) {
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("S3 endpoint is not configured")
+	}
+
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket: %v", err)
+	}
+	if !exists {
+		err := client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, fmt.Errorf("failed to create bucket: %v", err)
+		}
+	}
+
+	return &S3BlobStore{client: client, bucket: cfg.Bucket}, nil
+}
+
+// Put streams r to S3 as a multipart upload, since the size is not known in
+// advance.
+func (s *S3BlobStore) Put(key string, r io.Reader) error {
+	_, err := s.client.PutObject(context.Background(), s.bucket, key, r, -1, minio.PutObjectOptions{})
+	return err
+}
+
+func (s *S3BlobStore) Get(key string) (io.ReadCloser, error) {
+	ctx := context.Background()
+	if _, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{}); err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrBlobNotFound
+		}
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+}
+
+func (s *S3BlobStore) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+// Move copies the object on the server side and removes the original, since
+// S3 cannot rename objects.
+func (s *S3BlobStore) Move(from, to string) error {
+	ctx := context.Background()
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: to},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: from},
+	)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return ErrBlobNotFound
+		}
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, from, minio.RemoveObjectOptions{})
+}
+
+func (s *S3BlobStore) Keys() ([]string, error) {
+	var keys []string
+	for object := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return nil, object.Err
+		}
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+// MigrateBlobs copies every blob from one store to another. Blobs that are
+// already present in the target are copied again, so an interrupted
+// migration can simply be restarted. With deleteSource the blobs are removed
+// from the source once they have been copied.
+func MigrateBlobs(from, to BlobStore, deleteSource bool) (int, error) {
+	keys, err := from.Keys()
+	if err != nil {
+		return 0, fmt.Errorf("failed to list blobs: %v", err)
+	}
+
+	for i, key := range keys {
+		blob, err := from.Get(key)
+		if err != nil {
+			return i, fmt.Errorf("failed to read %s: %v", key, err)
+		}
+		err = to.Put(key, blob)
+		blob.Close()
+		if err != nil {
+			return i, fmt.Errorf("failed to write %s: %v", key, err)
+		}
+		if deleteSource {
+			if err := from.Delete(key); err != nil {
+				return i + 1, fmt.Errorf("failed to delete %s from source: %v", key, err)
+			}
+		}
+	}
+
+	return len(keys), nil
+}
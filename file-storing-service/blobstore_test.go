@@ -0,0 +1,169 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testBlobStore(t *testing.T, store BlobStore) {
+	if err := store.Put("essay.txt", strings.NewReader("first")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Put("essay.txt", strings.NewReader("second")); err != nil {
+		t.Fatalf("overwriting Put failed: %v", err)
+	}
+
+	blob, err := store.Get("essay.txt")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(data) != "second" {
+		t.Errorf("expected %q, got %q", "second", data)
+	}
+
+	keys, err := store.Keys()
+	if err != nil || len(keys) != 1 || keys[0] != "essay.txt" {
+		t.Errorf("expected one key, got %v (%v)", keys, err)
+	}
+
+	if err := store.Put("moved/essay.txt", strings.NewReader("replaced")); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if err := store.Move("essay.txt", "moved/essay.txt"); err != nil {
+		t.Fatalf("Move failed: %v", err)
+	}
+	if _, err := store.Get("essay.txt"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("expected ErrBlobNotFound after move, got %v", err)
+	}
+	blob, err = store.Get("moved/essay.txt")
+	if err != nil {
+		t.Fatalf("Get after move failed: %v", err)
+	}
+	data, _ = io.ReadAll(blob)
+	blob.Close()
+	if string(data) != "second" {
+		t.Errorf("expected %q after move, got %q", "second", data)
+	}
+	if err := store.Move("essay.txt", "other.txt"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("expected ErrBlobNotFound when moving a missing blob, got %v", err)
+	}
+
+	if err := store.Delete("moved/essay.txt"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Get("moved/essay.txt"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("expected ErrBlobNotFound after delete, got %v", err)
+	}
+}
+
+func TestFSBlobStore(t *testing.T) {
+	store, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBlobStore(t, store)
+
+	t.Run("Keys outside the root are rejected", func(t *testing.T) {
+		for _, key := range []string{"../escape.txt", "/etc/passwd", ""} {
+			if err := store.Put(key, strings.NewReader("x")); err == nil {
+				t.Errorf("expected error for key %q", key)
+			}
+		}
+	})
+}
+
+func TestS3BlobStore(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT is not set, start MinIO to run this test")
+	}
+
+	store, err := NewS3BlobStore(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "blobstore-test",
+		AccessKey: getEnv("S3_TEST_ACCESS_KEY", "minioadmin"),
+		SecretKey: getEnv("S3_TEST_SECRET_KEY", "minioadmin"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBlobStore(t, store)
+}
+
+// TestPostgresBlobStore drops the blob tables of the database it is given.
+func TestPostgresBlobStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_TEST_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_TEST_DSN is not set, give a scratch database to run this test")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec("DROP TABLE IF EXISTS file_content, file_content_chunks"); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewPostgresBlobStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBlobStore(t, store)
+
+	t.Run("Contents larger than a chunk", func(t *testing.T) {
+		content := strings.Repeat("0123456789", postgresChunkSize/4)
+		for _, data := range []string{content, ""} {
+			if err := store.Put("large.txt", strings.NewReader(data)); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			blob, err := store.Get("large.txt")
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			read, _ := io.ReadAll(blob)
+			blob.Close()
+			if string(read) != data {
+				t.Errorf("expected %d bytes, got %d", len(data), len(read))
+			}
+		}
+	})
+}
+
+func TestMigrateBlobs(t *testing.T) {
+	source := NewMockBlobStore()
+	source.Put("a.txt", strings.NewReader("A"))
+	source.Put("b.txt", strings.NewReader("B"))
+
+	target, err := NewFSBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := MigrateBlobs(source, target, true)
+	if err != nil {
+		t.Fatalf("MigrateBlobs failed: %v", err)
+	}
+	if moved != 2 {
+		t.Errorf("expected 2 migrated blobs, got %d", moved)
+	}
+
+	keys, _ := target.Keys()
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "a.txt,b.txt" {
+		t.Errorf("unexpected keys in target: %v", keys)
+	}
+	if len(source.Blobs) != 0 {
+		t.Errorf("expected source to be emptied, %d blobs left", len(source.Blobs))
+	}
+}
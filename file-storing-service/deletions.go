@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	deletionLease        = time.Minute
+	deletionPollInterval = time.Second
+	deletionBaseDelay    = 5 * time.Second
+	deletionMaxDelay     = 10 * time.Minute
+)
+
+// Deletion is a deleted file whose blob or analyses may still have to be
+// removed. Deletions are kept in the file_deletions table until both steps
+// have succeeded, so the cleanup survives restarts and outages of the
+// analysis service.
+type Deletion struct {
+	FileID       string
+	Location     string
+	TextLocation string
+	BlobDeleted  bool
+	Attempts     int
+}
+
+// AnalysisNotifier tells the analysis service to purge a deleted file.
+type AnalysisNotifier interface {
+	PurgeFile(fileID string) error
+}
+
+type httpAnalysisNotifier struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// NewAnalysisNotifier returns a notifier that authenticates with the
+// service token, since purging is not allowed to users.
+func NewAnalysisNotifier(url, token string) AnalysisNotifier {
+	return &httpAnalysisNotifier{url: url, token: token, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (n *httpAnalysisNotifier) PurgeFile(fileID string) error {
+	req, err := http.NewRequest(http.MethodDelete, n.url+"/files/"+fileID, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(serviceTokenHeader, n.token)
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("analysis service responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// DeletionWorker finishes deletions: it removes the blob and then has the
+// analysis service purge the file, retrying with a growing delay.
+type DeletionWorker struct {
+	repo     Repository
+	blobs    BlobStore
+	analysis AnalysisNotifier
+}
+
+func NewDeletionWorker(repo Repository, blobs BlobStore, analysis AnalysisNotifier) *DeletionWorker {
+	return &DeletionWorker{repo: repo, blobs: blobs, analysis: analysis}
+}
+
+func (w *DeletionWorker) Run(ctx context.Context) {
+	for {
+		processed, err := w.ProcessNext()
+		if err != nil {
+			log.Printf("Deletion worker: %v", err)
+		}
+		if processed {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(deletionPollInterval):
+		}
+	}
+}
+
+// ProcessNext handles one pending deletion and reports whether there was one.
+func (w *DeletionWorker) ProcessNext() (bool, error) {
+	deletion, err := w.repo.ClaimDeletion(deletionLease)
+	if err != nil {
+		return false, fmt.Errorf("failed to claim deletion: %v", err)
+	}
+	if deletion == nil {
+		return false, nil
+	}
+
+	if err := w.cleanUp(deletion); err != nil {
+		runAt := time.Now().Add(deletionDelay(deletion.Attempts))
+		return true, w.repo.RetryDeletion(deletion.FileID, err.Error(), runAt)
+	}
+	return true, w.repo.CompleteDeletion(deletion.FileID)
+}
+
+// cleanUp keeps the blobs if the same content has been uploaded again since
+// the file was deleted, because locations are derived from the content. The
+// check and the deletion run under the lock on the location, so an upload
+// of the same content cannot commit in between.
+func (w *DeletionWorker) cleanUp(deletion *Deletion) error {
+	if !deletion.BlobDeleted {
+		err := w.repo.LockLocation(deletion.Location, func() error {
+			inUse, err := w.repo.LocationInUse(deletion.Location)
+			if err != nil {
+				return fmt.Errorf("failed to check blob usage: %v", err)
+			}
+			if inUse {
+				return nil
+			}
+			if err := w.blobs.Delete(deletion.Location); err != nil {
+				return fmt.Errorf("failed to delete blob: %v", err)
+			}
+			if deletion.TextLocation != "" && deletion.TextLocation != deletion.Location {
+				if err := w.blobs.Delete(deletion.TextLocation); err != nil {
+					return fmt.Errorf("failed to delete extracted text: %v", err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := w.repo.MarkBlobDeleted(deletion.FileID); err != nil {
+			return err
+		}
+	}
+
+	if err := w.analysis.PurgeFile(deletion.FileID); err != nil {
+		return fmt.Errorf("failed to purge analyses: %v", err)
+	}
+	return nil
+}
+
+func deletionDelay(attempt int) time.Duration {
+	delay := deletionBaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if delay >= deletionMaxDelay {
+			return deletionMaxDelay
+		}
+	}
+	return delay
+}
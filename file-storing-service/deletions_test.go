@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type mockNotifier struct {
+	Down   bool
+	Purged []string
+}
+
+func (n *mockNotifier) PurgeFile(fileID string) error {
+	if n.Down {
+		return errors.New("connection refused")
+	}
+	n.Purged = append(n.Purged, fileID)
+	return nil
+}
+
+func TestDeleteFile(t *testing.T) {
+	mockRepo := &MockRepository{Files: map[string]FileMetadata{
+		"file1": {ID: "file1", Name: "essay.txt", Location: "essay.txt"},
+	}}
+	blobs := NewMockBlobStore()
+	blobs.Put("essay.txt", strings.NewReader("content"))
+	notifier := &mockNotifier{Down: true}
+
+	handler := NewHandler(mockRepo, blobs, 1024)
+	worker := NewDeletionWorker(mockRepo, blobs, notifier)
+
+	rr := httptest.NewRecorder()
+	handler.File(rr, internal(httptest.NewRequest("DELETE", "/files/file1", nil)))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+	if _, exists := mockRepo.Files["file1"]; exists {
+		t.Error("metadata was not deleted")
+	}
+
+	t.Run("Analysis service is down", func(t *testing.T) {
+		if processed, err := worker.ProcessNext(); !processed || err != nil {
+			t.Fatalf("expected the deletion to be processed, got %v, %v", processed, err)
+		}
+		if _, exists := blobs.Blobs["essay.txt"]; exists {
+			t.Error("blob was not deleted")
+		}
+		d := mockRepo.Deletions["file1"]
+		if d == nil || !d.BlobDeleted {
+			t.Fatal("deletion should stay pending with the blob marked as deleted")
+		}
+		if !mockRepo.RunAt["file1"].After(time.Now()) {
+			t.Error("retry should be scheduled in the future")
+		}
+	})
+
+	t.Run("Retry succeeds", func(t *testing.T) {
+		notifier.Down = false
+		mockRepo.RunAt["file1"] = time.Now()
+
+		if _, err := worker.ProcessNext(); err != nil {
+			t.Fatal(err)
+		}
+		if len(notifier.Purged) != 1 || notifier.Purged[0] != "file1" {
+			t.Errorf("expected the analysis service to purge file1, got %v", notifier.Purged)
+		}
+		if len(mockRepo.Deletions) != 0 {
+			t.Error("deletion should be completed")
+		}
+	})
+
+	t.Run("Unknown file", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.File(rr, internal(httptest.NewRequest("DELETE", "/files/file1", nil)))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func TestDeletionDelay(t *testing.T) {
+	if deletionDelay(1) != deletionBaseDelay || deletionDelay(2) != 2*deletionBaseDelay {
+		t.Error("delay should double with every attempt")
+	}
+	if deletionDelay(100) != deletionMaxDelay {
+		t.Error("delay should be capped")
+	}
+}
+
+// lockCheckingBlobs fails the test when a stored blob is moved or deleted
+// without the lock on its location.
+type lockCheckingBlobs struct {
+	*MockBlobStore
+	t    *testing.T
+	repo *MockRepository
+}
+
+func (b lockCheckingBlobs) check(key string) {
+	if !strings.HasPrefix(key, "tmp/") && (b.repo.Locked == "" || !strings.HasPrefix(key, b.repo.Locked)) {
+		b.t.Errorf("%s changed without the lock", key)
+	}
+}
+
+func (b lockCheckingBlobs) Delete(key string) error {
+	b.check(key)
+	return b.MockBlobStore.Delete(key)
+}
+
+func (b lockCheckingBlobs) Move(from, to string) error {
+	b.check(to)
+	return b.MockBlobStore.Move(from, to)
+}
+
+func TestDeletionKeepsReuploadedContent(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := lockCheckingBlobs{NewMockBlobStore(), t, mockRepo}
+	handler := NewHandler(mockRepo, blobs, 1024)
+	worker := NewDeletionWorker(mockRepo, blobs, &mockNotifier{})
+
+	upload := func() string {
+		rr := httptest.NewRecorder()
+		handler.UploadFile(rr, uploadRequest("essay.txt", "same content"))
+		var response UploadResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		return response.ID
+	}
+
+	first := upload()
+	location := mockRepo.Files[first].Location
+	handler.File(httptest.NewRecorder(), internal(httptest.NewRequest("DELETE", "/files/"+first, nil)))
+	second := upload()
+
+	if _, err := worker.ProcessNext(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := blobs.Blobs[location]; !exists {
+		t.Error("blob of the uploaded file was deleted")
+	}
+
+	handler.File(httptest.NewRecorder(), internal(httptest.NewRequest("DELETE", "/files/"+second, nil)))
+	if _, err := worker.ProcessNext(); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := blobs.Blobs[location]; exists {
+		t.Error("blob of the deleted file was kept")
+	}
+}
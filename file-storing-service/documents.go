@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var documentIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+func validDocumentID(id string) bool {
+	return documentIDPattern.MatchString(id)
+}
+
+type VersionListResponse struct {
+	DocumentID string         `json:"document_id"`
+	Versions   []FileMetadata `json:"versions"`
+}
+
+// Document serves the version history of a document:
+//
+//	GET /documents/{id}/versions      all versions, oldest first
+//	GET /documents/{id}/versions/{n}  version n
+//	GET /documents/{id}/latest        the latest version
+//
+// Versions the caller may not see are left out of the history.
+func (h *Handler) Document(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/documents/"), "/")
+	if parts[0] == "" {
+		http.Error(w, "Document ID is required", http.StatusBadRequest)
+		return
+	}
+	documentID := parts[0]
+	principal := principalFrom(r)
+
+	switch {
+	case len(parts) == 2 && parts[1] == "versions":
+		h.listVersions(w, principal, documentID)
+	case len(parts) == 3 && parts[1] == "versions":
+		version, err := strconv.Atoi(parts[2])
+		if err != nil || version < 1 {
+			http.Error(w, "Version must be a positive number", http.StatusBadRequest)
+			return
+		}
+		h.getVersion(w, principal, documentID, version)
+	case len(parts) == 2 && parts[1] == "latest":
+		h.getVersion(w, principal, documentID, 0)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *Handler) listVersions(w http.ResponseWriter, principal *Principal, documentID string) {
+	versions, err := h.repo.ListVersions(documentID)
+	if err != nil {
+		http.Error(w, "Failed to list versions", http.StatusInternalServerError)
+		return
+	}
+	if len(versions) == 0 {
+		http.Error(w, "Document not found", http.StatusNotFound)
+		return
+	}
+	visible := versions[:0]
+	for _, file := range versions {
+		if principal.CanRead(&file) {
+			visible = append(visible, file)
+		}
+	}
+	if len(visible) == 0 {
+		http.Error(w, "Access to the document denied", http.StatusForbidden)
+		return
+	}
+	versions = visible
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(VersionListResponse{DocumentID: documentID, Versions: versions})
+}
+
+func (h *Handler) getVersion(w http.ResponseWriter, principal *Principal, documentID string, version int) {
+	file, err := h.repo.GetVersion(documentID, version)
+	if err != nil {
+		http.Error(w, "Failed to get version", http.StatusInternalServerError)
+		return
+	}
+	if file == nil {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return
+	}
+	if !principal.CanRead(file) {
+		http.Error(w, "Access to the file denied", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(file)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// encodingSampleSize is how many leading bytes DetectEncoding looks at.
+const encodingSampleSize = 64 << 10
+
+var errUnknownCharset = errors.New("unknown charset")
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// singleByteEncodings are the legacy encodings a text that is not UTF-8 is
+// checked against, preferred in this order on a tie.
+var singleByteEncodings = []struct {
+	name    string
+	charmap *charmap.Charmap
+}{
+	{"windows-1251", charmap.Windows1251},
+	{"koi8-r", charmap.KOI8R},
+	{"ibm866", charmap.CodePage866},
+	{"windows-1252", charmap.Windows1252},
+}
+
+var metaCharsetPattern = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?([\w.:-]+)`)
+
+func isTextMimeType(mimeType string) bool {
+	return mimeType == mimeText || mimeType == mimeMarkdown || mimeType == mimeHTML
+}
+
+// lookupCharset resolves a charset label such as "cp1251" or "KOI8-R" to an
+// encoding and its canonical name.
+func lookupCharset(label string) (encoding.Encoding, string, error) {
+	enc, err := htmlindex.Get(strings.TrimSpace(label))
+	if err != nil || enc == encoding.Replacement {
+		return nil, "", errUnknownCharset
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		return nil, "", errUnknownCharset
+	}
+	return enc, name, nil
+}
+
+// DetectEncoding determines the encoding of a text from its first bytes. A
+// byte order mark wins over everything, then comes the charset given by the
+// uploader, UTF-16 without a byte order mark, UTF-8 and the charset an HTML
+// page declares. Anything else is taken for the single-byte encoding under
+// which the text looks most like words.
+func DetectEncoding(sample []byte, mimeType, charset string) (encoding.Encoding, string, error) {
+	switch {
+	case bytes.HasPrefix(sample, utf8BOM):
+		return xunicode.UTF8, "utf-8", nil
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM), "utf-16le", nil
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM), "utf-16be", nil
+	}
+
+	if charset != "" {
+		return lookupCharset(charset)
+	}
+
+	if order, ok := utf16Order(sample); ok {
+		if order == xunicode.BigEndian {
+			return xunicode.UTF16(xunicode.BigEndian, xunicode.IgnoreBOM), "utf-16be", nil
+		}
+		return xunicode.UTF16(xunicode.LittleEndian, xunicode.IgnoreBOM), "utf-16le", nil
+	}
+
+	if validUTF8(sample) {
+		return xunicode.UTF8, "utf-8", nil
+	}
+
+	if mimeType == mimeHTML {
+		// A page that declares UTF-8 or UTF-16 but is neither is guessed.
+		if match := metaCharsetPattern.FindSubmatch(sample); match != nil {
+			enc, name, err := lookupCharset(string(match[1]))
+			if err == nil && name != "utf-8" && !strings.HasPrefix(name, "utf-16") {
+				return enc, name, nil
+			}
+		}
+	}
+
+	best, bestScore := 0, 0
+	for i, candidate := range singleByteEncodings {
+		if score := letterScore(sample, candidate.charmap); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return singleByteEncodings[best].charmap, singleByteEncodings[best].name, nil
+}
+
+// utf16Order recognizes UTF-16 without a byte order mark: in text written in
+// a single alphabet nearly every code unit has a high byte of 0x00 (Latin)
+// or 0x04 (Cyrillic) and a low byte that is not.
+func utf16Order(sample []byte) (xunicode.Endianness, bool) {
+	units := len(sample) / 2
+	if units < 2 {
+		return false, false
+	}
+	var little, big int
+	for i := 0; i+1 < len(sample); i += 2 {
+		switch {
+		case sample[i+1] <= 0x04 && sample[i] > 0x04:
+			little++
+		case sample[i] <= 0x04 && sample[i+1] > 0x04:
+			big++
+		}
+	}
+	switch {
+	case little*10 >= units*9:
+		return xunicode.LittleEndian, true
+	case big*10 >= units*9:
+		return xunicode.BigEndian, true
+	}
+	return false, false
+}
+
+// validUTF8 reports whether the sample is UTF-8, allowing it to end in the
+// middle of a character.
+func validUTF8(sample []byte) bool {
+	start := len(sample) - 1
+	for start > 0 && len(sample)-start < utf8.UTFMax && !utf8.RuneStart(sample[start]) {
+		start--
+	}
+	if start >= 0 && !utf8.FullRune(sample[start:]) {
+		sample = sample[:start]
+	}
+	return utf8.Valid(sample)
+}
+
+// utf8Checker checks that the text written to it in pieces is UTF-8. A
+// character may be split between writes.
+type utf8Checker struct {
+	partial []byte
+	invalid bool
+	written int64
+	// invalidAt is an offset shortly before the first byte that is not
+	// UTF-8, at most one write earlier.
+	invalidAt int64
+}
+
+func (c *utf8Checker) Write(p []byte) (int, error) {
+	n := len(p)
+	if c.invalid {
+		return n, nil
+	}
+	c.invalidAt = c.written - int64(len(c.partial))
+	c.written += int64(n)
+	if len(c.partial) > 0 {
+		joined := append(c.partial, p[:min(len(p), utf8.UTFMax)]...)
+		if !utf8.FullRune(joined) {
+			c.partial = joined
+			return n, nil
+		}
+		r, size := utf8.DecodeRune(joined)
+		if r == utf8.RuneError && size == 1 {
+			c.invalid = true
+			return n, nil
+		}
+		p = p[size-len(c.partial):]
+		c.partial = c.partial[:0]
+	}
+
+	end := len(p)
+	for start := len(p) - 1; start >= 0 && len(p)-start <= utf8.UTFMax; start-- {
+		if utf8.RuneStart(p[start]) {
+			if !utf8.FullRune(p[start:]) {
+				end = start
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		c.invalid = true
+		return n, nil
+	}
+	c.partial = append(c.partial, p[end:]...)
+	return n, nil
+}
+
+// Valid reports whether everything written was UTF-8 and did not end in
+// the middle of a character.
+func (c *utf8Checker) Valid() bool {
+	return !c.invalid && len(c.partial) == 0
+}
+
+// letterScore rates how much the sample decoded with cm looks like text.
+// Only bytes outside ASCII are scored. Lower-case letters count for it;
+// upper-case letters inside words, symbols and Cyrillic letters stuck to
+// Latin ones count against it, since that is what a wrong code page mostly
+// produces.
+func letterScore(sample []byte, cm *charmap.Charmap) int {
+	score := 0
+	prev := ' '
+	for _, b := range sample {
+		r := cm.DecodeByte(b)
+		if b >= utf8.RuneSelf {
+			switch {
+			case unicode.Is(unicode.Cyrillic, r) && prev < utf8.RuneSelf && unicode.IsLetter(prev):
+				score -= 2
+			case unicode.IsLower(r):
+				score++
+			case unicode.IsUpper(r) && unicode.IsLetter(prev):
+				score--
+			case !unicode.IsLetter(r):
+				score -= 2
+			}
+		}
+		prev = r
+	}
+	return score
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+const russianText = "Привет, мир! Это эссе о чтении, письме и честной работе.\n"
+
+func encode(t *testing.T, enc encoding.Encoding, text string) string {
+	encoded, err := enc.NewEncoder().String(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func TestDetectEncoding(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		mimeType string
+		charset  string
+		expected string
+	}{
+		{name: "ASCII", data: "Just text", mimeType: mimeText, expected: "utf-8"},
+		{name: "UTF-8", data: russianText, mimeType: mimeText, expected: "utf-8"},
+		{name: "UTF-8 with BOM", data: "\xEF\xBB\xBF" + russianText, mimeType: mimeText, expected: "utf-8"},
+		{name: "Windows-1251", data: encode(t, charmap.Windows1251, russianText), mimeType: mimeText, expected: "windows-1251"},
+		{name: "KOI8-R", data: encode(t, charmap.KOI8R, russianText), mimeType: mimeText, expected: "koi8-r"},
+		{name: "CP866", data: encode(t, charmap.CodePage866, russianText), mimeType: mimeText, expected: "ibm866"},
+		{name: "Windows-1252", data: encode(t, charmap.Windows1252, "Un café très crème, déjà.\n"), mimeType: mimeText, expected: "windows-1252"},
+		{
+			name:     "UTF-16LE with BOM",
+			data:     encode(t, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), russianText),
+			mimeType: mimeText,
+			expected: "utf-16le",
+		},
+		{
+			name:     "UTF-16BE without BOM",
+			data:     encode(t, unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), russianText),
+			expected: "utf-16be",
+		},
+		{
+			name:     "HTML meta charset",
+			data:     `<html><head><meta charset="koi8-r"></head><body>` + encode(t, charmap.KOI8R, "Да") + `</body></html>`,
+			mimeType: mimeHTML,
+			expected: "koi8-r",
+		},
+		{
+			name:     "Charset overrides detection",
+			data:     encode(t, charmap.Windows1251, russianText),
+			mimeType: mimeText,
+			charset:  "cp866",
+			expected: "ibm866",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, name, err := DetectEncoding([]byte(tt.data), tt.mimeType, tt.charset)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, name)
+			}
+		})
+	}
+
+	if _, _, err := DetectEncoding([]byte("text"), mimeText, "no-such-charset"); err != errUnknownCharset {
+		t.Errorf("expected errUnknownCharset, got %v", err)
+	}
+}
+
+func TestUploadConvertsToUTF8(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1<<20)
+
+	uploads := []struct {
+		name     string
+		req      *http.Request
+		status   int
+		encoding string
+	}{
+		{
+			name:     "Windows-1251 is converted",
+			req:      uploadRequest("essay.txt", encode(t, charmap.Windows1251, russianText)),
+			status:   http.StatusCreated,
+			encoding: "windows-1251",
+		},
+		{
+			name:   "Same text in UTF-16 is a duplicate",
+			req:    uploadRequest("essay.txt", encode(t, unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), russianText)),
+			status: http.StatusOK,
+		},
+		{
+			name:     "Charset field overrides detection",
+			req:      uploadFormRequest(map[string]string{"charset": "koi8-r"}, "other.txt", encode(t, charmap.KOI8R, "Да.")),
+			status:   http.StatusCreated,
+			encoding: "koi8-r",
+		},
+		{
+			name:   "Unknown charset",
+			req:    uploadFormRequest(map[string]string{"charset": "klingon"}, "essay.txt", "text"),
+			status: http.StatusBadRequest,
+		},
+		{
+			name:   "Binary file with a charset is unsupported",
+			req:    uploadFormRequest(map[string]string{"charset": "klingon"}, "image.txt", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"),
+			status: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, upload := range uploads {
+		t.Run(upload.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.UploadFile(rr, upload.req)
+			if rr.Code != upload.status {
+				t.Fatalf("expected status %d, got %d: %s", upload.status, rr.Code, rr.Body.String())
+			}
+			if upload.status != http.StatusCreated {
+				return
+			}
+
+			var file FileMetadata
+			for _, f := range mockRepo.Files {
+				if f.Encoding == upload.encoding {
+					file = f
+				}
+			}
+			if file.ID == "" {
+				t.Fatalf("no file with encoding %s", upload.encoding)
+			}
+			if upload.encoding == "windows-1251" && string(blobs.Blobs[file.Location]) != russianText {
+				t.Errorf("unexpected content %q", blobs.Blobs[file.Location])
+			}
+		})
+	}
+
+	if len(mockRepo.Files) != 2 {
+		t.Errorf("expected 2 files, got %d", len(mockRepo.Files))
+	}
+}
+
+func TestUTF8Checker(t *testing.T) {
+	text := []byte(russianText)
+	tests := []struct {
+		name      string
+		pieces    [][]byte
+		valid     bool
+		invalidAt int64
+	}{
+		{name: "Whole text", pieces: [][]byte{text}, valid: true},
+		{name: "Character split between writes", pieces: [][]byte{text[:1], text[1:2], text[2:5], text[5:]}, valid: true},
+		{name: "Invalid byte after a split", pieces: [][]byte{text[:1], {0xFF}, text[2:]}},
+		{name: "Ends in a character", pieces: [][]byte{text[:1]}},
+		{name: "Windows-1251", pieces: [][]byte{[]byte("ok "), []byte(encode(t, charmap.Windows1251, russianText))}, invalidAt: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &utf8Checker{}
+			for _, piece := range tt.pieces {
+				checker.Write(piece)
+			}
+			if checker.Valid() != tt.valid {
+				t.Errorf("expected valid %v", tt.valid)
+			}
+			if !tt.valid && checker.invalidAt != tt.invalidAt {
+				t.Errorf("expected invalid text at %d, got %d", tt.invalidAt, checker.invalidAt)
+			}
+		})
+	}
+}
+
+func TestUploadUTF8OnlyInSample(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1<<20)
+
+	preface := strings.Repeat("Abstract. ", encodingSampleSize/10+1) + "\n"
+	rr := httptest.NewRecorder()
+	handler.UploadFile(rr, uploadRequest("essay.txt", preface+encode(t, charmap.Windows1251, russianText)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	for _, file := range mockRepo.Files {
+		if file.Encoding != "windows-1251" || file.LineCount != 2 {
+			t.Errorf("expected windows-1251 with 2 lines, got %s with %d", file.Encoding, file.LineCount)
+		}
+		if content := string(blobs.Blobs[file.Location]); content != preface+russianText {
+			t.Errorf("text was not converted: %q", content[len(preface):])
+		}
+		if hash := sha256.Sum256([]byte(preface + russianText)); file.Hash != hex.EncodeToString(hash[:]) {
+			t.Error("hash is not of the converted text")
+		}
+	}
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/ledongthuc/pdf"
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/charmap"
+)
+
+const (
+	mimeText     = "text/plain"
+	mimeMarkdown = "text/markdown"
+	mimeHTML     = "text/html"
+	mimeRTF      = "application/rtf"
+	mimePDF      = "application/pdf"
+	mimeZip      = "application/zip"
+	mimeDOCX     = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	mimeODT      = "application/vnd.oasis.opendocument.text"
+)
+
+// sniffLength is how many leading bytes DetectMimeType looks at.
+const sniffLength = 512
+
+var (
+	errUnsupportedFormat = errors.New("unsupported file format")
+	errExtractionFailed  = errors.New("failed to extract text")
+)
+
+// extractors pull plain text out of every supported format except plain
+// text, which is analyzed as uploaded. Paragraphs are separated by blank
+// lines, as the analysis service expects.
+var extractors = map[string]func(data []byte) (string, error){
+	mimeMarkdown: extractMarkdown,
+	mimeHTML:     extractHTML,
+	mimeRTF:      extractRTF,
+	mimePDF:      extractPDF,
+	mimeDOCX:     extractDOCX,
+	mimeODT:      extractODT,
+}
+
+// DetectMimeType determines the format from the first bytes of a file and
+// falls back to the file name only to tell Markdown and HTML from plain
+// text. Zip archives are reported as mimeZip and told apart by
+// zipMimeType once the whole file is available. It returns "" for
+// unsupported formats.
+func DetectMimeType(head []byte, filename string) string {
+	if bytes.HasPrefix(head, []byte(`{\rtf`)) {
+		return mimeRTF
+	}
+
+	detected, _, _ := strings.Cut(http.DetectContentType(head), ";")
+	switch detected {
+	case mimePDF, mimeZip, mimeHTML:
+		return detected
+	case mimeText:
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".md", ".markdown":
+			return mimeMarkdown
+		case ".html", ".htm":
+			return mimeHTML
+		}
+		return mimeText
+	}
+	return ""
+}
+
+// zipMimeType tells DOCX and ODT documents apart by their contents.
+func zipMimeType(archive *zip.Reader) string {
+	for _, f := range archive.File {
+		switch f.Name {
+		case "word/document.xml":
+			return mimeDOCX
+		case "mimetype":
+			data, err := readZipFile(f)
+			if err == nil && strings.TrimSpace(string(data)) == mimeODT {
+				return mimeODT
+			}
+		}
+	}
+	return ""
+}
+
+// ExtractText returns the plain text of a file of the given detected type,
+// together with the type refined for zip archives.
+func ExtractText(mimeType string, data []byte) (string, string, error) {
+	if mimeType == mimeZip {
+		archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return "", "", fmt.Errorf("%w: %v", errExtractionFailed, err)
+		}
+		if mimeType = zipMimeType(archive); mimeType == "" {
+			return "", "", errUnsupportedFormat
+		}
+	}
+
+	extract, ok := extractors[mimeType]
+	if !ok {
+		return "", "", errUnsupportedFormat
+	}
+	text, err := extract(data)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", errExtractionFailed, err)
+	}
+	return cleanText(text), mimeType, nil
+}
+
+var (
+	trailingSpaces = regexp.MustCompile(`[ \t]+\n`)
+	extraNewlines  = regexp.MustCompile(`\n{3,}`)
+)
+
+func cleanText(text string) string {
+	text = strings.ReplaceAll(text, "\u00a0", " ")
+	text = trailingSpaces.ReplaceAllString(text, "\n")
+	text = extraNewlines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text) + "\n"
+}
+
+// maxZipEntrySize limits how much is unpacked from a file in a DOCX or ODT
+// archive, so that a small zip bomb cannot exhaust memory.
+const maxZipEntrySize = 32 << 20
+
+// openZipEntry rejects entries that claim to be larger than
+// maxZipEntrySize. The size in the header can be forged, so the reader
+// stops at the limit as well.
+func openZipEntry(f *zip.File) (io.ReadCloser, error) {
+	if f.UncompressedSize64 > maxZipEntrySize {
+		return nil, fmt.Errorf("%s: unpacked size exceeds %d bytes", f.Name, maxZipEntrySize)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, maxZipEntrySize), rc}, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := openZipEntry(f)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+func openZipFile(data []byte, name string) (io.ReadCloser, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range archive.File {
+		if f.Name == name {
+			return openZipEntry(f)
+		}
+	}
+	return nil, fmt.Errorf("%s: file does not exist", name)
+}
+
+// extractDOCX reads the runs of word/document.xml. Only text inside w:t
+// elements is content; everything else is markup.
+func extractDOCX(data []byte) (string, error) {
+	document, err := openZipFile(data, "word/document.xml")
+	if err != nil {
+		return "", err
+	}
+	defer document.Close()
+
+	var (
+		text strings.Builder
+		inT  bool
+	)
+	decoder := xml.NewDecoder(document)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inT = true
+			case "tab":
+				text.WriteString("\t")
+			case "br", "cr":
+				text.WriteString("\n")
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inT = false
+			case "p":
+				text.WriteString("\n\n")
+			}
+		case xml.CharData:
+			if inT {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// extractODT reads the paragraphs and headings of content.xml.
+func extractODT(data []byte) (string, error) {
+	content, err := openZipFile(data, "content.xml")
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	var (
+		text  strings.Builder
+		depth int
+	)
+	decoder := xml.NewDecoder(content)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "p", "h":
+				depth++
+			case "tab":
+				text.WriteString("\t")
+			case "line-break":
+				text.WriteString("\n")
+			case "s":
+				spaces := 1
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "c" {
+						if n, err := strconv.Atoi(attr.Value); err == nil && n > 0 {
+							spaces = n
+						}
+					}
+				}
+				text.WriteString(strings.Repeat(" ", spaces))
+			}
+		case xml.EndElement:
+			if t.Name.Local == "p" || t.Name.Local == "h" {
+				depth--
+				text.WriteString("\n\n")
+			}
+		case xml.CharData:
+			if depth > 0 {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// extractPDF reads the text layer page by page. Glyphs are joined in the
+// order they are drawn; a drop of the baseline starts a new line, a larger
+// drop a new paragraph, and a gap between glyphs a space. Scanned pages
+// without a text layer yield nothing.
+func extractPDF(data []byte) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("malformed PDF: %v", r)
+		}
+	}()
+
+	reader, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+	for i := 1; i <= reader.NumPage(); i++ {
+		page := reader.Page(i)
+		if page.V.IsNull() {
+			continue
+		}
+
+		var prev *pdf.Text
+		for _, glyph := range page.Content().Text {
+			if prev != nil {
+				drop := prev.Y - glyph.Y
+				switch {
+				case drop > prev.FontSize*1.8 || drop < -prev.FontSize:
+					result.WriteString("\n\n")
+				case drop > prev.FontSize*0.5:
+					result.WriteString("\n")
+				case glyph.X-(prev.X+prev.W) > glyph.FontSize*0.15 && prev.S != " " && glyph.S != " ":
+					result.WriteString(" ")
+				}
+			}
+			result.WriteString(glyph.S)
+			prev = &glyph
+		}
+		result.WriteString("\n\n")
+	}
+	return result.String(), nil
+}
+
+// htmlSkipped elements have no readable text.
+var htmlSkipped = map[string]bool{
+	"head": true, "script": true, "style": true, "noscript": true, "template": true, "svg": true,
+}
+
+// htmlBlocks end a paragraph.
+var htmlBlocks = map[string]bool{
+	"p": true, "div": true, "li": true, "tr": true, "table": true, "ul": true, "ol": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"section": true, "article": true, "header": true, "footer": true, "aside": true,
+	"blockquote": true, "pre": true, "dd": true, "dt": true, "figcaption": true,
+}
+
+var htmlWhitespace = regexp.MustCompile(`\s+`)
+
+// extractHTML keeps the visible text. Whitespace is collapsed as a browser
+// would, except inside pre.
+func extractHTML(data []byte) (string, error) {
+	var (
+		text    strings.Builder
+		skipped int
+		inPre   int
+	)
+	tokenizer := html.NewTokenizer(bytes.NewReader(data))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return "", err
+			}
+			return text.String(), nil
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			switch {
+			case htmlSkipped[tag]:
+				skipped++
+			case tag == "br":
+				text.WriteString("\n")
+			case tag == "pre":
+				inPre++
+			case tag == "td" || tag == "th":
+				text.WriteString(" ")
+			}
+
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			tag := string(name)
+			switch {
+			case htmlSkipped[tag]:
+				if skipped > 0 {
+					skipped--
+				}
+			case tag == "pre" && inPre > 0:
+				inPre--
+			}
+			if htmlBlocks[tag] {
+				text.WriteString("\n\n")
+			}
+
+		case html.TextToken:
+			if skipped > 0 {
+				continue
+			}
+			content := string(tokenizer.Text())
+			if inPre == 0 {
+				content = htmlWhitespace.ReplaceAllString(content, " ")
+			}
+			text.WriteString(content)
+		}
+	}
+}
+
+var (
+	markdownFence      = regexp.MustCompile("^\\s*(```|~~~)")
+	markdownRule       = regexp.MustCompile(`^\s*([-*_=]\s*){3,}$`)
+	markdownLinkDef    = regexp.MustCompile(`^\s*\[[^\]]+\]:\s+\S+`)
+	markdownHeading    = regexp.MustCompile(`^\s*#{1,6}\s+`)
+	markdownQuote      = regexp.MustCompile(`^\s*(>\s?)+`)
+	markdownListItem   = regexp.MustCompile(`^\s*([-*+]|\d+[.)])\s+(\[[ xX]\]\s+)?`)
+	markdownImage      = regexp.MustCompile(`!\[([^\]]*)\]\([^)]*\)`)
+	markdownLink       = regexp.MustCompile(`\[([^\]]+)\](\([^)]*\)|\[[^\]]*\])`)
+	markdownCode       = regexp.MustCompile("`([^`]*)`")
+	markdownStrong     = regexp.MustCompile(`(\*\*|__)(\S(?:.*?\S)?)(\*\*|__)`)
+	markdownEmphasis   = regexp.MustCompile(`(^|[^\w*])[*_](\S(?:[^*_]*?\S)?)[*_]([^\w*]|$)`)
+	markdownStrike     = regexp.MustCompile(`~~(.+?)~~`)
+	markdownInlineHTML = regexp.MustCompile(`</?[A-Za-z][^>]*>`)
+)
+
+// extractMarkdown removes the Markdown syntax and keeps the text. Code
+// blocks are kept as they are.
+func extractMarkdown(data []byte) (string, error) {
+	var (
+		text   strings.Builder
+		inCode bool
+	)
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if markdownFence.MatchString(line) {
+			inCode = !inCode
+			continue
+		}
+		if !inCode {
+			if markdownRule.MatchString(line) || markdownLinkDef.MatchString(line) {
+				line = ""
+			}
+			line = markdownHeading.ReplaceAllString(line, "")
+			line = markdownQuote.ReplaceAllString(line, "")
+			line = markdownListItem.ReplaceAllString(line, "")
+			line = markdownImage.ReplaceAllString(line, "$1")
+			line = markdownLink.ReplaceAllString(line, "$1")
+			line = markdownCode.ReplaceAllString(line, "$1")
+			line = markdownStrong.ReplaceAllString(line, "$2")
+			line = markdownEmphasis.ReplaceAllString(line, "$1$2$3")
+			line = markdownStrike.ReplaceAllString(line, "$1")
+			line = markdownInlineHTML.ReplaceAllString(line, "")
+		}
+		text.WriteString(line)
+		text.WriteString("\n")
+	}
+	return text.String(), nil
+}
+
+// rtfSkipped destinations hold no document text.
+var rtfSkipped = map[string]bool{
+	"fonttbl": true, "colortbl": true, "stylesheet": true, "info": true, "pict": true,
+	"header": true, "headerl": true, "headerr": true, "headerf": true,
+	"footer": true, "footerl": true, "footerr": true, "footerf": true,
+	"object": true, "themedata": true, "datastore": true, "colorschememapping": true,
+	"listtable": true, "listoverridetable": true, "rsidtbl": true, "generator": true,
+	"latentstyles": true, "xmlnstbl": true, "fldinst": true, "filetbl": true,
+	"revtbl": true, "pgdsctbl": true, "mmathPr": true, "wgrffmtfilter": true,
+}
+
+var rtfSymbols = map[string]string{
+	"par": "\n\n", "line": "\n", "tab": "\t", "cell": " ", "row": "\n",
+	"emdash": "—", "endash": "–", "bullet": "•",
+	"lquote": "‘", "rquote": "’", "ldblquote": "“", "rdblquote": "”",
+}
+
+// rtfCodepages maps \ansicpgN to the charmap of 8-bit text.
+var rtfCodepages = map[int]*charmap.Charmap{
+	866: charmap.CodePage866, 1250: charmap.Windows1250, 1251: charmap.Windows1251,
+	1252: charmap.Windows1252, 1253: charmap.Windows1253, 1254: charmap.Windows1254,
+	1257: charmap.Windows1257, 10007: charmap.MacintoshCyrillic,
+}
+
+type rtfGroup struct {
+	skip bool
+	uc   int
+}
+
+// extractRTF interprets the text of an RTF document: 8-bit characters in
+// the document codepage, \uN escapes and paragraph breaks. Groups of
+// destinations such as the font table are skipped.
+func extractRTF(data []byte) (string, error) {
+	var (
+		text      strings.Builder
+		codepage  = charmap.Windows1252
+		group     = rtfGroup{uc: 1}
+		stack     []rtfGroup
+		skipChars int
+	)
+
+	write := func(s string) {
+		if skipChars > 0 {
+			skipChars--
+			return
+		}
+		if !group.skip {
+			text.WriteString(s)
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '{':
+			stack = append(stack, group)
+		case '}':
+			if len(stack) == 0 {
+				return "", fmt.Errorf("unbalanced braces")
+			}
+			group = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		case '\r', '\n':
+		case '\\':
+			if i+1 >= len(data) {
+				break
+			}
+			i++
+			c = data[i]
+			switch {
+			case c == '\'':
+				if i+2 >= len(data) {
+					return "", fmt.Errorf("truncated hex escape")
+				}
+				b, err := strconv.ParseUint(string(data[i+1:i+3]), 16, 8)
+				if err != nil {
+					return "", fmt.Errorf("invalid hex escape")
+				}
+				i += 2
+				write(string(codepage.DecodeByte(byte(b))))
+			case c == '*':
+				group.skip = true
+			case c == '~':
+				write(" ")
+			case c == '_':
+				write("-")
+			case c == '-':
+			case c == '\r' || c == '\n':
+				write("\n\n")
+			case isASCIILetter(c):
+				start := i
+				for i < len(data) && isASCIILetter(data[i]) {
+					i++
+				}
+				word := string(data[start:i])
+
+				paramStart := i
+				if i < len(data) && data[i] == '-' {
+					i++
+				}
+				for i < len(data) && data[i] >= '0' && data[i] <= '9' {
+					i++
+				}
+				param, hasParam := 0, i > paramStart
+				if hasParam {
+					param, _ = strconv.Atoi(string(data[paramStart:i]))
+				}
+				if i >= len(data) || data[i] != ' ' {
+					i--
+				}
+
+				switch {
+				case rtfSkipped[word]:
+					group.skip = true
+				case word == "ansicpg":
+					if cm, ok := rtfCodepages[param]; ok {
+						codepage = cm
+					}
+				case word == "uc" && hasParam:
+					group.uc = param
+				case word == "u" && hasParam:
+					if param < 0 {
+						param += 65536
+					}
+					write(string(rune(param)))
+					skipChars = group.uc
+				default:
+					if symbol, ok := rtfSymbols[word]; ok {
+						write(symbol)
+					}
+				}
+			default:
+				write(string(c))
+			}
+		default:
+			write(string(codepage.DecodeByte(c)))
+		}
+	}
+	return text.String(), nil
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func zipFile(t *testing.T, files map[string]string, order ...string) []byte {
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	for _, name := range order {
+		f, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(files[name]))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func docxFile(t *testing.T) []byte {
+	return zipFile(t, map[string]string{
+		"[Content_Types].xml": `<?xml version="1.0"?><Types/>`,
+		"word/document.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>
+<w:p><w:r><w:t>Первый </w:t></w:r><w:r><w:rPr><w:b/></w:rPr><w:t>абзац</w:t></w:r></w:p>
+<w:p><w:r><w:t>Второй</w:t><w:tab/><w:t>абзац</w:t></w:r></w:p>
+</w:body></w:document>`,
+	}, "[Content_Types].xml", "word/document.xml")
+}
+
+func odtFile(t *testing.T) []byte {
+	return zipFile(t, map[string]string{
+		"mimetype": mimeODT,
+		"content.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<office:document-content xmlns:office="urn:oasis:names:tc:opendocument:xmlns:office:1.0" xmlns:text="urn:oasis:names:tc:opendocument:xmlns:text:1.0">
+<office:body><office:text>
+<text:h text:outline-level="1">Заголовок</text:h>
+<text:p>Текст<text:s text:c="2"/>с <text:span>пробелами</text:span></text:p>
+</office:text></office:body></office:document-content>`,
+	}, "mimetype", "content.xml")
+}
+
+// pdfFile builds a one-page PDF that shows each line with the Helvetica
+// font.
+func pdfFile(lines ...string) []byte {
+	var content strings.Builder
+	content.WriteString("BT /F1 12 Tf 72 720 Td 14 TL\n")
+	for _, line := range lines {
+		fmt.Fprintf(&content, "(%s) Tj T*\n", line)
+	}
+	content.WriteString("ET")
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		"<< /Type /Page /Parent 2 0 R /MediaBox [0 0 612 792] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>",
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", content.Len(), content.String()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica >>",
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteString("%PDF-1.4\n")
+	offsets := make([]int, len(objects))
+	for i, object := range objects {
+		offsets[i] = buf.Len()
+		fmt.Fprintf(buf, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+	xref := buf.Len()
+	fmt.Fprintf(buf, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(buf, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+	return buf.Bytes()
+}
+
+func TestExtractText(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     []byte
+		mimeType string
+		expected string
+	}{
+		{
+			name:     "Plain text is detected",
+			filename: "essay.txt",
+			data:     []byte("Just text"),
+			mimeType: mimeText,
+		},
+		{
+			name:     "DOCX",
+			filename: "essay.docx",
+			data:     docxFile(t),
+			mimeType: mimeDOCX,
+			expected: "Первый абзац\n\nВторой\tабзац\n",
+		},
+		{
+			name:     "ODT",
+			filename: "essay.odt",
+			data:     odtFile(t),
+			mimeType: mimeODT,
+			expected: "Заголовок\n\nТекст  с пробелами\n",
+		},
+		{
+			name:     "RTF with codepage and unicode escapes",
+			filename: "essay.rtf",
+			data: []byte(`{\rtf1\ansi\ansicpg1251{\fonttbl{\f0 Times New Roman;}}{\*\generator Writer;}` +
+				`\f0 \'cf\'f0\'e8\'e2\'e5\'f2, {\b world}\par \uc1\u1052?\u1080?\u1088?\par}`),
+			mimeType: mimeRTF,
+			expected: "Привет, world\n\nМир\n",
+		},
+		{
+			name:     "HTML",
+			filename: "essay.html",
+			data: []byte(`<!DOCTYPE html><html><head><title>T</title><style>p{}</style></head>
+<body><h1>Title</h1><p>First   paragraph
+with <b>bold</b> &amp; entity.</p><script>var x = 1;</script><p>Second<br>line</p></body></html>`),
+			mimeType: mimeHTML,
+			expected: "Title\n\nFirst paragraph with bold & entity.\n\nSecond\nline\n",
+		},
+		{
+			name:     "Markdown",
+			filename: "README.md",
+			data: []byte("# Heading\n\nSome **bold** and _italic_ text with a [link](http://example.com) and `code`.\n\n" +
+				"- first item\n- second item\n\n> quoted snake_case_name\n\n```\nfmt.Println(\"hi\")\n```\n"),
+			mimeType: mimeMarkdown,
+			expected: "Heading\n\nSome bold and italic text with a link and code.\n\nfirst item\nsecond item\n\n" +
+				"quoted snake_case_name\n\nfmt.Println(\"hi\")\n",
+		},
+		{
+			name:     "PDF text layer",
+			filename: "essay.pdf",
+			data:     pdfFile("Hello PDF", "Second line"),
+			mimeType: mimePDF,
+			expected: "Hello PDF\nSecond line\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detected := DetectMimeType(tt.data[:min(len(tt.data), sniffLength)], tt.filename)
+			if tt.mimeType == mimeText {
+				if detected != mimeText {
+					t.Errorf("expected %s, got %s", mimeText, detected)
+				}
+				return
+			}
+
+			text, mimeType, err := ExtractText(detected, tt.data)
+			if err != nil {
+				t.Fatalf("extraction failed: %v", err)
+			}
+			if mimeType != tt.mimeType {
+				t.Errorf("expected type %s, got %s", tt.mimeType, mimeType)
+			}
+			if text != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, text)
+			}
+		})
+	}
+}
+
+func TestZipBomb(t *testing.T) {
+	// Spaces compress to about a thousandth of their size.
+	padding := strings.Repeat(" ", maxZipEntrySize+1)
+	document := `<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main">` + padding + `</w:document>`
+
+	buf := &bytes.Buffer{}
+	writer := zip.NewWriter(buf)
+	f, _ := writer.Create("word/document.xml")
+	f.Write([]byte(document))
+
+	// The same entry again with a forged size in the header.
+	compressed := &bytes.Buffer{}
+	deflate, _ := flate.NewWriter(compressed, flate.BestCompression)
+	deflate.Write([]byte(document))
+	deflate.Close()
+	raw, _ := writer.CreateRaw(&zip.FileHeader{
+		Name:               "content.xml",
+		Method:             zip.Deflate,
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: 100,
+	})
+	raw.Write(compressed.Bytes())
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, extract := range map[string]func([]byte) (string, error){"DOCX": extractDOCX, "ODT": extractODT} {
+		if _, err := extract(buf.Bytes()); err == nil {
+			t.Errorf("%s: expected an error for an entry over %d bytes", name, maxZipEntrySize)
+		}
+	}
+}
+
+func TestUnsupportedFormats(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if mimeType := DetectMimeType(png, "image.txt"); mimeType != "" {
+		t.Errorf("expected PNG to be unsupported, got %s", mimeType)
+	}
+
+	archive := zipFile(t, map[string]string{"data.csv": "a,b"}, "data.csv")
+	if _, _, err := ExtractText(DetectMimeType(archive, "data.zip"), archive); !errors.Is(err, errUnsupportedFormat) {
+		t.Errorf("expected errUnsupportedFormat for a plain zip, got %v", err)
+	}
+
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1024)
+
+	for name, content := range map[string]string{"image.png": string(png), "data.zip": string(archive)} {
+		rr := httptest.NewRecorder()
+		handler.UploadFile(rr, uploadRequest(name, content))
+		if rr.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: expected status %d, got %d", name, http.StatusUnsupportedMediaType, rr.Code)
+		}
+	}
+	if len(blobs.Blobs) != 0 || len(mockRepo.Files) != 0 {
+		t.Error("rejected uploads left blobs or files behind")
+	}
+}
+
+func TestUploadKeepsOriginalAndText(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1<<20)
+
+	original := docxFile(t)
+	rr := httptest.NewRecorder()
+	handler.UploadFile(rr, uploadRequest("essay.docx", string(original)))
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+
+	var file FileMetadata
+	for _, f := range mockRepo.Files {
+		file = f
+	}
+	if !bytes.Equal(blobs.Blobs[file.Location], original) {
+		t.Error("original file was not kept")
+	}
+	if file.TextLocation == file.Location || string(blobs.Blobs[file.TextLocation]) != "Первый абзац\n\nВторой\tабзац\n" {
+		t.Errorf("unexpected extracted text %q", blobs.Blobs[file.TextLocation])
+	}
+	if file.MimeType != mimeDOCX || file.Encoding != "" || file.LineCount != 3 {
+		t.Errorf("unexpected metadata %+v", file)
+	}
+}
@@ -4,38 +4,52 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 type MockRepository struct {
-	Files        map[string]FileMetadata
-	FileContents map[string]string
-	ErrorMode    bool
+	Files     map[string]FileMetadata
+	Deletions map[string]*Deletion
+	RunAt     map[string]time.Time
+	Uploads   map[string]*Upload
+	Finishing map[string]bool
+	Locked    string
+	ErrorMode bool
 }
 
-func (m *MockRepository) GetFileByHash(hash string) (*FileMetadata, error) {
+func (m *MockRepository) GetFileByHash(hash, uploader string) (*FileMetadata, error) {
 	if m.ErrorMode {
 		return nil, errors.New("mock error")
 	}
+	var found *FileMetadata
 	for _, file := range m.Files {
-		if file.Hash == hash {
-			return &file, nil
+		if file.Hash == hash && (found == nil || file.Uploader == uploader) {
+			found = &file
 		}
 	}
-	return nil, nil
+	return found, nil
 }
 
-func (m *MockRepository) SaveFile(metadata FileMetadata, content string) (string, error) {
+func (m *MockRepository) SaveFile(metadata *FileMetadata) error {
 	if m.ErrorMode {
-		return "", errors.New("mock error")
+		return errors.New("mock error")
+	}
+	metadata.Version = 1
+	for _, file := range m.Files {
+		if file.DocumentID == metadata.DocumentID && file.Version >= metadata.Version {
+			metadata.Version = file.Version + 1
+		}
 	}
-	m.Files[metadata.ID] = metadata
-	m.FileContents[metadata.Location] = content
-	return metadata.ID, nil
+	m.Files[metadata.ID] = *metadata
+	return nil
 }
 
 func (m *MockRepository) GetFile(id string) (*FileMetadata, error) {
@@ -49,23 +63,287 @@ func (m *MockRepository) GetFile(id string) (*FileMetadata, error) {
 	return &file, nil
 }
 
-func (m *MockRepository) GetFileContent(location string) (string, error) {
+func (m *MockRepository) ListVersions(documentID string) ([]FileMetadata, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	var versions []FileMetadata
+	for _, file := range m.Files {
+		if file.DocumentID == documentID {
+			versions = append(versions, file)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	return versions, nil
+}
+
+func (m *MockRepository) GetVersion(documentID string, version int) (*FileMetadata, error) {
+	versions, err := m.ListVersions(documentID)
+	if err != nil || len(versions) == 0 {
+		return nil, err
+	}
+	if version == 0 {
+		return &versions[len(versions)-1], nil
+	}
+	for _, file := range versions {
+		if file.Version == version {
+			return &file, nil
+		}
+	}
+	return nil, nil
+}
+
+// ListFiles filters and sorts in memory the same way the SQL query does.
+func (m *MockRepository) ListFiles(query FileQuery) ([]FileMetadata, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+
+	less := func(a, b FileMetadata) bool {
+		switch {
+		case query.Sort == "size" && a.Size != b.Size:
+			return a.Size < b.Size
+		case query.Sort == "date" && !a.CreatedAt.Equal(b.CreatedAt):
+			return a.CreatedAt.Before(b.CreatedAt)
+		case query.Sort == "name" && a.Name != b.Name:
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	}
+	before := func(a, b FileMetadata) bool {
+		if query.Desc {
+			return less(b, a)
+		}
+		return less(a, b)
+	}
+
+	var files []FileMetadata
+	for _, file := range m.Files {
+		if query.Name != "" && !strings.Contains(strings.ToLower(file.Name), strings.ToLower(query.Name)) {
+			continue
+		}
+		if query.Uploader != "" && file.Uploader != query.Uploader {
+			continue
+		}
+		if query.Access != nil && file.Uploader != query.Access.UserID && !slices.Contains(query.Access.Courses, file.CourseID) {
+			continue
+		}
+		if !query.From.IsZero() && file.CreatedAt.Before(query.From) {
+			continue
+		}
+		if !query.To.IsZero() && !file.CreatedAt.Before(query.To) {
+			continue
+		}
+		if query.After != nil {
+			after := m.Files[query.After.ID]
+			if !before(after, file) {
+				continue
+			}
+		}
+		files = append(files, file)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return before(files[i], files[j]) })
+	if len(files) > query.Limit {
+		files = files[:query.Limit]
+	}
+	return files, nil
+}
+
+func (m *MockRepository) DeleteFile(id string) (bool, error) {
+	if m.ErrorMode {
+		return false, errors.New("mock error")
+	}
+	file, exists := m.Files[id]
+	if !exists {
+		return false, nil
+	}
+	delete(m.Files, id)
+	if m.Deletions == nil {
+		m.Deletions = make(map[string]*Deletion)
+		m.RunAt = make(map[string]time.Time)
+	}
+	m.Deletions[id] = &Deletion{FileID: id, Location: file.Location, TextLocation: file.TextLocation}
+	m.RunAt[id] = time.Now()
+	return true, nil
+}
+
+func (m *MockRepository) LocationInUse(location string) (bool, error) {
+	for _, file := range m.Files {
+		if file.Location == location {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// LockLocation records the locked location, so tests can check that blobs
+// are only changed under the lock.
+func (m *MockRepository) LockLocation(location string, fn func() error) error {
+	m.Locked = location
+	defer func() { m.Locked = "" }()
+	return fn()
+}
+
+func (m *MockRepository) ClaimDeletion(lease time.Duration) (*Deletion, error) {
+	for id, d := range m.Deletions {
+		if !m.RunAt[id].After(time.Now()) {
+			d.Attempts++
+			m.RunAt[id] = time.Now().Add(lease)
+			claimed := *d
+			return &claimed, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockRepository) MarkBlobDeleted(fileID string) error {
+	m.Deletions[fileID].BlobDeleted = true
+	return nil
+}
+
+func (m *MockRepository) CompleteDeletion(fileID string) error {
+	delete(m.Deletions, fileID)
+	return nil
+}
+
+func (m *MockRepository) RetryDeletion(fileID string, errMsg string, runAt time.Time) error {
+	m.RunAt[fileID] = runAt
+	return nil
+}
+
+func (m *MockRepository) CreateUpload(upload Upload) (*Upload, error) {
 	if m.ErrorMode {
-		return "", errors.New("mock error")
+		return nil, errors.New("mock error")
+	}
+	if m.Uploads == nil {
+		m.Uploads = make(map[string]*Upload)
+	}
+	for _, existing := range m.Uploads {
+		if upload.IdempotencyKey != "" && existing.Uploader == upload.Uploader && existing.IdempotencyKey == upload.IdempotencyKey {
+			return m.GetUpload(existing.ID)
+		}
 	}
-	content, exists := m.FileContents[location]
+	m.Uploads[upload.ID] = &upload
+	return m.GetUpload(upload.ID)
+}
+
+func (m *MockRepository) GetUpload(id string) (*Upload, error) {
+	if m.ErrorMode {
+		return nil, errors.New("mock error")
+	}
+	upload, exists := m.Uploads[id]
 	if !exists {
-		return "", nil
+		return nil, nil
+	}
+	copied := *upload
+	copied.Chunks = append([]string(nil), upload.Chunks...)
+	return &copied, nil
+}
+
+func (m *MockRepository) AppendChunk(id string, offset, newOffset int64, key string, expiresAt time.Time) (bool, error) {
+	upload := m.Uploads[id]
+	if upload.Offset != offset {
+		return false, nil
+	}
+	upload.Offset = newOffset
+	upload.Chunks = append(upload.Chunks, key)
+	upload.ExpiresAt = expiresAt
+	return true, nil
+}
+
+func (m *MockRepository) ClaimUploadCompletion(id string, lease time.Duration) (bool, error) {
+	if m.Uploads[id].FileID != "" || m.Finishing[id] {
+		return false, nil
+	}
+	if m.Finishing == nil {
+		m.Finishing = make(map[string]bool)
+	}
+	m.Finishing[id] = true
+	return true, nil
+}
+
+func (m *MockRepository) ReleaseUploadCompletion(id string) error {
+	delete(m.Finishing, id)
+	return nil
+}
+
+func (m *MockRepository) CompleteUpload(id, fileID string, expiresAt time.Time) error {
+	m.Uploads[id].FileID = fileID
+	m.Uploads[id].Chunks = nil
+	m.Uploads[id].ExpiresAt = expiresAt
+	return nil
+}
+
+func (m *MockRepository) DeleteUpload(id string) error {
+	delete(m.Uploads, id)
+	return nil
+}
+
+func (m *MockRepository) ExpiredUploads(now time.Time) ([]Upload, error) {
+	var uploads []Upload
+	for _, upload := range m.Uploads {
+		if upload.ExpiresAt.Before(now) {
+			uploads = append(uploads, *upload)
+		}
+	}
+	return uploads, nil
+}
+
+type MockBlobStore struct {
+	Blobs map[string][]byte
+}
+
+func NewMockBlobStore() *MockBlobStore {
+	return &MockBlobStore{Blobs: make(map[string][]byte)}
+}
+
+func (m *MockBlobStore) Put(key string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.Blobs[key] = data
+	return nil
+}
+
+func (m *MockBlobStore) Get(key string) (io.ReadCloser, error) {
+	data, exists := m.Blobs[key]
+	if !exists {
+		return nil, ErrBlobNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *MockBlobStore) Delete(key string) error {
+	delete(m.Blobs, key)
+	return nil
+}
+
+func (m *MockBlobStore) Move(from, to string) error {
+	data, exists := m.Blobs[from]
+	if !exists {
+		return ErrBlobNotFound
+	}
+	delete(m.Blobs, from)
+	m.Blobs[to] = data
+	return nil
+}
+
+func (m *MockBlobStore) Keys() ([]string, error) {
+	var keys []string
+	for key := range m.Blobs {
+		keys = append(keys, key)
 	}
-	return content, nil
+	return keys, nil
 }
 
 func TestFileHandlers(t *testing.T) {
 	mockRepo := &MockRepository{
-		Files:        make(map[string]FileMetadata),
-		FileContents: make(map[string]string),
+		Files: make(map[string]FileMetadata),
 	}
-	handler := NewHandler(mockRepo)
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1024)
 
 	t.Run("Upload new file", func(t *testing.T) {
 		body := &bytes.Buffer{}
@@ -74,7 +352,7 @@ func TestFileHandlers(t *testing.T) {
 		part.Write([]byte("test content"))
 		writer.Close()
 
-		req := httptest.NewRequest("POST", "/files", body)
+		req := internal(httptest.NewRequest("POST", "/files", body))
 		req.Header.Set("Content-Type", writer.FormDataContentType())
 		rr := httptest.NewRecorder()
 
@@ -84,13 +362,20 @@ func TestFileHandlers(t *testing.T) {
 			t.Errorf("expected status %d, got %d", http.StatusCreated, rr.Code)
 		}
 
-		var response map[string]string
+		var response UploadResponse
 		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
 			t.Fatal(err)
 		}
 
-		if _, exists := mockRepo.Files[response["id"]]; !exists {
-			t.Error("file was not saved in repository")
+		saved, exists := mockRepo.Files[response.ID]
+		if !exists {
+			t.Fatal("file was not saved in repository")
+		}
+		if string(blobs.Blobs[saved.Location]) != "test content" {
+			t.Error("file content was not saved in blob store")
+		}
+		if saved.MimeType != mimeText || saved.Encoding != "utf-8" || saved.LineCount != 1 || saved.Size != 12 {
+			t.Errorf("unexpected metadata %+v", saved)
 		}
 	})
 
@@ -102,7 +387,7 @@ func TestFileHandlers(t *testing.T) {
 		part1.Write([]byte(content))
 		writer1.Close()
 
-		req1 := httptest.NewRequest("POST", "/files", body1)
+		req1 := internal(httptest.NewRequest("POST", "/files", body1))
 		req1.Header.Set("Content-Type", writer1.FormDataContentType())
 		rr1 := httptest.NewRecorder()
 		handler.UploadFile(rr1, req1)
@@ -113,7 +398,7 @@ func TestFileHandlers(t *testing.T) {
 		part2.Write([]byte(content))
 		writer2.Close()
 
-		req2 := httptest.NewRequest("POST", "/files", body2)
+		req2 := internal(httptest.NewRequest("POST", "/files", body2))
 		req2.Header.Set("Content-Type", writer2.FormDataContentType())
 		rr2 := httptest.NewRecorder()
 		handler.UploadFile(rr2, req2)
@@ -131,7 +416,7 @@ func TestFileHandlers(t *testing.T) {
 			Location: "test-location",
 		}
 
-		req := httptest.NewRequest("GET", "/files/"+fileID, nil)
+		req := internal(httptest.NewRequest("GET", "/files/"+fileID, nil))
 		rr := httptest.NewRecorder()
 		handler.GetFile(rr, req)
 
@@ -150,7 +435,7 @@ func TestFileHandlers(t *testing.T) {
 	})
 
 	t.Run("Get non-existent file", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/files/nonexistent", nil)
+		req := internal(httptest.NewRequest("GET", "/files/nonexistent", nil))
 		rr := httptest.NewRecorder()
 		handler.GetFile(rr, req)
 
@@ -162,11 +447,11 @@ func TestFileHandlers(t *testing.T) {
 	t.Run("Get file content - success", func(t *testing.T) {
 		location := "test-location"
 		expectedContent := "test file content"
-		mockRepo.FileContents[location] = expectedContent
+		blobs.Blobs[location] = []byte(expectedContent)
 
-		req := httptest.NewRequest("GET", "/files/content/"+location, nil)
+		req := internal(httptest.NewRequest("GET", "/files/test-file/content", nil))
 		rr := httptest.NewRecorder()
-		handler.GetFileContent(rr, req)
+		handler.File(rr, req)
 
 		if rr.Code != http.StatusOK {
 			t.Errorf("expected status %d, got %d", http.StatusOK, rr.Code)
@@ -175,18 +460,52 @@ func TestFileHandlers(t *testing.T) {
 		if !strings.Contains(rr.Body.String(), expectedContent) {
 			t.Errorf("expected content '%s', got '%s'", expectedContent, rr.Body.String())
 		}
+		if disposition := rr.Header().Get("Content-Disposition"); disposition != `attachment; filename=test.txt` {
+			t.Errorf("unexpected Content-Disposition %q", disposition)
+		}
 	})
 
 	t.Run("Get non-existent file content", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/files/content/nonexistent", nil)
+		req := internal(httptest.NewRequest("GET", "/files/nonexistent/content", nil))
 		rr := httptest.NewRecorder()
-		handler.GetFileContent(rr, req)
+		handler.File(rr, req)
 
 		if rr.Code != http.StatusNotFound {
 			t.Errorf("expected status %d, got %d", http.StatusNotFound, rr.Code)
 		}
 	})
 
+	t.Run("Upload too large file", func(t *testing.T) {
+		blobsBefore := len(blobs.Blobs)
+
+		req := uploadRequest("large.txt", strings.Repeat("a", 2048))
+		rr := httptest.NewRecorder()
+		handler.UploadFile(rr, req)
+
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("expected status %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+		if len(blobs.Blobs) != blobsBefore {
+			t.Error("partial blob of a rejected upload was kept")
+		}
+	})
+
+	t.Run("Duplicate upload discards its blob", func(t *testing.T) {
+		rr1 := httptest.NewRecorder()
+		handler.UploadFile(rr1, uploadRequest("first.txt", "same bytes"))
+		blobsBefore := len(blobs.Blobs)
+
+		rr2 := httptest.NewRecorder()
+		handler.UploadFile(rr2, uploadRequest("second.txt", "same bytes"))
+
+		if rr2.Code != http.StatusOK {
+			t.Errorf("expected status %d for duplicate, got %d", http.StatusOK, rr2.Code)
+		}
+		if len(blobs.Blobs) != blobsBefore {
+			t.Error("blob of a duplicate upload was kept")
+		}
+	})
+
 	t.Run("Upload file error", func(t *testing.T) {
 		mockRepo.ErrorMode = true
 		defer func() { mockRepo.ErrorMode = false }()
@@ -197,7 +516,7 @@ func TestFileHandlers(t *testing.T) {
 		part.Write([]byte("test content"))
 		writer.Close()
 
-		req := httptest.NewRequest("POST", "/files", body)
+		req := internal(httptest.NewRequest("POST", "/files", body))
 		req.Header.Set("Content-Type", writer.FormDataContentType())
 		rr := httptest.NewRecorder()
 
@@ -208,3 +527,244 @@ func TestFileHandlers(t *testing.T) {
 		}
 	})
 }
+
+func uploadRequest(filename, content string) *http.Request {
+	return uploadVersionRequest("", filename, content)
+}
+
+func uploadVersionRequest(documentID, filename, content string) *http.Request {
+	fields := map[string]string{}
+	if documentID != "" {
+		fields["document_id"] = documentID
+	}
+	return uploadFormRequest(fields, filename, content)
+}
+
+// uploadFormRequest sends the fields before the file.
+func uploadFormRequest(fields map[string]string, filename, content string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		writer.WriteField(name, value)
+	}
+	part, _ := writer.CreateFormFile("file", filename)
+	part.Write([]byte(content))
+	writer.Close()
+
+	req := internal(httptest.NewRequest("POST", "/files", body))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestListFiles(t *testing.T) {
+	base := time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+	mockRepo := &MockRepository{Files: map[string]FileMetadata{
+		"a": {ID: "a", Name: "essay.txt", Size: 300, Uploader: "alice", CreatedAt: base},
+		"b": {ID: "b", Name: "Essay-final.txt", Size: 100, Uploader: "bob", CreatedAt: base.Add(time.Hour)},
+		"c": {ID: "c", Name: "report.txt", Size: 200, Uploader: "alice", CreatedAt: base.AddDate(0, 0, 1)},
+		"d": {ID: "d", Name: "notes.txt", Size: 400, Uploader: "alice", CreatedAt: base.AddDate(0, 0, 2)},
+	}}
+	handler := NewHandler(mockRepo, NewMockBlobStore(), 1024)
+
+	list := func(t *testing.T, query string) FileListResponse {
+		req := internal(httptest.NewRequest("GET", "/files?"+query, nil))
+		rr := httptest.NewRecorder()
+		handler.Files(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		var response FileListResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	ids := func(files []FileMetadata) string {
+		var ids []string
+		for _, f := range files {
+			ids = append(ids, f.ID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	t.Run("Newest first by default", func(t *testing.T) {
+		if got := ids(list(t, "").Files); got != "d,c,b,a" {
+			t.Errorf("expected d,c,b,a, got %s", got)
+		}
+	})
+
+	t.Run("Cursor pagination", func(t *testing.T) {
+		first := list(t, "sort=size&limit=3")
+		if ids(first.Files) != "b,c,a" || first.NextCursor == "" {
+			t.Fatalf("unexpected first page %s, cursor %q", ids(first.Files), first.NextCursor)
+		}
+
+		second := list(t, "sort=size&limit=3&cursor="+first.NextCursor)
+		if ids(second.Files) != "d" || second.NextCursor != "" {
+			t.Errorf("unexpected second page %s, cursor %q", ids(second.Files), second.NextCursor)
+		}
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		if got := ids(list(t, "name=ESSAY&sort=name").Files); got != "b,a" {
+			t.Errorf("name filter: expected b,a, got %s", got)
+		}
+		if got := ids(list(t, "owner=alice&from=2025-03-02&to=2025-03-02").Files); got != "c" {
+			t.Errorf("owner and date filter: expected c, got %s", got)
+		}
+	})
+
+	t.Run("Invalid parameters", func(t *testing.T) {
+		for _, query := range []string{"sort=hash", "order=up", "limit=0", "from=yesterday", "cursor=garbage"} {
+			req := internal(httptest.NewRequest("GET", "/files?"+query, nil))
+			rr := httptest.NewRecorder()
+			handler.Files(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d, got %d", query, http.StatusBadRequest, rr.Code)
+			}
+		}
+	})
+}
+
+func TestDocumentVersions(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	handler := NewHandler(mockRepo, NewMockBlobStore(), 1024)
+
+	upload := func(t *testing.T, documentID, content string) UploadResponse {
+		rr := httptest.NewRecorder()
+		handler.UploadFile(rr, uploadVersionRequest(documentID, "essay.txt", content))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		var response UploadResponse
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	get := func(t *testing.T, path string, v any) int {
+		rr := httptest.NewRecorder()
+		handler.Document(rr, internal(httptest.NewRequest("GET", path, nil)))
+		if rr.Code == http.StatusOK {
+			if err := json.NewDecoder(rr.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rr.Code
+	}
+
+	first := upload(t, "", "first draft")
+	if first.DocumentID != first.ID || first.Version != 1 {
+		t.Fatalf("upload without document_id should start a document, got %+v", first)
+	}
+	second := upload(t, first.DocumentID, "corrected draft")
+	third := upload(t, first.DocumentID, "final draft")
+	if second.Version != 2 || third.Version != 3 || third.DocumentID != first.DocumentID {
+		t.Fatalf("unexpected versions %+v, %+v", second, third)
+	}
+
+	t.Run("List versions", func(t *testing.T) {
+		var response VersionListResponse
+		if code := get(t, "/documents/"+first.DocumentID+"/versions", &response); code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, code)
+		}
+		if len(response.Versions) != 3 || response.Versions[0].ID != first.ID || response.Versions[2].ID != third.ID {
+			t.Errorf("unexpected versions %+v", response.Versions)
+		}
+	})
+
+	t.Run("Get version and latest", func(t *testing.T) {
+		var version, latest FileMetadata
+		if code := get(t, "/documents/"+first.DocumentID+"/versions/2", &version); code != http.StatusOK || version.ID != second.ID {
+			t.Errorf("version 2: got status %d, file %s", code, version.ID)
+		}
+		if code := get(t, "/documents/"+first.DocumentID+"/latest", &latest); code != http.StatusOK || latest.ID != third.ID {
+			t.Errorf("latest: got status %d, file %s", code, latest.ID)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		var file FileMetadata
+		if code := get(t, "/documents/"+first.DocumentID+"/versions/9", &file); code != http.StatusNotFound {
+			t.Errorf("missing version: expected %d, got %d", http.StatusNotFound, code)
+		}
+		if code := get(t, "/documents/unknown/latest", &file); code != http.StatusNotFound {
+			t.Errorf("unknown document: expected %d, got %d", http.StatusNotFound, code)
+		}
+		if code := get(t, "/documents/"+first.DocumentID+"/versions/zero", &file); code != http.StatusBadRequest {
+			t.Errorf("invalid version: expected %d, got %d", http.StatusBadRequest, code)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.UploadFile(rr, uploadVersionRequest("../etc", "essay.txt", "other content"))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("invalid document_id: expected %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+}
+
+func TestContentAddressedUpload(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1024)
+
+	for _, content := range []string{"first essay", "second essay"} {
+		rr := httptest.NewRecorder()
+		handler.UploadFile(rr, uploadRequest("essay.txt", content))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+	}
+
+	for _, file := range mockRepo.Files {
+		if file.Location != contentLocation(file.Hash) || file.TextLocation != file.Location {
+			t.Errorf("expected location derived from the hash, got %s", file.Location)
+		}
+		if string(blobs.Blobs[file.Location]) == "" {
+			t.Errorf("no content stored for %s", file.ID)
+		}
+	}
+	for key := range blobs.Blobs {
+		if strings.HasPrefix(key, "tmp/") {
+			t.Errorf("temporary blob %s was left behind", key)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	handler.UploadFile(rr, uploadRequest("../../etc/passwd", "third essay"))
+	var response UploadResponse
+	json.NewDecoder(rr.Body).Decode(&response)
+	if name := mockRepo.Files[response.ID].Name; name != "passwd" {
+		t.Errorf("expected sanitized name passwd, got %q", name)
+	}
+
+	req := internal(httptest.NewRequest("GET", "/files/"+response.ID+"/text", nil))
+	rr = httptest.NewRecorder()
+	handler.File(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "third essay" {
+		t.Errorf("unexpected text response %d %q", rr.Code, rr.Body.String())
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+		t.Errorf("unexpected Content-Type %q", contentType)
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := map[string]string{
+		"essay.txt":                  "essay.txt",
+		"../../etc/passwd":           "passwd",
+		`C:\Users\student\essay.txt`: "essay.txt",
+		"..":                         "file",
+		"dir/":                       "dir",
+		"":                           "file",
+		" bad\x00\nname.txt ":        "badname.txt",
+		strings.Repeat("я", 200):     strings.Repeat("я", 127),
+	}
+	for input, expected := range tests {
+		if got := sanitizeFilename(input); got != expected {
+			t.Errorf("sanitizeFilename(%q) = %q, expected %q", input, got, expected)
+		}
+	}
+}
@@ -1,83 +1,534 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"path"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
+	xunicode "golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
 )
 
+// DefaultMaxUploadSize is used when MAX_UPLOAD_SIZE is not set.
+const DefaultMaxUploadSize = 50 << 20
+
+// multipartOverhead is allowed on top of the file size for the multipart
+// boundaries and headers of the request.
+const multipartOverhead = 1 << 20
+
+// uploaderHeader carries the identity of the user as set by the gateway.
+const uploaderHeader = "X-User-ID"
+
+var errFileTooLarge = errors.New("file is too large")
+
 type Handler struct {
-	repo Repository
+	repo          Repository
+	blobs         BlobStore
+	maxUploadSize int64
 }
 
-func NewHandler(repo Repository) *Handler {
-	return &Handler{repo: repo}
+func NewHandler(repo Repository, blobs BlobStore, maxUploadSize int64) *Handler {
+	return &Handler{repo: repo, blobs: blobs, maxUploadSize: maxUploadSize}
 }
 
+// Files serves the /files collection: GET lists files, POST uploads one.
+func (h *Handler) Files(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		h.ListFiles(w, r)
+		return
+	}
+	h.UploadFile(w, r)
+}
+
+// UploadFile streams the "file" part of a multipart request through a SHA-256
+// hasher straight into the blob store, so the upload is never held in memory.
+// Files larger than the configured maximum are rejected with 413. Duplicates
+// are detected once the whole file has been hashed, and their blob is
+// discarded.
+//
+// An optional "document_id" field, sent before the file, adds the upload as
+// the next version of that document. Without it the upload starts a new
+// document whose ID is the file ID. An optional "course_id" field submits
+// the file to a course, and an optional "charset" field overrides the
+// detected encoding of text files.
 func (h *Handler) UploadFile(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxUploadSize+multipartOverhead)
+
+	part, fields, err := uploadForm(r)
 	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusBadRequest)
+		h.uploadError(w, err, "Failed to read file", http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	defer part.Close()
 
-	contentBytes, err := io.ReadAll(file)
+	documentID := fields["document_id"]
+	if documentID != "" && !validDocumentID(documentID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+	principal := principalFrom(r)
+	if !h.checkUpload(w, principal, fields["course_id"], documentID) {
+		return
+	}
+
+	file, created, err := h.storeFile(part, part.FileName(), documentID, fields["course_id"], r.Header.Get(uploaderHeader), fields["charset"])
 	if err != nil {
-		http.Error(w, "Failed to read file content", http.StatusInternalServerError)
+		h.uploadError(w, err, "Failed to save file", http.StatusInternalServerError)
 		return
 	}
-	content := string(contentBytes)
 
+	status := http.StatusCreated
+	if !created {
+		status = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(newUploadResponse(file))
+}
+
+// storeFile streams content through a SHA-256 hasher into the blob store and
+// saves the file as the next version of the document, or of a new document
+// if documentID is empty. Blobs are addressed by the hash, and the file name
+// is kept only for display. If the uploader already has a file with the
+// same content, the new blob is discarded and that file is returned with
+// created set to false.
+//
+// The format is detected from the first bytes, so unsupported files are
+// rejected before anything is stored. Plain text, Markdown and HTML are
+// converted to UTF-8 from the given charset or, if it is empty, from the
+// detected encoding before they are hashed, so the same text uploaded in
+// different encodings is a duplicate. The charset is ignored for other
+// formats. A text detected as UTF-8 is checked
+// while it is stored, and converted again if it is not UTF-8 after the
+// sample. For formats other than plain text the
+// extracted text is stored next to the original under TextLocation.
+func (h *Handler) storeFile(content io.Reader, filename, documentID, courseID, uploader, charset string) (*FileMetadata, bool, error) {
+	filename = sanitizeFilename(filename)
+	limited := &limitedReader{r: content, remaining: h.maxUploadSize}
+	buffered := bufio.NewReaderSize(limited, encodingSampleSize)
+	sample, err := buffered.Peek(encodingSampleSize)
+	if err != nil && err != io.EOF {
+		return nil, false, fmt.Errorf("failed to read file: %w", err)
+	}
+	head := sample[:min(len(sample), sniffLength)]
+	mimeType := DetectMimeType(head, filename)
+
+	var encodingName string
+	var utf8Check *utf8Checker
+	reader := io.Reader(buffered)
+	if mimeType == "" {
+		// UTF-16 looks binary until it is decoded. The charset is not used
+		// here, so other binary files are unsupported whatever it says.
+		if enc, name, _ := DetectEncoding(sample, "", ""); strings.HasPrefix(name, "utf-16") {
+			decoded, _, _ := transform.Bytes(enc.NewDecoder(), head)
+			mimeType = DetectMimeType(decoded, filename)
+		}
+		if mimeType == "" {
+			return nil, false, errUnsupportedFormat
+		}
+	}
+	if isTextMimeType(mimeType) {
+		enc, name, err := DetectEncoding(sample, mimeType, charset)
+		if err != nil {
+			return nil, false, err
+		}
+		encodingName = name
+		if name == "utf-8" && charset == "" && !bytes.HasPrefix(sample, utf8BOM) {
+			// Valid UTF-8 needs no conversion, but only the sample was checked.
+			utf8Check = &utf8Checker{}
+		} else {
+			reader = transform.NewReader(buffered, xunicode.BOMOverride(enc.NewDecoder()))
+		}
+	}
+
+	id := uuid.New().String()
+	if documentID == "" {
+		documentID = id
+	}
+
+	// The location depends on the hash, so the content is streamed to a
+	// temporary blob first.
+	tmpLocation := "tmp/" + id
 	hash := sha256.New()
-	hash.Write(contentBytes)
+	lines := &lineCounter{}
+	writers := []io.Writer{hash, lines}
+	if utf8Check != nil {
+		writers = append(writers, utf8Check)
+	}
+	if err := h.blobs.Put(tmpLocation, io.TeeReader(reader, io.MultiWriter(writers...))); err != nil {
+		h.blobs.Delete(tmpLocation)
+		return nil, false, fmt.Errorf("failed to save file content: %w", err)
+	}
 	hashSum := hex.EncodeToString(hash.Sum(nil))
+	lineCount := lines.Count()
+	if utf8Check != nil && !utf8Check.Valid() {
+		encodingName, hashSum, lineCount, err = h.redecode(tmpLocation, mimeType, utf8Check.invalidAt)
+		if err != nil {
+			h.blobs.Delete(tmpLocation)
+			return nil, false, err
+		}
+	}
+
+	metadata := FileMetadata{
+		ID:         id,
+		DocumentID: documentID,
+		Name:       filename,
+		Hash:       hashSum,
+		Location:   contentLocation(hashSum),
+		MimeType:   mimeType,
+		Encoding:   encodingName,
+		LineCount:  lineCount,
+		Size:       h.maxUploadSize - limited.remaining,
+		Uploader:   uploader,
+		CourseID:   courseID,
+		CreatedAt:  time.Now().UTC(),
+	}
 
-	existingFile, err := h.repo.GetFileByHash(hashSum)
+	// The deletion worker checks whether a location is in use and deletes
+	// its blob under the same lock.
+	var file *FileMetadata
+	created := false
+	err = h.repo.LockLocation(metadata.Location, func() error {
+		var err error
+		file, created, err = h.saveFile(&metadata, tmpLocation)
+		return err
+	})
 	if err != nil {
-		http.Error(w, "Failed to check file existence", http.StatusInternalServerError)
-		return
+		return nil, false, err
 	}
+	return file, created, nil
+}
 
+// saveFile moves the content from tmpLocation to the location of the file
+// and saves the file. If the uploader already has a file with the same
+// content, that file is returned instead. If only others have one, the new
+// file shares its blobs, so nothing tells the uploader that they exist.
+func (h *Handler) saveFile(metadata *FileMetadata, tmpLocation string) (*FileMetadata, bool, error) {
+	existingFile, err := h.repo.GetFileByHash(metadata.Hash, metadata.Uploader)
+	if err != nil {
+		h.blobs.Delete(tmpLocation)
+		return nil, false, fmt.Errorf("failed to check file existence: %w", err)
+	}
 	if existingFile != nil {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"id": existingFile.ID})
-		return
+		h.blobs.Delete(tmpLocation)
+		if existingFile.Uploader == metadata.Uploader {
+			return existingFile, false, nil
+		}
+		metadata.TextLocation = existingFile.TextLocation
+		metadata.MimeType = existingFile.MimeType
+		metadata.LineCount = existingFile.LineCount
+		if err := h.repo.SaveFile(metadata); err != nil {
+			return nil, false, fmt.Errorf("failed to save file: %w", err)
+		}
+		return metadata, true, nil
 	}
 
-	id := uuid.New().String()
-	ext := filepath.Ext(header.Filename)
-	location := strings.TrimSuffix(header.Filename, ext) + "-" + time.Now().Format("20060102150405") + ext
+	location := metadata.Location
+	if err := h.blobs.Move(tmpLocation, location); err != nil {
+		h.blobs.Delete(tmpLocation)
+		return nil, false, fmt.Errorf("failed to save file content: %w", err)
+	}
 
-	metadata := FileMetadata{
-		ID:       id,
-		Name:     header.Filename,
-		Hash:     hashSum,
-		Location: location,
+	metadata.TextLocation = location
+	if metadata.MimeType != mimeText {
+		metadata.TextLocation = location + ".txt"
+		metadata.MimeType, metadata.LineCount, err = h.storeText(location, metadata.TextLocation, metadata.MimeType)
+		if err != nil {
+			h.blobs.Delete(location)
+			return nil, false, err
+		}
+	}
+
+	if err := h.repo.SaveFile(metadata); err != nil {
+		h.blobs.Delete(location)
+		if metadata.TextLocation != location {
+			h.blobs.Delete(metadata.TextLocation)
+		}
+		return nil, false, fmt.Errorf("failed to save file: %w", err)
+	}
+	return metadata, true, nil
+}
+
+// redecode converts a text stored as is because its sample was UTF-8 but
+// the rest is not. The encoding is detected again from the part where the
+// text stops being UTF-8, and the converted text replaces the stored one.
+// It returns the encoding, the hash and the number of lines of the
+// converted text.
+func (h *Handler) redecode(location, mimeType string, offset int64) (string, string, int, error) {
+	sample, err := h.readSample(location, offset)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to read file content: %w", err)
+	}
+	enc, name, err := DetectEncoding(sample, mimeType, "")
+	if err != nil {
+		return "", "", 0, err
+	}
+
+	blob, err := h.blobs.Get(location)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to read file content: %w", err)
+	}
+	defer blob.Close()
+
+	converted := location + ".converted"
+	hash := sha256.New()
+	lines := &lineCounter{}
+	text := io.TeeReader(transform.NewReader(blob, enc.NewDecoder()), io.MultiWriter(hash, lines))
+	if err := h.blobs.Put(converted, text); err != nil {
+		h.blobs.Delete(converted)
+		return "", "", 0, fmt.Errorf("failed to convert file from %s: %w", name, err)
+	}
+	if err := h.blobs.Move(converted, location); err != nil {
+		h.blobs.Delete(converted)
+		return "", "", 0, fmt.Errorf("failed to save file content: %w", err)
+	}
+	return name, hex.EncodeToString(hash.Sum(nil)), lines.Count(), nil
+}
+
+// readSample reads up to encodingSampleSize bytes of a blob from offset.
+func (h *Handler) readSample(location string, offset int64) ([]byte, error) {
+	blob, err := h.blobs.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	if _, err := io.CopyN(io.Discard, blob, offset); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(io.LimitReader(blob, encodingSampleSize))
+}
+
+// storeText extracts the text of the stored original and stores it under
+// textLocation. It returns the refined MIME type and the number of lines of
+// the text. Extraction needs the whole file, so the original is read back
+// into memory.
+func (h *Handler) storeText(location, textLocation, mimeType string) (string, int, error) {
+	blob, err := h.blobs.Get(location)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read file content: %w", err)
+	}
+	data, err := io.ReadAll(blob)
+	blob.Close()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read file content: %w", err)
+	}
+
+	text, mimeType, err := ExtractText(mimeType, data)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := h.blobs.Put(textLocation, strings.NewReader(text)); err != nil {
+		h.blobs.Delete(textLocation)
+		return "", 0, fmt.Errorf("failed to save extracted text: %w", err)
+	}
+	lines := &lineCounter{}
+	io.WriteString(lines, text)
+	return mimeType, lines.Count(), nil
+}
+
+// contentLocation is the blob key of a content with the given SHA-256 hash.
+// Keys are spread over directories by the first two hex digits.
+func contentLocation(hash string) string {
+	return "sha256/" + hash[:2] + "/" + hash
+}
+
+// maxFilenameLength is the longest display name kept, in bytes.
+const maxFilenameLength = 255
+
+// sanitizeFilename turns the file name sent by the client into a display
+// name: directories and control characters are dropped and the name is cut
+// to maxFilenameLength bytes.
+func sanitizeFilename(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." || name == "/" || name == "" {
+		return "file"
+	}
+	for len(name) > maxFilenameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+type UploadResponse struct {
+	ID         string `json:"id"`
+	DocumentID string `json:"document_id"`
+	Version    int    `json:"version"`
+}
+
+func newUploadResponse(file *FileMetadata) UploadResponse {
+	return UploadResponse{ID: file.ID, DocumentID: file.DocumentID, Version: file.Version}
+}
+
+// maxFieldSize limits the form fields sent along with the file.
+const maxFieldSize = 1 << 10
+
+// uploadForm returns the "file" part of a multipart request without reading
+// the parts that follow it, together with the form fields sent before it.
+// Fields that follow the file are ignored.
+func uploadForm(r *http.Request) (*multipart.Part, map[string]string, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == "file" && part.FileName() != "" {
+			return part, fields, nil
+		}
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(value) > maxFieldSize {
+				return nil, nil, fmt.Errorf("form field %q is too large", part.FormName())
+			}
+			fields[part.FormName()] = string(value)
+		}
+		part.Close()
+	}
+}
+
+// uploadError responds with 413 if the request or the file exceeded the size
+// limit, with 400 for an unknown charset, with 409 for content someone else
+// uploaded, with 415 for unsupported formats, with 422 if no text could be
+// extracted and with the given status otherwise.
+func (h *Handler) uploadError(w http.ResponseWriter, err error, message string, status int) {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errFileTooLarge) || errors.As(err, &maxBytesErr):
+		http.Error(w, fmt.Sprintf("File exceeds the maximum size of %d bytes", h.maxUploadSize), http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errUnknownCharset):
+		http.Error(w, "Unknown charset", http.StatusBadRequest)
+	case errors.Is(err, errUnsupportedFormat):
+		http.Error(w, "Unsupported file format. Supported formats: plain text, Markdown, HTML, RTF, PDF, DOCX and ODT", http.StatusUnsupportedMediaType)
+	case errors.Is(err, errExtractionFailed):
+		http.Error(w, "Failed to extract text from the file: "+err.Error(), http.StatusUnprocessableEntity)
+	case errors.Is(err, errUploadFinishing):
+		http.Error(w, "Upload is being stored by another request, retry later", http.StatusLocked)
+	default:
+		http.Error(w, message, status)
+	}
+}
+
+// limitedReader fails with errFileTooLarge once more than remaining bytes
+// have been read, unlike io.LimitReader, which silently truncates.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errFileTooLarge
+	}
+	return n, err
+}
+
+// lineCounter counts the lines of the text written to it. A last line
+// without a line break counts as well.
+type lineCounter struct {
+	lines   int
+	partial bool
+}
+
+func (c *lineCounter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.lines += bytes.Count(p, []byte{'\n'})
+		c.partial = p[len(p)-1] != '\n'
+	}
+	return len(p), nil
+}
+
+func (c *lineCounter) Count() int {
+	if c.partial {
+		return c.lines + 1
+	}
+	return c.lines
+}
+
+// File serves a single file: GET returns its metadata, DELETE removes it.
+// GET /files/{id}/content returns the file as uploaded (text files in
+// UTF-8) and GET /files/{id}/text the text the analysis is based on.
+func (h *Handler) File(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/files/"), "/")
+	switch {
+	case resource == "" && r.Method == http.MethodDelete:
+		h.DeleteFile(w, r)
+	case resource == "":
+		h.GetFile(w, r)
+	case resource == "content" || resource == "text":
+		h.getFileContent(w, r, id, resource == "text")
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// DeleteFile removes the file metadata right away. The blob and everything
+// the analysis service stored about the file are removed afterwards by the
+// DeletionWorker, which retries until the analysis service is reachable.
+func (h *Handler) DeleteFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !principalFrom(r).Unrestricted() {
+		http.Error(w, "Only admins may delete files", http.StatusForbidden)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/files/")
+	if id == "" {
+		http.Error(w, "File ID is required", http.StatusBadRequest)
+		return
 	}
 
-	fileID, err := h.repo.SaveFile(metadata, content)
+	deleted, err := h.repo.DeleteFile(id)
 	if err != nil {
-		http.Error(w, "Failed to save file", http.StatusInternalServerError)
+		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
+		return
+	}
+	if !deleted {
+		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"id": fileID})
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (h *Handler) GetFile(w http.ResponseWriter, r *http.Request) {
@@ -102,36 +553,65 @@ func (h *Handler) GetFile(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
+	if !principalFrom(r).CanRead(file) {
+		http.Error(w, "Access to the file denied", http.StatusForbidden)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(file)
 }
 
-func (h *Handler) GetFileContent(w http.ResponseWriter, r *http.Request) {
+// getFileContent streams the original file or, with text set, its text.
+// Blob locations are internal and never appear in the URL.
+func (h *Handler) getFileContent(w http.ResponseWriter, r *http.Request, id string, text bool) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	location := strings.TrimPrefix(r.URL.Path, "/files/content/")
-	if location == "" {
-		http.Error(w, "File location is required", http.StatusBadRequest)
+	file, err := h.repo.GetFile(id)
+	if err != nil {
+		http.Error(w, "Failed to get file", http.StatusInternalServerError)
 		return
 	}
-
-	content, err := h.repo.GetFileContent(location)
-	if err != nil {
-		http.Error(w, "Failed to get file content", http.StatusInternalServerError)
+	if file == nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if !principalFrom(r).CanRead(file) {
+		http.Error(w, "Access to the file denied", http.StatusForbidden)
 		return
 	}
 
-	if content == "" {
+	location, contentType := file.Location, file.MimeType
+	if text {
+		location, contentType = file.TextLocation, mimeText
+	}
+	switch {
+	case contentType == "":
+		// Files uploaded before formats were recorded.
+		contentType = "application/octet-stream"
+	case isTextMimeType(contentType):
+		contentType += "; charset=utf-8"
+	}
+
+	content, err := h.blobs.Get(location)
+	if errors.Is(err, ErrBlobNotFound) {
 		http.Error(w, "File content not found", http.StatusNotFound)
 		return
 	}
+	if err != nil {
+		http.Error(w, "Failed to get file content", http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
 
-	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Type", contentType)
+	if !text {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(content))
+	io.Copy(w, content)
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// sortColumns maps the values of the "sort" parameter to columns. Only these
+// columns ever get into the ORDER BY clause.
+var sortColumns = map[string]string{
+	"name": "name",
+	"date": "created_at",
+	"size": "size_bytes",
+}
+
+// FileQuery selects one page of the file listing. From is inclusive and To
+// is exclusive.
+type FileQuery struct {
+	Name     string
+	Uploader string
+	From     time.Time
+	To       time.Time
+	Sort     string
+	Desc     bool
+	Limit    int
+	After    *Cursor
+	// Access limits the listing to the files the caller may see.
+	Access *FileAccess
+}
+
+// Cursor points at the last file of the previous page. It is handed to
+// clients as an opaque base64 string.
+type Cursor struct {
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+func cursorFor(file FileMetadata, sort string) Cursor {
+	switch sort {
+	case "name":
+		return Cursor{Value: file.Name, ID: file.ID}
+	case "size":
+		return Cursor{Value: strconv.FormatInt(file.Size, 10), ID: file.ID}
+	}
+	return Cursor{Value: file.CreatedAt.Format(time.RFC3339Nano), ID: file.ID}
+}
+
+func (c Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func DecodeCursor(s string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c Cursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &c, nil
+}
+
+// sortValue converts the cursor value to the type of the sort column.
+func (c Cursor) sortValue(sort string) (any, error) {
+	switch sort {
+	case "name":
+		return c.Value, nil
+	case "size":
+		size, err := strconv.ParseInt(c.Value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+		return size, nil
+	}
+	createdAt, err := time.Parse(time.RFC3339Nano, c.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return createdAt, nil
+}
+
+// ParseFileQuery reads the listing parameters: "name" (substring), "owner",
+// "from" and "to" (RFC 3339 time or a date; a date in "to" includes the
+// whole day), "sort" (name, date or size; date by default), "order" (asc or
+// desc; newest first by default), "limit" and "cursor".
+func ParseFileQuery(values url.Values) (FileQuery, error) {
+	query := FileQuery{
+		Name:     values.Get("name"),
+		Uploader: values.Get("owner"),
+		Sort:     "date",
+		Desc:     true,
+		Limit:    defaultPageSize,
+	}
+
+	if sort := values.Get("sort"); sort != "" {
+		if _, ok := sortColumns[sort]; !ok {
+			return query, fmt.Errorf("unknown sort %q", sort)
+		}
+		query.Sort = sort
+		query.Desc = false
+	}
+
+	switch order := values.Get("order"); order {
+	case "":
+	case "asc":
+		query.Desc = false
+	case "desc":
+		query.Desc = true
+	default:
+		return query, fmt.Errorf("unknown order %q", order)
+	}
+
+	var err error
+	if query.From, err = parseTime(values.Get("from"), false); err != nil {
+		return query, fmt.Errorf("invalid from: %v", err)
+	}
+	if query.To, err = parseTime(values.Get("to"), true); err != nil {
+		return query, fmt.Errorf("invalid to: %v", err)
+	}
+
+	if value := values.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return query, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		query.Limit = limit
+	}
+
+	if value := values.Get("cursor"); value != "" {
+		if query.After, err = DecodeCursor(value); err != nil {
+			return query, err
+		}
+		if _, err := query.After.sortValue(query.Sort); err != nil {
+			return query, err
+		}
+	}
+
+	return query, nil
+}
+
+func parseTime(value string, endOfDay bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expected RFC 3339 time or YYYY-MM-DD date")
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+type FileListResponse struct {
+	Files      []FileMetadata `json:"files"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+func (h *Handler) ListFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query, err := ParseFileQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Access = principalFrom(r).Access()
+
+	// One extra file tells whether there is a next page.
+	limit := query.Limit
+	query.Limit++
+	files, err := h.repo.ListFiles(query)
+	if err != nil {
+		http.Error(w, "Failed to list files", http.StatusInternalServerError)
+		return
+	}
+
+	response := FileListResponse{Files: files}
+	if len(files) > limit {
+		response.Files = files[:limit]
+		response.NextCursor = cursorFor(files[limit-1], query.Sort).Encode()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,18 +1,53 @@
 package main
 
 import (
+	"context"
+	"database/sql"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 )
 
 func main() {
-	repo := NewPostgresRepository()
-	handler := NewHandler(repo)
+	db := ConnectDB()
 
-	http.HandleFunc("/files", handler.UploadFile)
-	http.HandleFunc("/files/", handler.GetFile)
-	http.HandleFunc("/files/content/", handler.GetFileContent)
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(db, os.Args[2:])
+		return
+	}
+
+	blobs, err := NewBlobStore(os.Getenv("BLOB_STORE"), db)
+	if err != nil {
+		log.Fatalf("Failed to open blob store: %v", err)
+	}
+
+	maxUploadSize := int64(DefaultMaxUploadSize)
+	if value := os.Getenv("MAX_UPLOAD_SIZE"); value != "" {
+		maxUploadSize, err = strconv.ParseInt(value, 10, 64)
+		if err != nil || maxUploadSize <= 0 {
+			log.Fatalf("Invalid MAX_UPLOAD_SIZE %q", value)
+		}
+	}
+
+	serviceToken = os.Getenv("SERVICE_TOKEN")
+	if serviceToken == "" {
+		log.Println("SERVICE_TOKEN is not set, requests from other services are rejected")
+	}
+
+	repo := NewPostgresRepository(db)
+	handler := NewHandler(repo, blobs, maxUploadSize)
+
+	analysis := NewAnalysisNotifier(getEnv("FILE_ANALYSIS_SERVICE_URL", "http://file-analysis-service:8082"), serviceToken)
+	go NewDeletionWorker(repo, blobs, analysis).Run(context.Background())
+	go handler.RunUploadExpiry(context.Background())
+
+	http.HandleFunc("/files", requireIdentity(handler.Files))
+	http.HandleFunc("/files/", requireIdentity(handler.File))
+	http.HandleFunc("/documents/", requireIdentity(handler.Document))
+	http.HandleFunc("/uploads", requireIdentity(handler.Uploads))
+	http.HandleFunc("/uploads/", requireIdentity(handler.Upload))
 	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
@@ -26,3 +61,35 @@ func main() {
 	log.Printf("File Storing Service is running on :%s", port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
+
+// migrate moves file contents between blob stores:
+//
+//	file-storing-service migrate -from postgres -to s3 [-delete]
+//
+// Switch BLOB_STORE to the target backend once it has finished.
+func migrate(db *sql.DB, args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "postgres", "source blob store: postgres, fs or s3")
+	to := flags.String("to", "", "target blob store: postgres, fs or s3")
+	deleteSource := flags.Bool("delete", false, "delete blobs from the source after copying")
+	flags.Parse(args)
+
+	if *to == "" || *to == *from {
+		log.Fatal("-to must name a blob store different from -from")
+	}
+
+	source, err := NewBlobStore(*from, db)
+	if err != nil {
+		log.Fatalf("Failed to open source blob store: %v", err)
+	}
+	target, err := NewBlobStore(*to, db)
+	if err != nil {
+		log.Fatalf("Failed to open target blob store: %v", err)
+	}
+
+	moved, err := MigrateBlobs(source, target, *deleteSource)
+	if err != nil {
+		log.Fatalf("Migration stopped after %d blobs: %v", moved, err)
+	}
+	log.Printf("Migrated %d blobs from %s to %s", moved, *from, *to)
+}
@@ -4,34 +4,68 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 type FileMetadata struct {
-	ID       string `json:"id"`
-	Name     string `json:"name"`
-	Hash     string `json:"hash"`
-	Location string `json:"location"`
-}
-
-type FileContent struct {
-	Location string `json:"location"`
-	Content  string `json:"content"`
+	ID         string `json:"id"`
+	DocumentID string `json:"document_id"`
+	Version    int    `json:"version"`
+	Name       string `json:"name"`
+	Hash       string `json:"hash"`
+	Location   string `json:"location"`
+	// TextLocation points at the text extracted from the original, which
+	// is what the analysis service reads. For plain text files it is the
+	// same blob as Location.
+	TextLocation string `json:"text_location"`
+	// MimeType is the format detected from the content.
+	MimeType string `json:"mime_type"`
+	// Encoding is the encoding a text file was converted to UTF-8 from.
+	Encoding string `json:"encoding,omitempty"`
+	// LineCount is the number of lines of the text at TextLocation.
+	LineCount int    `json:"line_count"`
+	Size      int64  `json:"size_bytes"`
+	Uploader  string `json:"uploader,omitempty"`
+	// CourseID is the course the file was submitted to. Teachers of the
+	// course may see it.
+	CourseID  string    `json:"course_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Repository interface {
-	GetFileByHash(hash string) (*FileMetadata, error)
-	SaveFile(metadata FileMetadata, content string) (string, error)
+	GetFileByHash(hash, uploader string) (*FileMetadata, error)
+	SaveFile(metadata *FileMetadata) error
 	GetFile(id string) (*FileMetadata, error)
-	GetFileContent(location string) (string, error)
+	ListVersions(documentID string) ([]FileMetadata, error)
+	GetVersion(documentID string, version int) (*FileMetadata, error)
+	ListFiles(query FileQuery) ([]FileMetadata, error)
+	DeleteFile(id string) (bool, error)
+	LocationInUse(location string) (bool, error)
+	LockLocation(location string, fn func() error) error
+	ClaimDeletion(lease time.Duration) (*Deletion, error)
+	MarkBlobDeleted(fileID string) error
+	CompleteDeletion(fileID string) error
+	RetryDeletion(fileID string, errMsg string, runAt time.Time) error
+	// CreateUpload saves the upload and returns it, or returns the upload
+	// the uploader created earlier with the same idempotency key.
+	CreateUpload(upload Upload) (*Upload, error)
+	GetUpload(id string) (*Upload, error)
+	AppendChunk(id string, offset, newOffset int64, key string, expiresAt time.Time) (bool, error)
+	ClaimUploadCompletion(id string, lease time.Duration) (bool, error)
+	ReleaseUploadCompletion(id string) error
+	CompleteUpload(id, fileID string, expiresAt time.Time) error
+	DeleteUpload(id string) error
+	ExpiredUploads(now time.Time) ([]Upload, error)
 }
 
 type PostgresRepository struct {
 	db *sql.DB
 }
 
-func NewPostgresRepository() *PostgresRepository {
+func ConnectDB() *sql.DB {
 	connStr := fmt.Sprintf(
 		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
 		os.Getenv("DB_HOST"),
@@ -51,37 +85,109 @@ func NewPostgresRepository() *PostgresRepository {
 		panic(err)
 	}
 
-	_, err = db.Exec(`
+	return db
+}
+
+// NewPostgresRepository keeps file metadata only. Contents are kept by the
+// configured BlobStore under the file location.
+func NewPostgresRepository(db *sql.DB) *PostgresRepository {
+	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS file_metadata (
 			id TEXT PRIMARY KEY,
 			name TEXT NOT NULL,
-			hash TEXT NOT NULL UNIQUE,
-			location TEXT NOT NULL UNIQUE
+			hash TEXT NOT NULL,
+			location TEXT NOT NULL
 		)
 	`)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS file_content (
-			location TEXT PRIMARY KEY,
-			content TEXT NOT NULL
-		)
-	`)
-	if err != nil {
-		panic(err)
+	for _, migration := range []string{
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS size_bytes BIGINT NOT NULL DEFAULT 0",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS uploader TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now()",
+		"CREATE INDEX IF NOT EXISTS file_metadata_name_idx ON file_metadata (name, id)",
+		"CREATE INDEX IF NOT EXISTS file_metadata_created_at_idx ON file_metadata (created_at, id)",
+		"CREATE INDEX IF NOT EXISTS file_metadata_size_idx ON file_metadata (size_bytes, id)",
+		// Files uploaded before versioning become the first version of a
+		// document of their own.
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS document_id TEXT",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1",
+		"UPDATE file_metadata SET document_id = id WHERE document_id IS NULL",
+		"ALTER TABLE file_metadata ALTER COLUMN document_id SET NOT NULL",
+		"CREATE UNIQUE INDEX IF NOT EXISTS file_metadata_document_version_idx ON file_metadata (document_id, version)",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS text_location TEXT NOT NULL DEFAULT ''",
+		"UPDATE file_metadata SET text_location = location WHERE text_location = ''",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS encoding TEXT NOT NULL DEFAULT ''",
+		// Before text extraction every file was plain text.
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS mime_type TEXT NOT NULL DEFAULT ''",
+		"UPDATE file_metadata SET mime_type = 'text/plain' WHERE mime_type = '' AND text_location = location",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS line_count INTEGER NOT NULL DEFAULT 0",
+		"ALTER TABLE file_metadata ADD COLUMN IF NOT EXISTS course_id TEXT NOT NULL DEFAULT ''",
+		"CREATE INDEX IF NOT EXISTS file_metadata_uploader_idx ON file_metadata (uploader)",
+		"CREATE INDEX IF NOT EXISTS file_metadata_course_idx ON file_metadata (course_id)",
+		// Every uploader of the same content gets a file of their own, and
+		// the files share the blob.
+		"ALTER TABLE file_metadata DROP CONSTRAINT IF EXISTS file_metadata_hash_key",
+		"ALTER TABLE file_metadata DROP CONSTRAINT IF EXISTS file_metadata_location_key",
+		"CREATE UNIQUE INDEX IF NOT EXISTS file_metadata_hash_uploader_idx ON file_metadata (hash, uploader)",
+		"CREATE INDEX IF NOT EXISTS file_metadata_location_idx ON file_metadata (location)",
+		`CREATE TABLE IF NOT EXISTS file_deletions (
+			file_id TEXT PRIMARY KEY,
+			location TEXT NOT NULL,
+			blob_deleted BOOLEAN NOT NULL DEFAULT false,
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			run_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`,
+		"ALTER TABLE file_deletions ADD COLUMN IF NOT EXISTS text_location TEXT NOT NULL DEFAULT ''",
+		`CREATE TABLE IF NOT EXISTS uploads (
+			id TEXT PRIMARY KEY,
+			upload_length BIGINT NOT NULL,
+			upload_offset BIGINT NOT NULL DEFAULT 0,
+			filename TEXT NOT NULL,
+			document_id TEXT NOT NULL DEFAULT '',
+			uploader TEXT NOT NULL DEFAULT '',
+			chunks TEXT[] NOT NULL DEFAULT '{}',
+			file_id TEXT NOT NULL DEFAULT '',
+			expires_at TIMESTAMPTZ NOT NULL
+		)`,
+		"ALTER TABLE uploads ADD COLUMN IF NOT EXISTS charset TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE uploads ADD COLUMN IF NOT EXISTS course_id TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE uploads ADD COLUMN IF NOT EXISTS idempotency_key TEXT NOT NULL DEFAULT ''",
+		"ALTER TABLE uploads ADD COLUMN IF NOT EXISTS finishing_until TIMESTAMPTZ",
+		`CREATE UNIQUE INDEX IF NOT EXISTS uploads_idempotency_key_idx
+			ON uploads (uploader, idempotency_key) WHERE idempotency_key <> ''`,
+	} {
+		if _, err := db.Exec(migration); err != nil {
+			panic(err)
+		}
 	}
 
 	return &PostgresRepository{db: db}
 }
 
-func (r *PostgresRepository) GetFileByHash(hash string) (*FileMetadata, error) {
+const fileColumns = "id, document_id, version, name, hash, location, text_location, mime_type, encoding, line_count, size_bytes, uploader, course_id, created_at"
+
+func scanFile(row interface{ Scan(...any) error }) (*FileMetadata, error) {
 	var file FileMetadata
-	err := r.db.QueryRow(
-		"SELECT id, name, hash, location FROM file_metadata WHERE hash = $1",
-		hash,
-	).Scan(&file.ID, &file.Name, &file.Hash, &file.Location)
+	err := row.Scan(&file.ID, &file.DocumentID, &file.Version, &file.Name, &file.Hash,
+		&file.Location, &file.TextLocation, &file.MimeType, &file.Encoding, &file.LineCount,
+		&file.Size, &file.Uploader, &file.CourseID, &file.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &file, nil
+}
+
+// GetFileByHash returns a file with the given content, preferring the one
+// uploaded by uploader.
+func (r *PostgresRepository) GetFileByHash(hash, uploader string) (*FileMetadata, error) {
+	file, err := scanFile(r.db.QueryRow(
+		"SELECT "+fileColumns+" FROM file_metadata WHERE hash = $1 ORDER BY uploader = $2 DESC LIMIT 1",
+		hash, uploader,
+	))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -90,47 +196,88 @@ func (r *PostgresRepository) GetFileByHash(hash string) (*FileMetadata, error) {
 		return nil, err
 	}
 
-	return &file, nil
+	return file, nil
 }
 
-func (r *PostgresRepository) SaveFile(metadata FileMetadata, content string) (string, error) {
+// SaveFile stores the file as the next version of its document and sets
+// metadata.Version. Uploads to the same document are serialized by an
+// advisory lock, so concurrent uploads get consecutive versions.
+func (r *PostgresRepository) SaveFile(metadata *FileMetadata) error {
 	tx, err := r.db.Begin()
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer tx.Rollback()
 
-	_, err = tx.Exec(
-		"INSERT INTO file_metadata (id, name, hash, location) VALUES ($1, $2, $3, $4)",
-		metadata.ID, metadata.Name, metadata.Hash, metadata.Location,
-	)
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext($1))", metadata.DocumentID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO file_metadata (id, document_id, version, name, hash, location, text_location,
+			mime_type, encoding, line_count, size_bytes, uploader, course_id, created_at)
+		SELECT $1, $2, COALESCE(MAX(version), 0) + 1, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13
+		FROM file_metadata WHERE document_id = $2
+		RETURNING version`,
+		metadata.ID, metadata.DocumentID, metadata.Name, metadata.Hash, metadata.Location,
+		metadata.TextLocation, metadata.MimeType, metadata.Encoding, metadata.LineCount, metadata.Size,
+		metadata.Uploader, metadata.CourseID, metadata.CreatedAt,
+	).Scan(&metadata.Version)
 	if err != nil {
-		tx.Rollback()
-		return "", err
+		return err
 	}
 
-	_, err = tx.Exec(
-		"INSERT INTO file_content (location, content) VALUES ($1, $2)",
-		metadata.Location, content,
-	)
+	return tx.Commit()
+}
+
+func (r *PostgresRepository) GetFile(id string) (*FileMetadata, error) {
+	file, err := scanFile(r.db.QueryRow(
+		"SELECT "+fileColumns+" FROM file_metadata WHERE id = $1",
+		id,
+	))
+
 	if err != nil {
-		tx.Rollback()
-		return "", err
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	err = tx.Commit()
+	return file, nil
+}
+
+// ListVersions returns the versions of a document, oldest first.
+func (r *PostgresRepository) ListVersions(documentID string) ([]FileMetadata, error) {
+	rows, err := r.db.Query(
+		"SELECT "+fileColumns+" FROM file_metadata WHERE document_id = $1 ORDER BY version",
+		documentID,
+	)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	defer rows.Close()
 
-	return metadata.ID, nil
+	var files []FileMetadata
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, *file)
+	}
+
+	return files, rows.Err()
 }
 
-func (r *PostgresRepository) GetFile(id string) (*FileMetadata, error) {
-	var file FileMetadata
-	err := r.db.QueryRow(
-		"SELECT id, name, hash, location FROM file_metadata WHERE id = $1",
-		id,
-	).Scan(&file.ID, &file.Name, &file.Hash, &file.Location)
+// GetVersion returns the given version of a document, or its latest version
+// if version is 0.
+func (r *PostgresRepository) GetVersion(documentID string, version int) (*FileMetadata, error) {
+	file, err := scanFile(r.db.QueryRow(
+		"SELECT "+fileColumns+` FROM file_metadata
+		WHERE document_id = $1 AND ($2 = 0 OR version = $2)
+		ORDER BY version DESC LIMIT 1`,
+		documentID, version,
+	))
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -139,22 +286,310 @@ func (r *PostgresRepository) GetFile(id string) (*FileMetadata, error) {
 		return nil, err
 	}
 
-	return &file, nil
+	return file, nil
 }
 
-func (r *PostgresRepository) GetFileContent(location string) (string, error) {
-	var content string
-	err := r.db.QueryRow(
-		"SELECT content FROM file_content WHERE location = $1",
-		location,
-	).Scan(&content)
+// ListFiles returns one page of files. The page after a cursor is selected
+// by comparing the (sort column, id) pair, so it stays stable while files are
+// uploaded concurrently.
+func (r *PostgresRepository) ListFiles(query FileQuery) ([]FileMetadata, error) {
+	column := sortColumns[query.Sort]
+
+	var (
+		conditions []string
+		args       []any
+	)
+	arg := func(value any) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if query.Name != "" {
+		conditions = append(conditions, "name ILIKE '%' || "+arg(escapeLike(query.Name))+" || '%'")
+	}
+	if query.Uploader != "" {
+		conditions = append(conditions, "uploader = "+arg(query.Uploader))
+	}
+	if query.Access != nil {
+		visible := "uploader = " + arg(query.Access.UserID)
+		if len(query.Access.Courses) > 0 {
+			visible = "(" + visible + " OR course_id = ANY(" + arg(pq.Array(query.Access.Courses)) + "))"
+		}
+		conditions = append(conditions, visible)
+	}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(query.From))
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "created_at < "+arg(query.To))
+	}
+	if query.After != nil {
+		op := ">"
+		if query.Desc {
+			op = "<"
+		}
+		value, err := query.After.sortValue(query.Sort)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s (%s, %s)", column, op, arg(value), arg(query.After.ID)))
+	}
+
+	statement := "SELECT " + fileColumns + " FROM file_metadata"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	direction := "ASC"
+	if query.Desc {
+		direction = "DESC"
+	}
+	statement += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT %s", column, direction, direction, arg(query.Limit))
 
+	rows, err := r.db.Query(statement, args...)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return "", nil
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := []FileMetadata{}
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
 		}
-		return "", err
+		files = append(files, *file)
+	}
+
+	return files, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// DeleteFile removes the metadata and records the deletion for the
+// DeletionWorker in the same transaction. It reports false for unknown files.
+func (r *PostgresRepository) DeleteFile(id string) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var location, textLocation string
+	err = tx.QueryRow(
+		"DELETE FROM file_metadata WHERE id = $1 RETURNING location, text_location", id,
+	).Scan(&location, &textLocation)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, err = tx.Exec(
+		"INSERT INTO file_deletions (file_id, location, text_location) VALUES ($1, $2, $3) ON CONFLICT (file_id) DO NOTHING",
+		id, location, textLocation,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// LocationInUse reports whether a file still refers to the blob.
+func (r *PostgresRepository) LocationInUse(location string) (bool, error) {
+	var inUse bool
+	err := r.db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM file_metadata WHERE location = $1)", location,
+	).Scan(&inUse)
+	return inUse, err
+}
+
+// locationLockClass is the first key of the advisory locks on blob
+// locations, which keeps them apart from the locks on documents.
+const locationLockClass = 1
+
+// LockLocation runs fn while holding an advisory lock on the blob location.
+// Uploads store their blob and file under it, and the deletion worker
+// checks LocationInUse and deletes the blob under it, so a blob is never
+// deleted for a file that is being saved.
+func (r *PostgresRepository) LockLocation(location string, fn func() error) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1, hashtext($2))", locationLockClass, location); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ClaimDeletion takes the next due deletion and postpones it by the lease,
+// so it is picked up again if the worker dies while processing it.
+func (r *PostgresRepository) ClaimDeletion(lease time.Duration) (*Deletion, error) {
+	var d Deletion
+	err := r.db.QueryRow(`
+		UPDATE file_deletions
+		SET attempts = attempts + 1,
+			run_at = now() + make_interval(secs => $1)
+		WHERE file_id = (
+			SELECT file_id FROM file_deletions
+			WHERE run_at <= now()
+			ORDER BY run_at
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING file_id, location, text_location, blob_deleted, attempts`,
+		lease.Seconds(),
+	).Scan(&d.FileID, &d.Location, &d.TextLocation, &d.BlobDeleted, &d.Attempts)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (r *PostgresRepository) MarkBlobDeleted(fileID string) error {
+	_, err := r.db.Exec("UPDATE file_deletions SET blob_deleted = true WHERE file_id = $1", fileID)
+	return err
+}
+
+func (r *PostgresRepository) CompleteDeletion(fileID string) error {
+	_, err := r.db.Exec("DELETE FROM file_deletions WHERE file_id = $1", fileID)
+	return err
+}
+
+func (r *PostgresRepository) RetryDeletion(fileID string, errMsg string, runAt time.Time) error {
+	_, err := r.db.Exec(
+		"UPDATE file_deletions SET last_error = $2, run_at = $3 WHERE file_id = $1",
+		fileID, errMsg, runAt,
+	)
+	return err
+}
+
+func (r *PostgresRepository) CreateUpload(upload Upload) (*Upload, error) {
+	result, err := r.db.Exec(`
+		INSERT INTO uploads (id, upload_length, filename, document_id, course_id, uploader, charset, idempotency_key, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (uploader, idempotency_key) WHERE idempotency_key <> '' DO NOTHING`,
+		upload.ID, upload.Length, upload.Filename, upload.DocumentID, upload.CourseID, upload.Uploader, upload.Charset, upload.IdempotencyKey, upload.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 1 {
+		return &upload, err
+	}
+	existing, err := scanUpload(r.db.QueryRow(
+		"SELECT "+uploadColumns+" FROM uploads WHERE uploader = $1 AND idempotency_key = $2",
+		upload.Uploader, upload.IdempotencyKey,
+	))
+	if err == sql.ErrNoRows {
+		// The earlier upload expired in the meantime.
+		return r.CreateUpload(upload)
+	}
+	return existing, err
+}
+
+const uploadColumns = "id, upload_length, upload_offset, filename, document_id, course_id, uploader, charset, idempotency_key, chunks, file_id, expires_at"
+
+func scanUpload(row interface{ Scan(...any) error }) (*Upload, error) {
+	var u Upload
+	err := row.Scan(&u.ID, &u.Length, &u.Offset, &u.Filename, &u.DocumentID, &u.CourseID,
+		&u.Uploader, &u.Charset, &u.IdempotencyKey, pq.Array(&u.Chunks), &u.FileID, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *PostgresRepository) GetUpload(id string) (*Upload, error) {
+	upload, err := scanUpload(r.db.QueryRow("SELECT "+uploadColumns+" FROM uploads WHERE id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return upload, err
+}
+
+// AppendChunk adds a chunk and moves the offset forward if the upload is
+// still at the given offset. It reports false if another request got there
+// first.
+func (r *PostgresRepository) AppendChunk(id string, offset, newOffset int64, key string, expiresAt time.Time) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE uploads
+		SET upload_offset = $3, chunks = array_append(chunks, $4), expires_at = $5
+		WHERE id = $1 AND upload_offset = $2`,
+		id, offset, newOffset, key, expiresAt,
+	)
+	if err != nil {
+		return false, err
 	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// ClaimUploadCompletion reserves an upload that has not become a file yet
+// for the request that stores it, for the lease. It reports false if
+// another request holds the reservation or the file is already stored. A
+// request that dies while storing loses the reservation with the lease.
+func (r *PostgresRepository) ClaimUploadCompletion(id string, lease time.Duration) (bool, error) {
+	result, err := r.db.Exec(`
+		UPDATE uploads SET finishing_until = now() + make_interval(secs => $2)
+		WHERE id = $1 AND file_id = '' AND (finishing_until IS NULL OR finishing_until < now())`,
+		id, lease.Seconds(),
+	)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	return rows == 1, err
+}
+
+// ReleaseUploadCompletion gives up the reservation after storing failed, so
+// the client can retry at once.
+func (r *PostgresRepository) ReleaseUploadCompletion(id string) error {
+	_, err := r.db.Exec("UPDATE uploads SET finishing_until = NULL WHERE id = $1", id)
+	return err
+}
 
-	return content, nil
+// CompleteUpload records the file an upload became. The upload is kept
+// until it expires, so clients can still ask for its status.
+func (r *PostgresRepository) CompleteUpload(id, fileID string, expiresAt time.Time) error {
+	_, err := r.db.Exec(
+		"UPDATE uploads SET file_id = $2, chunks = '{}', expires_at = $3 WHERE id = $1",
+		id, fileID, expiresAt,
+	)
+	return err
+}
+
+func (r *PostgresRepository) DeleteUpload(id string) error {
+	_, err := r.db.Exec("DELETE FROM uploads WHERE id = $1", id)
+	return err
+}
+
+func (r *PostgresRepository) ExpiredUploads(now time.Time) ([]Upload, error) {
+	rows, err := r.db.Query("SELECT "+uploadColumns+" FROM uploads WHERE expires_at < $1", now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uploads []Upload
+	for rows.Next() {
+		upload, err := scanUpload(rows)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, *upload)
+	}
+	return uploads, rows.Err()
 }
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errUploadFinishing is returned while another request stores the upload.
+var errUploadFinishing = errors.New("upload is being stored by another request")
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,expiration"
+
+	// uploadTTL is how long an upload is kept after its last change.
+	uploadTTL            = 24 * time.Hour
+	uploadExpiryInterval = time.Hour
+	// uploadFinishLease is how long a request that stores a complete
+	// upload as a file keeps others from doing the same.
+	uploadFinishLease = 5 * time.Minute
+
+	// forwardedPrefixHeader carries the path prefix under which the gateway
+	// exposes the service, so Location points at the gateway.
+	forwardedPrefixHeader = "X-Forwarded-Prefix"
+
+	// fileIDHeader tells the client which file a finished upload became.
+	fileIDHeader = "X-File-ID"
+
+	// idempotencyKeyHeader identifies a creation request the client or the
+	// gateway may send more than once.
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+// Upload is a resumable upload in the tus protocol. Every PATCH request is
+// stored as a separate chunk blob, so the upload survives restarts and can
+// be continued on any replica. Once all bytes have arrived, the chunks are
+// stored as a file in the same way as a multipart upload and deleted.
+type Upload struct {
+	ID         string
+	Length     int64
+	Offset     int64
+	Filename   string
+	DocumentID string
+	CourseID   string
+	Uploader   string
+	Charset    string
+	Chunks     []string
+	FileID     string
+	ExpiresAt  time.Time
+	// IdempotencyKey is the Idempotency-Key of the creation request, so a
+	// repeated request gets the same upload.
+	IdempotencyKey string
+}
+
+// Uploads serves the /uploads collection: OPTIONS describes the server and
+// POST creates an upload.
+func (h *Handler) Uploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	switch r.Method {
+	case http.MethodOptions:
+		h.uploadOptions(w)
+	case http.MethodPost:
+		if tusVersionMismatch(w, r) {
+			return
+		}
+		h.createUpload(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Upload serves a single upload: HEAD returns its offset, PATCH appends a
+// chunk at the offset and DELETE cancels it.
+func (h *Handler) Upload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		h.uploadOptions(w)
+		return
+	}
+	if tusVersionMismatch(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead, http.MethodPatch, http.MethodDelete:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload := h.loadUpload(w, r)
+	if upload == nil {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Cache-Control", "no-store")
+		writeUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		h.patchUpload(w, r, upload)
+	case http.MethodDelete:
+		if err := h.repo.DeleteUpload(upload.ID); err != nil {
+			http.Error(w, "Failed to delete upload", http.StatusInternalServerError)
+			return
+		}
+		h.deleteChunks(upload.Chunks)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (h *Handler) uploadOptions(w http.ResponseWriter) {
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(h.maxUploadSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusVersionMismatch(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get("Tus-Resumable") == tusVersion {
+		return false
+	}
+	w.Header().Set("Tus-Version", tusVersion)
+	http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+	return true
+}
+
+func (h *Handler) createUpload(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > h.maxUploadSize {
+		http.Error(w, fmt.Sprintf("File exceeds the maximum size of %d bytes", h.maxUploadSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+	if filename == "" {
+		http.Error(w, "Upload-Metadata must contain filename", http.StatusBadRequest)
+		return
+	}
+	documentID := metadata["document_id"]
+	if documentID != "" && !validDocumentID(documentID) {
+		http.Error(w, "Invalid document_id", http.StatusBadRequest)
+		return
+	}
+	charset := metadata["charset"]
+	if charset != "" {
+		if _, _, err := lookupCharset(charset); err != nil {
+			http.Error(w, "Unknown charset", http.StatusBadRequest)
+			return
+		}
+	}
+	principal := principalFrom(r)
+	if !h.checkUpload(w, principal, metadata["course_id"], documentID) {
+		return
+	}
+
+	requested := Upload{
+		ID:             uuid.New().String(),
+		Length:         length,
+		Filename:       filename,
+		DocumentID:     documentID,
+		CourseID:       metadata["course_id"],
+		Uploader:       r.Header.Get(uploaderHeader),
+		Charset:        charset,
+		IdempotencyKey: r.Header.Get(idempotencyKeyHeader),
+		ExpiresAt:      time.Now().Add(uploadTTL),
+	}
+	upload, err := h.repo.CreateUpload(requested)
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if upload.ID != requested.ID && !sameUpload(upload, &requested) {
+		http.Error(w, "Idempotency-Key was used for another upload", http.StatusUnprocessableEntity)
+		return
+	}
+
+	// An empty file is complete as soon as it is created.
+	if length == 0 && upload.FileID == "" {
+		if err := h.finishUpload(upload); err != nil {
+			h.uploadError(w, err, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Location", r.Header.Get(forwardedPrefixHeader)+"/uploads/"+upload.ID)
+	writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// sameUpload reports whether two creation requests describe the same upload.
+func sameUpload(a, b *Upload) bool {
+	return a.Length == b.Length && a.Filename == b.Filename && a.DocumentID == b.DocumentID &&
+		a.CourseID == b.CourseID && a.Charset == b.Charset
+}
+
+// patchUpload stores the request body as the next chunk. The offset is
+// advanced only if it still matches, so of two concurrent requests for the
+// same offset one fails with 409. A finished upload whose file could not be
+// saved is retried by a PATCH at its final offset.
+func (h *Handler) patchUpload(w http.ResponseWriter, r *http.Request, upload *Upload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	if offset != upload.Offset {
+		http.Error(w, fmt.Sprintf("Upload-Offset does not match the current offset %d", upload.Offset), http.StatusConflict)
+		return
+	}
+
+	if upload.Offset < upload.Length {
+		key := "uploads/" + upload.ID + "/" + uuid.New().String()
+		chunk := &limitedReader{r: r.Body, remaining: upload.Length - upload.Offset}
+		if err := h.blobs.Put(key, chunk); err != nil {
+			h.blobs.Delete(key)
+			if errors.Is(err, errFileTooLarge) {
+				http.Error(w, "Chunk exceeds Upload-Length", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+			return
+		}
+
+		written := upload.Length - upload.Offset - chunk.remaining
+		if written == 0 {
+			h.blobs.Delete(key)
+		} else {
+			expiresAt := time.Now().Add(uploadTTL)
+			appended, err := h.repo.AppendChunk(upload.ID, offset, offset+written, key, expiresAt)
+			if err != nil || !appended {
+				h.blobs.Delete(key)
+			}
+			if err != nil {
+				http.Error(w, "Failed to save chunk", http.StatusInternalServerError)
+				return
+			}
+			if !appended {
+				http.Error(w, "Upload-Offset does not match the current offset", http.StatusConflict)
+				return
+			}
+			upload.Offset += written
+			upload.Chunks = append(upload.Chunks, key)
+			upload.ExpiresAt = expiresAt
+		}
+	}
+
+	if upload.Offset == upload.Length && upload.FileID == "" {
+		if err := h.finishUpload(upload); err != nil {
+			h.uploadError(w, err, "Failed to save file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	writeUploadHeaders(w, upload)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// finishUpload stores the chunks of a complete upload as a file, going
+// through the same deduplication and checks as a multipart upload. Only one
+// request at a time may store an upload, others get errUploadFinishing, so
+// the file is not stored twice and the chunks are not deleted while
+// another request reads them.
+func (h *Handler) finishUpload(upload *Upload) error {
+	claimed, err := h.repo.ClaimUploadCompletion(upload.ID, uploadFinishLease)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return errUploadFinishing
+	}
+
+	content := &chunkReader{blobs: h.blobs, keys: upload.Chunks}
+	file, _, err := h.storeFile(content, upload.Filename, upload.DocumentID, upload.CourseID, upload.Uploader, upload.Charset)
+	content.Close()
+	if errors.Is(err, errUnsupportedFormat) || errors.Is(err, errExtractionFailed) {
+		// Resending the same bytes cannot succeed.
+		h.repo.DeleteUpload(upload.ID)
+		h.deleteChunks(upload.Chunks)
+		return err
+	}
+	if err != nil {
+		h.repo.ReleaseUploadCompletion(upload.ID)
+		return err
+	}
+
+	expiresAt := time.Now().Add(uploadTTL)
+	if err := h.repo.CompleteUpload(upload.ID, file.ID, expiresAt); err != nil {
+		return err
+	}
+	h.deleteChunks(upload.Chunks)
+
+	upload.FileID = file.ID
+	upload.Chunks = nil
+	upload.ExpiresAt = expiresAt
+	return nil
+}
+
+func (h *Handler) loadUpload(w http.ResponseWriter, r *http.Request) *Upload {
+	id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if id == "" {
+		http.Error(w, "Upload ID is required", http.StatusBadRequest)
+		return nil
+	}
+
+	upload, err := h.repo.GetUpload(id)
+	if err != nil {
+		http.Error(w, "Failed to get upload", http.StatusInternalServerError)
+		return nil
+	}
+	if upload == nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return nil
+	}
+	if upload.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return nil
+	}
+	if principal := principalFrom(r); !principal.Unrestricted() && upload.Uploader != principal.UserID {
+		http.Error(w, "Access to the upload denied", http.StatusForbidden)
+		return nil
+	}
+	return upload
+}
+
+func writeUploadHeaders(w http.ResponseWriter, upload *Upload) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.FileID != "" {
+		w.Header().Set(fileIDHeader, upload.FileID)
+	}
+}
+
+func (h *Handler) deleteChunks(keys []string) {
+	for _, key := range keys {
+		if err := h.blobs.Delete(key); err != nil {
+			log.Printf("Failed to delete upload chunk %s: %v", key, err)
+		}
+	}
+}
+
+// parseUploadMetadata decodes the Upload-Metadata header: comma-separated
+// pairs of a key and a base64-encoded value, which may be omitted.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("invalid Upload-Metadata")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid Upload-Metadata value for %q", key)
+		}
+		metadata[key] = string(value)
+	}
+	return metadata, nil
+}
+
+// chunkReader reads the chunk blobs one after another, opening each one
+// only when the previous one has been read.
+type chunkReader struct {
+	blobs   BlobStore
+	keys    []string
+	current io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.current == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			blob, err := c.blobs.Get(c.keys[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to read chunk %s: %w", c.keys[0], err)
+			}
+			c.current = blob
+			c.keys = c.keys[1:]
+		}
+
+		n, err := c.current.Read(p)
+		if err == io.EOF {
+			c.current.Close()
+			c.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.current != nil {
+		return c.current.Close()
+	}
+	return nil
+}
+
+// ExpireUploads removes uploads that have not changed for uploadTTL together
+// with their chunks.
+func (h *Handler) ExpireUploads() (int, error) {
+	uploads, err := h.repo.ExpiredUploads(time.Now())
+	if err != nil {
+		return 0, err
+	}
+	for i, upload := range uploads {
+		if err := h.repo.DeleteUpload(upload.ID); err != nil {
+			return i, err
+		}
+		h.deleteChunks(upload.Chunks)
+	}
+	return len(uploads), nil
+}
+
+func (h *Handler) RunUploadExpiry(ctx context.Context) {
+	ticker := time.NewTicker(uploadExpiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if expired, err := h.ExpireUploads(); err != nil {
+				log.Printf("Upload expiry: %v", err)
+			} else if expired > 0 {
+				log.Printf("Removed %d expired uploads", expired)
+			}
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tusRequest(method, path, body string) *http.Request {
+	req := internal(httptest.NewRequest(method, path, strings.NewReader(body)))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	return req
+}
+
+func createUpload(t *testing.T, handler *Handler, length int, metadata string) string {
+	req := tusRequest("POST", "/uploads", "")
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", metadata)
+	req.Header.Set(forwardedPrefixHeader, "/api")
+	rr := httptest.NewRecorder()
+	handler.Uploads(rr, req)
+
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	location := rr.Header().Get("Location")
+	if !strings.HasPrefix(location, "/api/uploads/") {
+		t.Fatalf("unexpected Location %q", location)
+	}
+	return strings.TrimPrefix(location, "/api")
+}
+
+func patchUpload(handler *Handler, path string, offset int, chunk string) *httptest.ResponseRecorder {
+	req := tusRequest("PATCH", path, chunk)
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	rr := httptest.NewRecorder()
+	handler.Upload(rr, req)
+	return rr
+}
+
+func TestResumableUpload(t *testing.T) {
+	mockRepo := &MockRepository{Files: make(map[string]FileMetadata)}
+	blobs := NewMockBlobStore()
+	handler := NewHandler(mockRepo, blobs, 1024)
+
+	content := "Сочинение, загруженное по частям"
+	metadata := "filename " + base64.StdEncoding.EncodeToString([]byte("essay.txt"))
+
+	t.Run("Upload in chunks", func(t *testing.T) {
+		path := createUpload(t, handler, len(content), metadata)
+
+		// The first chunk ends in the middle of a Cyrillic letter.
+		rr := patchUpload(handler, path, 0, content[:5])
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Upload-Offset") != "5" {
+			t.Fatalf("first chunk: got status %d, offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+		}
+
+		// The connection dropped: the client asks for the offset and resumes.
+		rr = httptest.NewRecorder()
+		handler.Upload(rr, tusRequest("HEAD", path, ""))
+		if rr.Code != http.StatusOK || rr.Header().Get("Upload-Offset") != "5" {
+			t.Fatalf("HEAD: got status %d, offset %q", rr.Code, rr.Header().Get("Upload-Offset"))
+		}
+
+		if rr := patchUpload(handler, path, 3, content[3:]); rr.Code != http.StatusConflict {
+			t.Errorf("wrong offset: expected status %d, got %d", http.StatusConflict, rr.Code)
+		}
+
+		rr = patchUpload(handler, path, 5, content[5:])
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("last chunk: expected status %d, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+		}
+		file, exists := mockRepo.Files[rr.Header().Get(fileIDHeader)]
+		if !exists {
+			t.Fatal("finished upload was not saved as a file")
+		}
+		if file.Name != "essay.txt" || string(blobs.Blobs[file.Location]) != content {
+			t.Errorf("unexpected file %+v with content %q", file, blobs.Blobs[file.Location])
+		}
+		if len(blobs.Blobs) != 1 {
+			t.Errorf("chunks were not deleted, blobs: %d", len(blobs.Blobs))
+		}
+	})
+
+	t.Run("Finished upload of existing content is deduplicated", func(t *testing.T) {
+		filesBefore := len(mockRepo.Files)
+		path := createUpload(t, handler, len(content), metadata)
+		rr := patchUpload(handler, path, 0, content)
+
+		if rr.Code != http.StatusNoContent || rr.Header().Get(fileIDHeader) == "" {
+			t.Fatalf("expected status %d with a file ID, got %d", http.StatusNoContent, rr.Code)
+		}
+		if len(mockRepo.Files) != filesBefore || len(blobs.Blobs) != 1 {
+			t.Errorf("duplicate upload created a file or kept blobs")
+		}
+	})
+
+	t.Run("Upload stored by another request", func(t *testing.T) {
+		path := createUpload(t, handler, len(content), metadata)
+		id := strings.TrimPrefix(path, "/uploads/")
+		if claimed, _ := mockRepo.ClaimUploadCompletion(id, uploadFinishLease); !claimed {
+			t.Fatal("failed to claim a new upload")
+		}
+
+		if rr := patchUpload(handler, path, 0, content); rr.Code != http.StatusLocked {
+			t.Fatalf("expected status %d, got %d", http.StatusLocked, rr.Code)
+		}
+		if mockRepo.Uploads[id].FileID != "" {
+			t.Error("upload was stored while another request stores it")
+		}
+
+		mockRepo.ReleaseUploadCompletion(id)
+		rr := patchUpload(handler, path, len(content), "")
+		if rr.Code != http.StatusNoContent || rr.Header().Get(fileIDHeader) == "" {
+			t.Fatalf("expected status %d with a file ID, got %d: %s", http.StatusNoContent, rr.Code, rr.Body.String())
+		}
+		if len(blobs.Blobs) != 1 {
+			t.Errorf("chunks were not deleted, blobs: %d", len(blobs.Blobs))
+		}
+	})
+
+	t.Run("Repeated creation with Idempotency-Key", func(t *testing.T) {
+		create := func(length int) *httptest.ResponseRecorder {
+			req := tusRequest("POST", "/uploads", "")
+			req.Header.Set("Upload-Length", strconv.Itoa(length))
+			req.Header.Set("Upload-Metadata", metadata)
+			req.Header.Set(idempotencyKeyHeader, "k1")
+			rr := httptest.NewRecorder()
+			handler.Uploads(rr, req)
+			return rr
+		}
+
+		first := create(10)
+		patchUpload(handler, first.Header().Get("Location"), 0, "12345")
+		second := create(10)
+		if second.Code != http.StatusCreated || second.Header().Get("Location") != first.Header().Get("Location") {
+			t.Fatalf("expected the first upload, got status %d, Location %q", second.Code, second.Header().Get("Location"))
+		}
+		if second.Header().Get("Upload-Offset") != "5" {
+			t.Errorf("expected offset 5, got %q", second.Header().Get("Upload-Offset"))
+		}
+		if rr := create(20); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status %d for another upload, got %d", http.StatusUnprocessableEntity, rr.Code)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.Upload(rr, tusRequest("DELETE", first.Header().Get("Location"), ""))
+	})
+
+	t.Run("Termination", func(t *testing.T) {
+		path := createUpload(t, handler, 10, metadata)
+		patchUpload(handler, path, 0, "12345")
+
+		rr := httptest.NewRecorder()
+		handler.Upload(rr, tusRequest("DELETE", path, ""))
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status %d, got %d", http.StatusNoContent, rr.Code)
+		}
+		if len(blobs.Blobs) != 1 {
+			t.Error("chunks of a terminated upload were kept")
+		}
+
+		rr = httptest.NewRecorder()
+		handler.Upload(rr, tusRequest("HEAD", path, ""))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status %d after termination, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		path := createUpload(t, handler, 10, metadata)
+		patchUpload(handler, path, 0, "12345")
+		mockRepo.Uploads[strings.TrimPrefix(path, "/uploads/")].ExpiresAt = time.Now().Add(-time.Minute)
+
+		rr := httptest.NewRecorder()
+		handler.Upload(rr, tusRequest("HEAD", path, ""))
+		if rr.Code != http.StatusGone {
+			t.Errorf("expected status %d, got %d", http.StatusGone, rr.Code)
+		}
+
+		if expired, err := handler.ExpireUploads(); err != nil || expired != 1 {
+			t.Errorf("expected 1 expired upload, got %d (%v)", expired, err)
+		}
+		if len(blobs.Blobs) != 1 {
+			t.Error("chunks of an expired upload were kept")
+		}
+	})
+
+	t.Run("Protocol errors", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.Uploads(rr, httptest.NewRequest("POST", "/uploads", nil))
+		if rr.Code != http.StatusPreconditionFailed {
+			t.Errorf("missing Tus-Resumable: expected %d, got %d", http.StatusPreconditionFailed, rr.Code)
+		}
+
+		req := tusRequest("POST", "/uploads", "")
+		req.Header.Set("Upload-Length", "2048")
+		req.Header.Set("Upload-Metadata", metadata)
+		rr = httptest.NewRecorder()
+		handler.Uploads(rr, req)
+		if rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("too large: expected %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+
+		path := createUpload(t, handler, 4, metadata)
+		if rr := patchUpload(handler, path, 0, "12345"); rr.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("chunk beyond Upload-Length: expected %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+		}
+
+		rr = httptest.NewRecorder()
+		handler.Uploads(rr, httptest.NewRequest("OPTIONS", "/uploads", nil))
+		if rr.Code != http.StatusNoContent || rr.Header().Get("Tus-Extension") != tusExtensions {
+			t.Errorf("OPTIONS: got status %d, extensions %q", rr.Code, rr.Header().Get("Tus-Extension"))
+		}
+	})
+}